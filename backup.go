@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
+)
+
+// loadReleaseBackup reads a release object, as stored by the storage drivers,
+// from a JSON file.
+func loadReleaseBackup(path string) (*release.Release, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rel := &release.Release{}
+	if err := json.Unmarshal(data, rel); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse release backup %s", path)
+	}
+
+	switch {
+	case rel.Name == "":
+		return nil, errors.Errorf("invalid release backup %s: missing name", path)
+	case rel.Version < 1:
+		return nil, errors.Errorf("invalid release backup %s: missing version", path)
+	case rel.Info == nil:
+		return nil, errors.Errorf("invalid release backup %s: missing info", path)
+	}
+	return rel, nil
+}
+
+// useReleaseBackup replaces the release storage of c with an in-memory store
+// holding only rel, so the release is read from the backup rather than the
+// cluster.
+func useReleaseBackup(c *action.Configuration, rel *release.Release) error {
+	mem := driver.NewMemory()
+	mem.SetNamespace(rel.Namespace)
+	c.Releases = storage.Init(mem)
+	return c.Releases.Create(rel)
+}
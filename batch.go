@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/bacongobbler/helm-patchdiff/pkg/patchdiff"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"helm.sh/helm/v3/pkg/chart"
+	"sigs.k8s.io/yaml"
+)
+
+// batchEntry is one chart of a batch run and the release it is diffed
+// against.
+type batchEntry struct {
+	chartDir string
+	release  string
+	out      string
+	err      error
+}
+
+func newBatchCmd() *cobra.Command {
+	valueOpts := &valueOptions{}
+	opts := &options{}
+	var releaseMap string
+	// chartConcurrency is the number of charts diffed in parallel, each
+	// reading patchdiff.DefaultConcurrency resources at a time.
+	var chartConcurrency int
+
+	cmd := &cobra.Command{
+		Use:   "batch <DIR> --release-map <FILE> [options]",
+		Short: "Preview upgrades of every chart in a directory",
+		Long:  "Preview upgrades of every chart in a directory, each against the release it is mapped to in the release map",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if chartConcurrency < 1 {
+				log.Fatalf("invalid concurrency %d: must be at least 1", chartConcurrency)
+			}
+			if err := completeOptions(opts); err != nil {
+				log.Fatal(err)
+			}
+
+			entries, err := loadReleaseMap(releaseMap)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			charts := make([]*chart.Chart, len(entries))
+			vals := make([]map[string]interface{}, len(entries))
+			for i, e := range entries {
+				if charts[i], vals[i], err = loadChart(filepath.Join(args[0], e.chartDir), valueOpts, opts); err != nil {
+					log.Fatalf("chart %s: %s", e.chartDir, err)
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+			defer cancel()
+			actionConfig, err := newActionConfig(ctx, opts)
+			if err != nil {
+				log.Fatal(err)
+			}
+			// discover capabilities up front so concurrent diffs share them
+			// rather than race to fill them in
+			if err := patchdiff.GetCapabilities(ctx, actionConfig); err != nil {
+				log.Fatal(err)
+			}
+
+			var wg sync.WaitGroup
+			sem := make(chan struct{}, chartConcurrency)
+			for i := range entries {
+				wg.Add(1)
+				go func(e *batchEntry, ch *chart.Chart, vals map[string]interface{}) {
+					defer wg.Done()
+					sem <- struct{}{}
+					defer func() { <-sem }()
+					e.out, e.err = diffRelease(actionConfig, e.release, ch, vals, opts)
+				}(entries[i], charts[i], vals[i])
+			}
+			wg.Wait()
+
+			if err := writeMetrics(opts); err != nil {
+				log.Fatal(err)
+			}
+
+			failed := 0
+			var summaries []string
+			stdout := newOutputWriter(opts.Gzip)
+			for _, e := range entries {
+				switch {
+				case opts.Output == "fleet-summary":
+					summaries = append(summaries, e.out)
+				case e.out != "":
+					fmt.Fprintf(stdout, "# Chart: %s (release %s)\n%s\n", e.chartDir, e.release, e.out)
+				}
+				if e.err != nil {
+					log.Printf("chart %s (release %s): %s", e.chartDir, e.release, e.err)
+					failed++
+				}
+			}
+			if err := writeFleetSummary(stdout, summaries, opts); err != nil {
+				log.Fatal(err)
+			}
+			if err := stdout.Close(); err != nil {
+				log.Fatal(err)
+			}
+			if failed > 0 {
+				log.Fatalf("%d of %d chart(s) failed", failed, len(entries))
+			}
+			exitOnChanges(opts)
+			return nil
+		},
+	}
+
+	f := cmd.Flags()
+	addValueOptionsFlags(f, valueOpts)
+	addDiffFlags(f, opts)
+	f.StringVar(&releaseMap, "release-map", "", "YAML file mapping each chart subdirectory of <DIR> to the name of the release it upgrades")
+	f.IntVar(&chartConcurrency, "concurrency", 1, "number of charts to diff in parallel")
+	cmd.MarkFlagRequired("release-map")
+
+	return cmd
+}
+
+// loadReleaseMap reads a YAML mapping of chart subdirectory to release name,
+// ordered by subdirectory.
+func loadReleaseMap(path string) ([]*batchEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]string{}
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse release map %s", path)
+	}
+	if len(m) == 0 {
+		return nil, errors.Errorf("release map %s maps no charts", path)
+	}
+
+	entries := make([]*batchEntry, 0, len(m))
+	for dir, release := range m {
+		if err := validateReleaseName(release); err != nil {
+			return nil, errors.Wrapf(err, "chart %s", dir)
+		}
+		entries = append(entries, &batchEntry{chartDir: dir, release: release})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].chartDir < entries[j].chartDir })
+	return entries, nil
+}
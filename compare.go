@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/bacongobbler/helm-patchdiff/pkg/patchdiff"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+func newCompareValuesCmd() *cobra.Command {
+	valueOpts := &valueOptions{}
+	otherOpts := &valueOptions{}
+	var releaseName string
+
+	cmd := &cobra.Command{
+		Use:   "compare-values <CHART> -f <FILE> --values-other <FILE> [options]",
+		Short: "Show how two sets of values change the rendered chart",
+		Long:  "Render a chart with two sets of values and show the patches between the results, without contacting a cluster",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := validateReleaseName(releaseName); err != nil {
+				log.Fatal(err)
+			}
+
+			var manifests [2]string
+			for i, v := range []*valueOptions{valueOpts, otherOpts} {
+				// each side loads its own copy, since processing dependencies
+				// prunes disabled subcharts from the chart
+				ch, vals, err := loadChart(args[0], v, &options{})
+				if err != nil {
+					log.Fatal(err)
+				}
+				if manifests[i], err = patchdiff.RenderOffline(ch, vals, releaseName, settings.Namespace()); err != nil {
+					log.Fatal(err)
+				}
+			}
+
+			entries, err := patchdiff.CompareManifests(manifests[0], manifests[1])
+			if err != nil {
+				log.Fatal(err)
+			}
+			out, err := json.Marshal(entries)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println(string(out))
+			return nil
+		},
+	}
+
+	f := cmd.Flags()
+	addValueOptionsFlags(f, valueOpts)
+	f.StringSliceVar(&otherOpts.ValueFiles, "values-other", []string{}, "values files of the other side of the comparison, also --f-other (can specify multiple)")
+	f.StringArrayVar(&otherOpts.Values, "set-other", []string{}, "set values of the other side of the comparison on the command line (can specify multiple or separate values with commas: key1=val1,key2=val2)")
+	f.StringArrayVar(&otherOpts.StringValues, "set-string-other", []string{}, "set STRING values of the other side of the comparison on the command line (can specify multiple or separate values with commas: key1=val1,key2=val2)")
+	f.StringArrayVar(&otherOpts.JSONValues, "set-json-other", []string{}, "set JSON values of the other side of the comparison on the command line (can specify multiple or separate values with commas: key1=jsonval1,key2=jsonval2)")
+	f.StringArrayVar(&otherOpts.LiteralValues, "set-literal-other", []string{}, "set a literal STRING value of the other side of the comparison on the command line")
+	f.StringArrayVar(&otherOpts.FileValues, "set-file-other", []string{}, "set values of the other side of the comparison from respective files specified via the command line (can specify multiple or separate values with commas: key1=path1,key2=path2)")
+	// --f-other mirrors -f
+	f.SetNormalizeFunc(func(f *pflag.FlagSet, name string) pflag.NormalizedName {
+		if name == "f-other" {
+			name = "values-other"
+		}
+		return pflag.NormalizedName(name)
+	})
+	f.StringVar(&releaseName, "release-name", "release-name", "release name the chart is rendered for")
+
+	return cmd
+}
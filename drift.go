@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/bacongobbler/helm-patchdiff/pkg/patchdiff"
+	"github.com/spf13/cobra"
+)
+
+func newDriftLiveCmd() *cobra.Command {
+	opts := &options{}
+
+	cmd := &cobra.Command{
+		Use:   "drift-live <NAME> [options]",
+		Short: "Show how live objects have drifted from the release",
+		Long:  "Show how live objects have drifted from what Helm recorded in the release, without rendering a chart",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			if err := validateReleaseName(name); err != nil {
+				log.Fatal(err)
+			}
+			if opts.normalizeConfigFile != "" {
+				normalizer, err := patchdiff.LoadNormalizeConfig(opts.normalizeConfigFile)
+				if err != nil {
+					log.Fatal(err)
+				}
+				opts.Normalizer = normalizer
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+			defer cancel()
+			actionConfig, err := newActionConfig(ctx, opts)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			_, currentRelease, err := patchdiff.FindReleases(actionConfig, name)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			if err := patchdiff.ReportDrift(ctx, os.Stdout, actionConfig, currentRelease.Manifest, &opts.Options); err != nil {
+				log.Fatal(err)
+			}
+			return nil
+		},
+	}
+
+	f := cmd.Flags()
+	f.StringVar(&opts.normalizeConfigFile, "normalize-config", "", "YAML file of paths, annotation prefixes and label prefixes to ignore when diffing, globally or per kind")
+	addTimeoutFlag(f, opts)
+	f.BoolVar(&opts.BatchFetch, "batch-fetch", false, "fetch live objects with one list call per kind and namespace when a release has several resources of that kind")
+
+	return cmd
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bacongobbler/helm-patchdiff/pkg/patchdiff"
+	"github.com/spf13/cobra"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/getter"
+)
+
+func newExplainCreateCmd() *cobra.Command {
+	valueOpts := &valueOptions{}
+	var selector string
+	var timeout time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "explain-create <NAME> <CHART> --resource <KIND>/<NAME> [options]",
+		Short: "Explain why a resource would be created rather than patched",
+		Long:  "Explain why a resource would be created rather than patched by looking it up in the cluster",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			if err := validateReleaseName(name); err != nil {
+				log.Fatal(err)
+			}
+
+			kind, resourceName, err := parseResourceSelector(selector)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			valueOpts.timeout = timeout
+			vals, err := valueOpts.MergeValues(getter.All(settings))
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			ch, err := loader.Load(args[1])
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			setRequestTimeout(settings.RESTClientGetter(), timeout)
+			actionConfig := new(action.Configuration)
+			if err := actionConfig.Init(settings.RESTClientGetter(), settings.Namespace(), os.Getenv("HELM_DRIVER"), log.Printf); err != nil {
+				log.Fatalf("%+v", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			if err := patchdiff.IsReachable(ctx, actionConfig); err != nil {
+				log.Fatal(err)
+			}
+
+			originalManifest, targetManifest, err := patchdiff.PrepareUpgrade(ctx, actionConfig, name, ch, vals, &patchdiff.Options{})
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			if err := patchdiff.ExplainCreate(ctx, os.Stdout, actionConfig, originalManifest, targetManifest, kind, resourceName); err != nil {
+				log.Fatal(err)
+			}
+			return nil
+		},
+	}
+
+	f := cmd.Flags()
+	addValueOptionsFlags(f, valueOpts)
+	f.StringVar(&selector, "resource", "", "the resource to explain, as <KIND>/<NAME>")
+	f.DurationVar(&timeout, "timeout", 30*time.Second, timeoutUsage)
+	cmd.MarkFlagRequired("resource")
+
+	return cmd
+}
+
+// parseResourceSelector splits a <KIND>/<NAME> selector into its parts.
+func parseResourceSelector(selector string) (string, string, error) {
+	parts := strings.SplitN(selector, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid resource %q: must be of the form <KIND>/<NAME>", selector)
+	}
+	return parts[0], parts[1], nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/provenance"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// verifyLock checks that the chart's lock file is in sync with both the
+// dependencies declared in Chart.yaml and the subcharts vendored in charts/.
+func verifyLock(ch *chart.Chart) error {
+	if ch.Lock == nil {
+		if len(ch.Metadata.Dependencies) > 0 {
+			return errors.Errorf("chart %s declares dependencies but has no lock file", ch.Name())
+		}
+		return nil
+	}
+
+	req, err := resolveRepoAliases(ch.Metadata.Dependencies)
+	if err != nil {
+		return err
+	}
+	digest, err := hashReq(req, ch.Lock.Dependencies)
+	if err != nil {
+		return err
+	}
+	if digest != ch.Lock.Digest {
+		return errors.New("the lock file (Chart.lock) is out of sync with the dependencies file (Chart.yaml). Please update the dependencies")
+	}
+
+	vendored := map[string]string{}
+	for _, dep := range ch.Dependencies() {
+		vendored[dep.Name()] = dep.Metadata.Version
+	}
+
+	var stale []string
+	for _, dep := range ch.Lock.Dependencies {
+		version, ok := vendored[dep.Name]
+		switch {
+		case !ok:
+			stale = append(stale, fmt.Sprintf("%s: locked at %s but missing from charts/", dep.Name, dep.Version))
+		case version != dep.Version:
+			stale = append(stale, fmt.Sprintf("%s: locked at %s but charts/ contains %s", dep.Name, dep.Version, version))
+		}
+	}
+	if len(stale) > 0 {
+		return errors.Errorf("the contents of charts/ do not match the lock file (Chart.lock):\n  %s", strings.Join(stale, "\n  "))
+	}
+	return nil
+}
+
+// hashReq computes the lock digest the same way Helm does when it writes
+// Chart.lock.
+func hashReq(req, lock []*chart.Dependency) (string, error) {
+	data, err := json.Marshal([2][]*chart.Dependency{req, lock})
+	if err != nil {
+		return "", err
+	}
+	s, err := provenance.Digest(bytes.NewBuffer(data))
+	return "sha256:" + s, err
+}
+
+// resolveRepoAliases returns a copy of deps with "@name" and "alias:name"
+// repositories replaced by their URLs, as Helm does before hashing.
+func resolveRepoAliases(deps []*chart.Dependency) ([]*chart.Dependency, error) {
+	rf, err := repo.LoadFile(settings.RepositoryConfig)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, err
+	}
+
+	resolved := make([]*chart.Dependency, 0, len(deps))
+	for _, dep := range deps {
+		d := *dep
+		alias := strings.TrimPrefix(strings.TrimPrefix(d.Repository, "@"), "alias:")
+		if alias != d.Repository && rf != nil {
+			if entry := rf.Get(alias); entry != nil {
+				d.Repository = entry.URL
+			}
+		}
+		resolved = append(resolved, &d)
+	}
+	return resolved, nil
+}
@@ -2,13 +2,23 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
+	"crypto/sha256"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
-	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/Masterminds/semver/v3"
+	"github.com/bacongobbler/helm-patchdiff/pkg/patchdiff"
+	"github.com/fatih/color"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
@@ -17,313 +27,818 @@ import (
 	"helm.sh/helm/v3/pkg/chart/loader"
 	"helm.sh/helm/v3/pkg/chartutil"
 	"helm.sh/helm/v3/pkg/cli"
-	"helm.sh/helm/v3/pkg/cli/values"
-	"helm.sh/helm/v3/pkg/engine"
+	"helm.sh/helm/v3/pkg/downloader"
 	"helm.sh/helm/v3/pkg/getter"
 	"helm.sh/helm/v3/pkg/kube"
 	"helm.sh/helm/v3/pkg/release"
-	"helm.sh/helm/v3/pkg/releaseutil"
+	"helm.sh/helm/v3/pkg/repo"
 	"helm.sh/helm/v3/pkg/storage/driver"
-	apiextv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
-	apierrors "k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/util/strategicpatch"
-	"k8s.io/cli-runtime/pkg/resource"
-	"k8s.io/client-go/discovery"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
 )
 
 var settings = cli.New()
 
+// options holds the flags that control how charts and values are loaded and
+// which cluster is diffed against, along with the options of the diff itself.
+type options struct {
+	patchdiff.Options
+	// env selects a values file named after envValuesPattern, merged before
+	// any files given with --values.
+	env              string
+	envValuesPattern string
+	// valuesDir holds values files merged in lexical order before any files
+	// given with --values, descending into subdirectories when
+	// valuesDirRecursive is set.
+	valuesDir          string
+	valuesDirRecursive bool
+	// renderValuesSprig renders values files as templates with the sprig
+	// functions before they are parsed.
+	renderValuesSprig bool
+	// valuesJSON is a JSON values file merged after every other values file.
+	valuesJSON string
+	// typedValues are key:type=value overrides applied after all other values.
+	typedValues []string
+	// stringFileValues are key=path pairs whose file content is set as a
+	// string, applied before typedValues.
+	stringFileValues []string
+	// targetKubeContext, when set, is the kubeconfig context used for live
+	// lookups and capabilities, while the release is still read from the
+	// current context.
+	targetKubeContext string
+	// releaseBackup, when set, is a JSON file the release is read from
+	// instead of the cluster's release storage.
+	releaseBackup string
+	// releaseSelector, when set, diffs every release whose storage objects
+	// match this label selector instead of a single named release.
+	releaseSelector string
+	// expectKubeVersion is a semver constraint the cluster's version must
+	// satisfy.
+	expectKubeVersion string
+	// apiVersions are added to the API versions discovered on the cluster, or
+	// to the default versions when kubeVersion is set.
+	apiVersions []string
+	// kubeVersion, when set, is the Kubernetes version rendered for instead
+	// of the cluster's, and the diff runs offline.
+	kubeVersion string
+	// normalizeConfigFile is the --normalize-config file, loaded into
+	// Normalizer, whose rules remove noise before diffing.
+	normalizeConfigFile string
+	// prometheusTextfile is where metrics for the node_exporter textfile
+	// collector are written, as recorded by metrics.
+	prometheusTextfile string
+	metrics            *metricsRecorder
+	// postRenderer and postRendererArgs are the --post-renderer executable
+	// and its arguments, built into PostRenderer.
+	postRenderer     string
+	postRendererArgs []string
+	// chartPathOptions locate a chart that is not a local path, as helm
+	// upgrade does. devel selects development versions when no version is
+	// set.
+	chartPathOptions action.ChartPathOptions
+	devel            bool
+	// chartDigest, when set, pins the chart archive to this sha256 digest.
+	chartDigest string
+	// verifyLock fails the run when Chart.lock is out of sync with charts/.
+	verifyLock bool
+	// dumpValues prints the values passed to the template engine to stderr,
+	// as DumpValues.
+	dumpValues bool
+	// timeout bounds the time spent waiting for the cluster to connect and
+	// for each release, each single request to it, and each remote values
+	// file.
+	timeout time.Duration
+	// detailedExitCode exits with 2 when any diffed release changes, which
+	// changed records. It is set atomically, as batch diffs concurrently.
+	detailedExitCode bool
+	changed          int32
+}
+
 func main() {
-	valueOpts := &values.Options{}
+	if os.Getenv("NO_COLOR") != "" {
+		// https://no-color.org; color already leaves out colors when
+		// stdout is not a terminal
+		color.NoColor = true
+	}
+
+	valueOpts := &valueOptions{}
+	opts := &options{}
 	var rootCmd = &cobra.Command{
 		Use:   "patchdiff <NAME> <CHART> [options]",
 		Short: "Preview helm upgrade changes as a JSON patch",
 		Long:  "Preview helm upgrade changes as a JSON patch",
-		Args:  cobra.ExactArgs(2),
+		Args: func(cmd *cobra.Command, args []string) error {
+			n := 2
+			if opts.releaseSelector != "" {
+				n--
+			}
+			if opts.KustomizeDir != "" {
+				n--
+			}
+			// missing arguments may be provided by the environment
+			return cobra.MaximumNArgs(n)(cmd, args)
+		},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			name := args[0]
-			if err := validateReleaseName(name); err != nil {
+			name, chartPath, err := resolveArgs(args, opts.releaseSelector == "", opts.KustomizeDir == "")
+			if err != nil {
 				log.Fatal(err)
 			}
+			if opts.releaseSelector == "" {
+				if err := validateReleaseName(name); err != nil {
+					log.Fatal(err)
+				}
+			}
 
-			chartPath := args[1]
-
-			vals, err := valueOpts.MergeValues(getter.All(settings))
-			if err != nil {
+			if err := completeOptions(opts); err != nil {
 				log.Fatal(err)
 			}
 
-			ch, err := loader.Load(chartPath)
+			var ch *chart.Chart
+			var vals map[string]interface{}
+			if opts.KustomizeDir == "" {
+				if chartPath, err = locateChart(chartPath, opts); err != nil {
+					log.Fatal(err)
+				}
+				if opts.ChartDigest, err = chartArchiveDigest(chartPath, opts.chartDigest); err != nil {
+					log.Fatal(err)
+				}
+				if ch, vals, err = loadChart(chartPath, valueOpts, opts); err != nil {
+					log.Fatal(err)
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+			defer cancel()
+			actionConfig, err := newActionConfig(ctx, opts)
 			if err != nil {
 				log.Fatal(err)
 			}
 
-			patchset, err := createPatchset(name, ch, vals)
+			stdout := newOutputWriter(opts.Gzip)
+			if opts.releaseSelector == "" {
+				out, err := diffRelease(actionConfig, name, ch, vals, opts)
+				// output is still printed when policy checks fail
+				if out != "" {
+					fmt.Fprintln(stdout, out)
+				}
+				if err := stdout.Close(); err != nil {
+					log.Fatal(err)
+				}
+				if err := writeMetrics(opts); err != nil {
+					log.Fatal(err)
+				}
+				if err != nil {
+					log.Fatal(err)
+				}
+				exitOnChanges(opts)
+				return nil
+			}
+
+			names, err := releasesForSelector(actionConfig, opts.releaseSelector)
 			if err != nil {
 				log.Fatal(err)
 			}
-			fmt.Println(patchset)
+			var summaries []string
+			for _, name := range names {
+				out, err := diffRelease(actionConfig, name, ch, vals, opts)
+				switch {
+				case opts.Output == "fleet-summary":
+					summaries = append(summaries, out)
+				case out != "":
+					fmt.Fprintf(stdout, "# Release: %s\n%s\n", name, out)
+				}
+				if err != nil {
+					stdout.Close()
+					log.Fatalf("release %s: %s", name, err)
+				}
+			}
+			if err := writeFleetSummary(stdout, summaries, opts); err != nil {
+				log.Fatal(err)
+			}
+			if err := stdout.Close(); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Fprintf(os.Stderr, "Diffed %d release(s) matching %q: %s\n", len(names), opts.releaseSelector, strings.Join(names, ", "))
+			if err := writeMetrics(opts); err != nil {
+				log.Fatal(err)
+			}
+			exitOnChanges(opts)
 			return nil
 		},
 	}
 
 	f := rootCmd.Flags()
 	addValueOptionsFlags(f, valueOpts)
+	addDiffFlags(f, opts)
+	addChartPathOptionsFlags(f, opts)
+	f.IntVar(&opts.Concurrency, "concurrency", patchdiff.DefaultConcurrency, "number of resources of each release whose live state is read and diffed in parallel")
+	f.StringVar(&opts.releaseSelector, "release-selector", "", "diff every release whose storage secrets or configmaps match this label selector; the release name argument is omitted")
+	f.StringVar(&opts.KustomizeDir, "kustomize", "", "build the target from the kustomization in this directory instead of rendering a chart (value flags are ignored)")
+
+	settings.AddFlags(rootCmd.PersistentFlags())
+
+	rootCmd.AddCommand(newExplainCreateCmd())
+	rootCmd.AddCommand(newBatchCmd())
+	rootCmd.AddCommand(newDriftLiveCmd())
+	rootCmd.AddCommand(newUninstallCmd())
+	rootCmd.AddCommand(newCompareValuesCmd())
 
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func createPatchset(name string, ch *chart.Chart, vals map[string]interface{}) (string, error) {
-	patches := []string{}
+// addDiffFlags adds the flags shared by every command that previews a chart.
+func addDiffFlags(f *pflag.FlagSet, opts *options) {
+	f.StringVar(&opts.env, "env", "", "merge the values file for this environment, found inside or next to the chart, before any --values files")
+	f.StringVar(&opts.envValuesPattern, "env-values-pattern", "values-%s.yaml", "file name pattern of the values file selected by --env")
+	f.StringVar(&opts.valuesDir, "values-dir", "", "merge every *.yaml and *.yml file in this directory, in lexical order, before any --values files")
+	f.BoolVar(&opts.valuesDirRecursive, "values-dir-recursive", false, "also merge *.yaml and *.yml files in subdirectories of --values-dir, ordered by their path")
+	f.BoolVar(&opts.renderValuesSprig, "render-values-sprig", false, "render local values files as Go templates with the sprig functions before parsing them, with the chart's default values as .Values and the environment as .Env")
+	f.StringVar(&opts.valuesJSON, "values-json", "", "specify values in a JSON file, merged after all other values files")
+	f.StringArrayVar(&opts.stringFileValues, "set-string-file", []string{}, "set STRING values from the content of files, without any interpretation (can specify multiple: key1=path1)")
+	f.StringArrayVar(&opts.typedValues, "set-type", []string{}, "set values on the command line with an explicit type of string, int, float or bool (can specify multiple: key1:int=8080)")
+	f.StringVarP(&opts.Output, "output", "o", "json", "output format: json prints the patches with the resource and patch type of each, raw prints only the patches, target-yaml prints the target objects as multi-document YAML, snapshots writes before and after YAML of each changed resource to --snapshot-dir, junit reports each resource as a test case that fails when it is deleted, changes immutable fields or violates --fail-on-change-to, argocd prints live and desired YAML of out-of-sync resources as argocd app diff does, patchbundle prints a versioned document of patches to apply, delta lists the changed paths of each resource with their new values, diff prints a colored unified diff of the YAML of each changed resource, csv prints a row of namespace, kind, name, change, fields_changed and patch_type for each changed resource, fleet-summary lists the kinds that change in each namespace, rolled up across every release diffed, html prints a self-contained report with a collapsible diff of each changed resource, written to --output-dir when set")
+	f.IntVar(&opts.MaxValueWidth, "max-value-width", 60, "truncate values printed by --output delta to this many characters, or 0 to print them whole")
+	f.IntVar(&opts.MaxDepth, "max-depth", 0, "collapse sub-objects nested deeper than this into {...} in --output diff, argocd, delta, target-yaml and html, where the fields of an object are at depth 1, or 0 to print them whole")
+	f.StringVar(&opts.DiffFormat, "diff-format", "patch", "how changes are described: patch prints the raw patches, semantic describes changes to replicas, images, resource limits and env vars in plain English")
+	f.BoolVar(&opts.WithContextResources, "with-context-resources", false, "with --diff-format semantic, list the unchanged resources of the same kind in the same namespace below each changed resource")
+	f.BoolVar(&opts.ExplainPatchType, "explain-patch-type", false, "print to stderr how many resources were patched with a strategic merge patch and how many with a merge patch, and why")
+	f.StringVar(&opts.prometheusTextfile, "prometheus-textfile", "", "also write metrics about the resources each release would change to this file, for the node_exporter textfile collector")
+	f.BoolVar(&opts.Summary, "summary", false, "print to stderr how many resources of each kind would be modified, created and deleted, leaving the output on stdout as it is")
+	f.BoolVar(&opts.CountOnly, "count-only", false, "print only the number of resources that would be created, patched or deleted")
+	f.BoolVar(&opts.SourceComments, "source-comments", false, "annotate target-yaml output with the template each object was rendered from")
+	f.BoolVar(&opts.Gzip, "gzip", false, "gzip-compress the output, and the files written to --snapshot-dir, for archiving")
+	f.StringVar(&opts.SnapshotDir, "snapshot-dir", "", "directory to write snapshots output to")
+	f.StringVar(&opts.OutputDir, "output-dir", "", "write the patch of each resource to its own <namespace>-<kind>-<name>.json file in this directory, created if missing, instead of printing the patchset")
+	f.BoolVar(&opts.dumpValues, "dump-values", false, "print the coalesced values passed to the template engine to stderr before rendering, with the builtin engine")
+	f.BoolVar(&opts.IncludeHooks, "include-hooks", false, "also diff the chart's hooks, such as pre-upgrade Jobs, marking their entries with their hook events")
+	f.BoolVar(&opts.IncludeTestHooks, "include-test-hooks", false, "list the resources helm test would create, such as test Pods, after the patch entries as created entries with their hook events")
+	f.BoolVar(&opts.ValidateRender, "validate-render", false, "build every rendered document before diffing and report all that fail with the template they came from")
+	f.BoolVar(&opts.verifyLock, "verify-lock", false, "fail if Chart.lock is out of sync with Chart.yaml or the contents of charts/")
+	f.StringVar(&opts.normalizeConfigFile, "normalize-config", "", "YAML file of paths, annotation prefixes and label prefixes to ignore when diffing, globally or per kind")
+	f.BoolVar(&opts.Force, "force", false, "preview helm upgrade --force: resources with changes to immutable fields are replaced (deleted and recreated) instead of patched")
+	f.BoolVar(&opts.CheckFieldOwnership, "check-field-ownership", false, "report on stderr the fields each patch changes that another field manager owns on the live object, which may conflict with server-side apply")
+	f.StringVar(&opts.FieldManager, "field-manager", "helm", "the field manager upgrades are applied as, whose own fields --check-field-ownership does not report")
+	f.BoolVar(&opts.WithRollback, "with-rollback", false, "with --output patchbundle, also give each entry the patch that restores the live configuration after it was applied")
+	f.DurationVar(&opts.FreshnessWindow, "freshness-window", 0, "note resources whose live state was changed within this duration, e.g. 5m, according to their managed fields")
+	f.BoolVar(&opts.VerifyPatches, "verify-patches", false, "apply each patch to the object it was computed against and warn when the result does not match the target")
+	f.BoolVar(&opts.ShowManagedFields, "show-managed-fields", false, "diff the fields the API server maintains, such as metadata.managedFields, metadata.resourceVersion, metadata.uid, metadata.creationTimestamp and status, instead of removing them first")
+	f.BoolVar(&opts.SpecOnly, "spec-only", false, "only diff spec, or data for ConfigMaps and Secrets, ignoring metadata such as labels and annotations, and status")
+	f.BoolVar(&opts.IgnoreListOrder, "ignore-list-order", false, "ignore changes that only reorder lists of objects, such as env vars or tolerations, by sorting them before diffing")
+	f.BoolVar(&opts.SkipForbidden, "skip-forbidden", false, "skip resources whose live state cannot be read because access is forbidden, and list them on stderr, instead of failing")
+	f.BoolVar(&opts.BatchFetch, "batch-fetch", false, "fetch live objects with one list call per kind and namespace when a release has several resources of that kind")
+	f.BoolVar(&opts.Strict, "strict", false, "fail rendering when a template references a value that was not passed in; the lookup function finds nothing in this mode")
+	f.StringVar(&opts.postRenderer, "post-renderer", "", "the path to an executable to be used for post rendering, as with helm upgrade. If it exists in $PATH, the binary will be used, otherwise it will try to look for the executable at the given path")
+	f.StringArrayVar(&opts.postRendererArgs, "post-renderer-args", []string{}, "an argument to the post-renderer (can specify multiple)")
+	f.StringVar(&opts.PatchType, "patch-type", "strategic", "type of the patches printed: strategic uses strategic merge patches, or JSON merge patches for custom resources, json uses RFC 6902 JSON Patches that apply with kubectl patch --type=json")
+	f.BoolVar(&opts.WithHashes, "with-hashes", false, "add to each entry of json output the sha256 of its patch and of its target object, as patchHash and targetHash")
+	f.BoolVar(&opts.Envelope, "envelope", false, "print json output as an object with the patch entries as \"patches\" and the warnings of the run, each with a code and a message, as \"warnings\"")
+	f.BoolVar(&opts.WithTests, "with-tests", false, "precede each replace and remove of --patch-type json patches with a test operation asserting the live value, so a patch no longer applies once the object changed")
+	f.StringVar(&opts.Engine, "engine", "builtin", "how to render the target manifest: builtin renders it directly, helm runs a dry-run of helm upgrade")
+	f.StringSliceVar(&opts.PatchOnlyKinds, "patch-only-kinds", []string{}, "only diff resources of these kinds, e.g. Deployment,Service,ConfigMap; overrides the chart's "+patchdiff.PatchOnlyKindsAnnotation+" annotation")
+	f.StringArrayVar(&opts.Include, "include", []string{}, "only diff resources matching this Kind or Kind/name selector, e.g. Deployment or ConfigMap/settings (can specify multiple)")
+	f.StringArrayVar(&opts.Exclude, "exclude", []string{}, "leave out resources matching this Kind or Kind/name selector, even when they match --include (can specify multiple)")
+	f.StringArrayVar(&opts.FailOnChangeTo, "fail-on-change-to", []string{}, "exit non-zero if any patch touches this JSON pointer, e.g. /spec/template/spec/securityContext (can specify multiple)")
+	f.StringSliceVarP(&opts.apiVersions, "api-versions", "a", []string{}, "Kubernetes api versions used for Capabilities.APIVersions, in addition to those the cluster serves, or to the defaults with --kube-version, e.g. for CRDs the upgrade installs (can specify multiple)")
+	f.StringVar(&opts.kubeVersion, "kube-version", "", "Kubernetes version used for Capabilities.KubeVersion, as helm template does; diffs offline against --release-backup without the live state of any resource")
+	f.StringVar(&opts.expectKubeVersion, "expect-kube-version", "", "fail unless the cluster's Kubernetes version satisfies this semver constraint, e.g. \">=1.18.0 <1.19.0\"")
+	f.BoolVar(&opts.Install, "install", false, "if the release does not exist yet, preview installing it, as helm upgrade --install does: every resource is created and listed with its whole body")
+	f.BoolVar(&opts.ReuseValues, "reuse-values", false, "when upgrading, reuse the last release's values and merge in any overrides from the command line via --set and -f. If '--reset-values' is specified, this is ignored")
+	f.BoolVar(&opts.ResetValues, "reset-values", false, "when upgrading, reset the values to the ones built into the chart")
+	f.StringVar(&opts.BaseReleaseName, "base-release-name", "", "diff against the release stored under this name while rendering the chart for <NAME>, e.g. when previewing a release rename")
+	f.IntVar(&opts.Revision, "revision", 0, "diff against the manifest of this revision of the release instead of the deployed one, e.g. a known-good revision before a bad rollout")
+	f.StringVar(&opts.releaseBackup, "release-backup", "", "read the release from this JSON file, as stored by the storage driver, instead of from the cluster")
+	f.StringVar(&opts.targetKubeContext, "target-kube-context", "", "kubeconfig context of the cluster to preview against; the release is still read from the current context")
+	addTimeoutFlag(f, opts)
+	f.BoolVar(&opts.detailedExitCode, "detailed-exitcode", false, "exit with 2 when the upgrade would create, patch or delete any resource, 0 when it changes nothing, and 1 on errors")
+	f.StringToStringVar(&opts.PatchAnnotations, "patch-annotations", map[string]string{}, "annotations to add to every target object so they appear in the patch (can specify multiple or separate values with commas: key1=val1,key2=val2)")
+}
 
-	actionConfig := new(action.Configuration)
-	if err := actionConfig.Init(settings.RESTClientGetter(), settings.Namespace(), os.Getenv("HELM_DRIVER"), log.Printf); err != nil {
-		log.Fatalf("%+v", err)
-	}
+// timeoutUsage is the help of the --timeout flag.
+const timeoutUsage = "time to wait for the cluster to connect and for each release, and for each request and remote values file, before giving up"
 
-	if err := actionConfig.KubeClient.IsReachable(); err != nil {
-		return "", err
-	}
+// addTimeoutFlag adds the --timeout flag of every command that contacts the
+// cluster.
+func addTimeoutFlag(f *pflag.FlagSet, opts *options) {
+	f.DurationVar(&opts.timeout, "timeout", 30*time.Second, timeoutUsage)
+}
 
-	originalManifest, targetManifest, err := prepareUpgrade(actionConfig, name, ch, vals)
-	if err != nil {
-		return "", err
-	}
+// addChartPathOptionsFlags adds the flags that locate a remote chart, as
+// helm upgrade has them.
+func addChartPathOptionsFlags(f *pflag.FlagSet, opts *options) {
+	f.StringVar(&opts.chartPathOptions.Version, "version", "", "specify the exact chart version to use. If this is not specified, the latest version is used")
+	f.StringVar(&opts.chartPathOptions.RepoURL, "repo", "", "chart repository url where to locate the requested chart")
+	f.StringVar(&opts.chartPathOptions.Username, "username", "", "chart repository username where to locate the requested chart")
+	f.StringVar(&opts.chartPathOptions.Password, "password", "", "chart repository password where to locate the requested chart")
+	f.BoolVar(&opts.devel, "devel", false, "use development versions, too. Equivalent to version '>0.0.0-0'. If --version is set, this is ignored")
+	f.StringVar(&opts.chartDigest, "chart-digest", "", "fail unless the chart archive, local or downloaded, has this digest, such as sha256:<hex>")
+}
 
-	original, err := actionConfig.KubeClient.Build(bytes.NewBufferString(originalManifest), false)
-	if err != nil {
-		return "", errors.Wrap(err, "unable to build kubernetes objects from original release manifest")
+// completeOptions validates the flags in opts and loads the files they refer
+// to.
+func completeOptions(opts *options) error {
+	if opts.kubeVersion != "" {
+		if opts.releaseBackup == "" {
+			return errors.New("--kube-version requires --release-backup, since the release cannot be read from the cluster")
+		}
+		if opts.targetKubeContext != "" {
+			return errors.New("--kube-version cannot be combined with --target-kube-context")
+		}
+		opts.Offline = true
 	}
-	target, err := actionConfig.KubeClient.Build(bytes.NewBufferString(targetManifest), false)
-	if err != nil {
-		return "", errors.Wrap(err, "unable to build kubernetes objects from new release manifest")
+	if err := validateEnvValuesPattern(opts.envValuesPattern); err != nil {
+		return err
 	}
-
-	err = target.Visit(func(info *resource.Info, err error) error {
+	if opts.dumpValues {
+		opts.DumpValues = os.Stderr
+	}
+	if opts.postRenderer != "" {
+		pr, err := newPostRenderer(opts.postRenderer, opts.postRendererArgs)
 		if err != nil {
 			return err
 		}
+		opts.PostRenderer = pr
+	} else if len(opts.postRendererArgs) > 0 {
+		return errors.New("--post-renderer-args requires --post-renderer")
+	}
+	if err := opts.Validate(); err != nil {
+		return err
+	}
 
-		helper := resource.NewHelper(info.Client, info.Mapping)
-		if _, err := helper.Get(info.Namespace, info.Name, info.Export); apierrors.IsNotFound(err) {
-			// no patch to generate
-			return nil
-		}
-
-		originalInfo := original.Get(info)
-		if originalInfo == nil {
-			return fmt.Errorf("could not find %q", info.Name)
+	if opts.detailedExitCode && opts.Output == "target-yaml" {
+		return errors.New("--detailed-exitcode cannot be combined with --output target-yaml, which does not diff")
+	}
+	if opts.prometheusTextfile != "" {
+		if opts.Output == "target-yaml" {
+			return errors.New("--prometheus-textfile cannot be combined with --output target-yaml")
 		}
+		opts.metrics = newMetricsRecorder()
+	}
 
-		patch, _, err := createPatch(originalInfo.Object, info)
+	if opts.normalizeConfigFile != "" {
+		normalizer, err := patchdiff.LoadNormalizeConfig(opts.normalizeConfigFile)
 		if err != nil {
 			return err
 		}
+		opts.Normalizer = normalizer
+	}
 
-		// append patch to patchset
-		patches = append(patches, string(patch))
-		return nil
-	})
-
-	return fmt.Sprintf("[%s]", strings.Join(patches, ",")), err
+	if opts.BaseReleaseName != "" {
+		if err := validateReleaseName(opts.BaseReleaseName); err != nil {
+			return errors.Wrap(err, "invalid --base-release-name")
+		}
+		if opts.releaseSelector != "" {
+			return errors.New("--base-release-name cannot be combined with --release-selector")
+		}
+	}
+	return nil
 }
 
-func prepareUpgrade(c *action.Configuration, name string, chart *chart.Chart, vals map[string]interface{}) (string, string, error) {
-	if chart == nil {
-		return "", "", errors.New("missing chart")
+// locateChart resolves a chart reference as helm upgrade does, returning the
+// local path of a chart directory or archive. Chart names of added
+// repositories, names with --repo and http(s) URLs are downloaded to the
+// repository cache.
+func locateChart(ref string, opts *options) (string, error) {
+	if strings.HasPrefix(ref, "oci://") {
+		if strings.Contains(ref, "@sha256:") {
+			// the OCI registry client of this helm version is internal to
+			// helm, so digests cannot be resolved either
+			return "", errors.Errorf("unable to locate chart %q: the helm version patchdiff is built with cannot pull OCI charts, by tag or by digest; to pin a chart by digest, pass its archive along with --chart-digest", ref)
+		}
+		return "", errors.Errorf("unable to locate chart %q: the helm version patchdiff is built with cannot pull OCI charts; pull and export it with helm chart pull and helm chart export, and pass the exported directory", ref)
+	}
+	pathOpts := opts.chartPathOptions
+	if pathOpts.Version == "" && opts.devel {
+		pathOpts.Version = ">0.0.0-0"
+	}
+	if _, err := os.Stat(ref); err == nil || filepath.IsAbs(ref) || strings.HasPrefix(ref, ".") {
+		// local charts are not downloaded
+		return pathOpts.LocateChart(ref, settings)
+	}
+
+	// the same as LocateChart, with every download bounded by --timeout
+	getters := downloadGetters(opts.timeout)
+	dl := downloader.ChartDownloader{
+		Out:     os.Stderr,
+		Keyring: pathOpts.Keyring,
+		Getters: getters,
+		Options: []getter.Option{
+			getter.WithBasicAuth(pathOpts.Username, pathOpts.Password),
+			getter.WithTLSClientConfig(pathOpts.CertFile, pathOpts.KeyFile, pathOpts.CaFile),
+			getter.WithInsecureSkipVerifyTLS(pathOpts.InsecureSkipTLSverify),
+		},
+		RepositoryConfig: settings.RepositoryConfig,
+		RepositoryCache:  settings.RepositoryCache,
+	}
+	if pathOpts.Verify {
+		dl.Verify = downloader.VerifyAlways
+	}
+	version := strings.TrimSpace(pathOpts.Version)
+	if pathOpts.RepoURL != "" {
+		chartURL, err := repo.FindChartInAuthRepoURL(pathOpts.RepoURL, pathOpts.Username, pathOpts.Password, ref, version, pathOpts.CertFile, pathOpts.KeyFile, pathOpts.CaFile, getters)
+		if err != nil {
+			return "", err
+		}
+		ref = chartURL
+	}
+	if err := os.MkdirAll(settings.RepositoryCache, 0755); err != nil {
+		return "", err
 	}
+	filename, _, err := dl.DownloadTo(ref, version, settings.RepositoryCache)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to download %q", ref)
+	}
+	return filepath.Abs(filename)
+}
 
-	// finds the last non-deleted release with the given name
-	lastRelease, err := c.Releases.Last(name)
+// chartArchiveDigest returns the digest of the chart archive at path, as
+// sha256:<hex>, failing unless it is pinned when pinned is set. A chart
+// directory has no digest, so it cannot be pinned.
+func chartArchiveDigest(path, pinned string) (string, error) {
+	fi, err := os.Stat(path)
 	if err != nil {
-		// to keep existing behavior of returning the "%q has no deployed releases" error when an existing release does not exist
-		if errors.Is(err, driver.ErrReleaseNotFound) {
-			return "", "", driver.NewErrNoDeployedReleases(name)
+		return "", err
+	}
+	if fi.IsDir() {
+		if pinned != "" {
+			return "", errors.Errorf("--chart-digest requires a chart archive, not the directory %s", path)
 		}
-		return "", "", err
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+	if pinned != "" && digest != pinned {
+		return "", errors.Errorf("chart archive %s has digest %s, not the pinned %s", path, digest, pinned)
 	}
+	return digest, nil
+}
 
-	var currentRelease *release.Release
-	if lastRelease.Info.Status == release.StatusDeployed {
-		// no need to retrieve the last deployed release from storage as the last release is deployed
-		currentRelease = lastRelease
-	} else {
-		// finds the deployed release with the given name
-		currentRelease, err = c.Releases.Deployed(name)
-		if err != nil {
-			if errors.Is(err, driver.ErrNoDeployedReleases) &&
-				(lastRelease.Info.Status == release.StatusFailed || lastRelease.Info.Status == release.StatusSuperseded) {
-				currentRelease = lastRelease
-			} else {
-				return "", "", err
+// downloadGetters returns the getters of settings with their downloads
+// bounded by timeout, or unbounded when it is zero, and noted with --debug.
+// Getters of plugins run their own commands and may not honour the timeout.
+func downloadGetters(timeout time.Duration) getter.Providers {
+	providers := getter.All(settings)
+	for i := range providers {
+		newGetter := providers[i].New
+		providers[i].New = func(options ...getter.Option) (getter.Getter, error) {
+			g, err := newGetter(append(options, getter.WithTimeout(timeout))...)
+			if err != nil {
+				return nil, err
 			}
+			return debugGetter{g}, nil
 		}
 	}
+	return providers
+}
 
-	if err := chartutil.ProcessDependencies(chart, vals); err != nil {
-		return "", "", err
-	}
-
-	// Increment revision count. This is passed to templates, and also stored on
-	// the release object.
-	revision := lastRelease.Version + 1
+// debugGetter notes each URL it fetches, and how long fetching it took, when
+// --debug is set.
+type debugGetter struct {
+	getter.Getter
+}
 
-	options := chartutil.ReleaseOptions{
-		Name:      name,
-		Namespace: currentRelease.Namespace,
-		Revision:  revision,
-		IsUpgrade: true,
+func (g debugGetter) Get(url string, options ...getter.Option) (*bytes.Buffer, error) {
+	if !settings.Debug {
+		return g.Getter.Get(url, options...)
 	}
+	log.Printf("fetching %s", url)
+	start := time.Now()
+	data, err := g.Getter.Get(url, options...)
+	if err != nil {
+		log.Printf("failed to fetch %s after %s: %s", url, time.Since(start).Round(time.Millisecond), err)
+		return nil, err
+	}
+	log.Printf("fetched %s (%d bytes) in %s", url, data.Len(), time.Since(start).Round(time.Millisecond))
+	return data, nil
+}
 
-	if err := getCapabilities(c); err != nil {
-		return "", "", err
+// loadChart loads the chart at chartPath along with the values selected by
+// valueOpts and opts.
+func loadChart(chartPath string, valueOpts *valueOptions, opts *options) (*chart.Chart, map[string]interface{}, error) {
+	// copy so the files found for one chart are not reused for another
+	withFiles := *valueOpts
+	withFiles.ValueFiles = nil
+	withFiles.timeout = opts.timeout
+	if opts.env != "" {
+		file, err := envValuesFile(chartPath, opts.env, opts.envValuesPattern)
+		if err != nil {
+			return nil, nil, err
+		}
+		withFiles.ValueFiles = append(withFiles.ValueFiles, file)
+	}
+	if opts.valuesDir != "" {
+		files, err := valuesDirFiles(opts.valuesDir, opts.valuesDirRecursive)
+		if err != nil {
+			return nil, nil, err
+		}
+		withFiles.ValueFiles = append(withFiles.ValueFiles, files...)
 	}
-	valuesToRender, err := chartutil.ToRenderValues(chart, vals, options, c.Capabilities)
+	withFiles.ValueFiles = append(withFiles.ValueFiles, valueOpts.ValueFiles...)
+	if opts.valuesJSON != "" {
+		if err := checkJSONValues(opts.valuesJSON); err != nil {
+			return nil, nil, err
+		}
+		// JSON is valid YAML, so as the last file it overrides every other
+		// file and is coalesced the same way
+		withFiles.ValueFiles = append(withFiles.ValueFiles, opts.valuesJSON)
+	}
+	valueOpts = &withFiles
+
+	ch, err := loader.Load(chartPath)
 	if err != nil {
-		return "", "", err
+		return nil, nil, err
+	}
+	// like helm upgrade, fail when subcharts are missing from charts/
+	if req := ch.Metadata.Dependencies; req != nil {
+		if err := action.CheckDependencies(ch, req); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	manifestDoc, err := renderResources(c, chart, valuesToRender)
+	if opts.renderValuesSprig {
+		dir, err := ioutil.TempDir("", "patchdiff-values-")
+		if err != nil {
+			return nil, nil, err
+		}
+		defer os.RemoveAll(dir)
+		if valueOpts.ValueFiles, err = renderValuesFiles(valueOpts.ValueFiles, ch.Values, dir); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	vals, err := valueOpts.MergeValues(getter.All(settings))
 	if err != nil {
-		return "", "", err
+		return nil, nil, err
+	}
+	if err := mergeStringFileValues(vals, opts.stringFileValues); err != nil {
+		return nil, nil, err
+	}
+	if err := mergeTypedValues(vals, opts.typedValues); err != nil {
+		return nil, nil, err
 	}
 
-	return currentRelease.Manifest, manifestDoc.String(), err
+	if opts.verifyLock {
+		if err := verifyLock(ch); err != nil {
+			return nil, nil, err
+		}
+	}
+	return ch, vals, nil
 }
 
-// capabilities builds a Capabilities from discovery information.
-func getCapabilities(c *action.Configuration) error {
-	if c.Capabilities != nil {
+// writeMetrics writes the metrics recorded during the run, if requested.
+func writeMetrics(opts *options) error {
+	if opts.metrics == nil {
 		return nil
 	}
-	dc, err := c.RESTClientGetter.ToDiscoveryClient()
-	if err != nil {
-		return errors.Wrap(err, "could not get Kubernetes discovery client")
+	return errors.Wrapf(opts.metrics.writeTextfile(opts.prometheusTextfile), "unable to write metrics to %s", opts.prometheusTextfile)
+}
+
+// newActionConfig connects to the cluster the release lives in, or with
+// --kube-version sets up an offline diff that never contacts it. Connecting
+// is cancelled along with ctx, and every request gives up after --timeout.
+func newActionConfig(ctx context.Context, opts *options) (*action.Configuration, error) {
+	setRequestTimeout(settings.RESTClientGetter(), opts.timeout)
+	actionConfig := new(action.Configuration)
+	if err := actionConfig.Init(settings.RESTClientGetter(), settings.Namespace(), os.Getenv("HELM_DRIVER"), log.Printf); err != nil {
+		return nil, errors.Wrap(err, "unable to initialize helm")
 	}
-	// force a discovery cache invalidation to always fetch the latest server version/capabilities.
-	dc.Invalidate()
-	kubeVersion, err := dc.ServerVersion()
-	if err != nil {
-		return errors.Wrap(err, "could not get server version from Kubernetes")
-	}
-	// Issue #6361:
-	// Client-Go emits an error when an API service is registered but unimplemented.
-	// We trap that error here and print a warning. But since the discovery client continues
-	// building the API object, it is correctly populated with all valid APIs.
-	// See https://github.com/kubernetes/kubernetes/issues/72051#issuecomment-521157642
-	apiVersions, err := action.GetVersionSet(dc)
-	if err != nil {
-		if discovery.IsGroupDiscoveryFailedError(err) {
-			c.Log("WARNING: The Kubernetes server has an orphaned API service. Server reports: %s", err)
-			c.Log("WARNING: To fix this, kubectl delete apiservice <service-name>")
-		} else {
-			return errors.Wrap(err, "could not get apiVersions from Kubernetes")
+
+	var backup *release.Release
+	if opts.releaseBackup != "" {
+		var err error
+		if backup, err = loadReleaseBackup(opts.releaseBackup); err != nil {
+			return nil, err
+		}
+		if err := useReleaseBackup(actionConfig, backup); err != nil {
+			return nil, errors.Wrapf(err, "unable to load release backup %s", opts.releaseBackup)
 		}
 	}
 
-	c.Capabilities = &chartutil.Capabilities{
-		APIVersions: apiVersions,
-		KubeVersion: chartutil.KubeVersion{
-			Version: kubeVersion.GitVersion,
-			Major:   kubeVersion.Major,
-			Minor:   kubeVersion.Minor,
-		},
+	if opts.targetKubeContext != "" {
+		if err := useTargetCluster(actionConfig, opts.targetKubeContext, opts.timeout); err != nil {
+			return nil, errors.Wrapf(err, "unable to configure target kube context %q", opts.targetKubeContext)
+		}
 	}
-	return nil
-}
 
-func renderResources(c *action.Configuration, ch *chart.Chart, values chartutil.Values) (*bytes.Buffer, error) {
-	b := bytes.NewBuffer(nil)
+	if backup != nil && backup.Namespace != "" {
+		// objects without a namespace of their own belong to the namespace
+		// of the release, which need not be the current one
+		if kc, ok := actionConfig.KubeClient.(*kube.Client); ok {
+			kc.Namespace = backup.Namespace
+		}
+	}
 
-	if err := getCapabilities(c); err != nil {
-		return b, err
+	if opts.kubeVersion != "" {
+		caps, err := offlineCapabilities(opts.kubeVersion, opts.apiVersions)
+		if err != nil {
+			return nil, err
+		}
+		actionConfig.Capabilities = caps
+	} else if err := patchdiff.IsReachable(ctx, actionConfig); err != nil {
+		return nil, err
 	}
 
-	if ch.Metadata.KubeVersion != "" {
-		if !chartutil.IsCompatibleRange(ch.Metadata.KubeVersion, c.Capabilities.KubeVersion.String()) {
-			return b, errors.Errorf("chart requires kubeVersion: %s which is incompatible with Kubernetes %s", ch.Metadata.KubeVersion, c.Capabilities.KubeVersion.String())
+	if opts.expectKubeVersion != "" {
+		if err := checkKubeVersion(ctx, actionConfig, opts.expectKubeVersion); err != nil {
+			return nil, err
 		}
 	}
 
-	rest, err := c.RESTClientGetter.ToRESTConfig()
-	if err != nil {
-		return b, err
+	if len(opts.apiVersions) > 0 && opts.kubeVersion == "" {
+		if err := addAPIVersions(ctx, actionConfig, opts.apiVersions); err != nil {
+			return nil, err
+		}
 	}
-	files, err := engine.RenderWithClient(ch, values, rest)
-	if err != nil {
-		return b, err
+	return actionConfig, nil
+}
+
+// addAPIVersions adds apiVersions to those discovered on the cluster, so
+// templates can check for APIs that the upgrade itself introduces. Discovery
+// happens up front, since it would otherwise replace the added versions.
+func addAPIVersions(ctx context.Context, c *action.Configuration, apiVersions []string) error {
+	if err := patchdiff.GetCapabilities(ctx, c); err != nil {
+		return err
+	}
+	for _, v := range apiVersions {
+		if !c.Capabilities.APIVersions.Has(v) {
+			c.Capabilities.APIVersions = append(c.Capabilities.APIVersions, v)
+		}
 	}
+	return nil
+}
 
-	// Sort hooks, manifests, and partials. Only hooks and manifests are returned,
-	// as partials are not used after renderer.Render. Empty manifests are also
-	// removed here.
-	_, manifests, err := releaseutil.SortManifests(files, c.Capabilities.APIVersions, releaseutil.InstallOrder)
+// offlineCapabilities returns the capabilities helm template renders with for
+// kubeVersion, with apiVersions added to the default API versions, so that
+// nothing is discovered from a cluster.
+func offlineCapabilities(kubeVersion string, apiVersions []string) (*chartutil.Capabilities, error) {
+	v, err := semver.NewVersion(kubeVersion)
 	if err != nil {
-		return b, err
+		return nil, errors.Wrapf(err, "invalid kube version %q", kubeVersion)
 	}
-
-	for _, m := range manifests {
-		// skip notes
-		if !strings.Contains(m.Name, "NOTES.txt") {
-			fmt.Fprintf(b, "---\n# Source: %s\n%s\n", m.Name, m.Content)
+	versions := append(chartutil.VersionSet{}, chartutil.DefaultVersionSet...)
+	for _, av := range apiVersions {
+		if !versions.Has(av) {
+			versions = append(versions, av)
 		}
 	}
+	return &chartutil.Capabilities{
+		KubeVersion: chartutil.KubeVersion{
+			Version: "v" + v.String(),
+			Major:   strconv.FormatUint(v.Major(), 10),
+			Minor:   strconv.FormatUint(v.Minor(), 10),
+		},
+		APIVersions: versions,
+		HelmVersion: chartutil.DefaultCapabilities.HelmVersion,
+	}, nil
+}
 
-	return b, nil
+// checkKubeVersion fails unless the cluster's version satisfies constraint.
+func checkKubeVersion(ctx context.Context, c *action.Configuration, constraint string) error {
+	if _, err := semver.NewConstraint(constraint); err != nil {
+		return errors.Wrapf(err, "invalid kube version constraint %q", constraint)
+	}
+	if err := patchdiff.GetCapabilities(ctx, c); err != nil {
+		return err
+	}
+	if !chartutil.IsCompatibleRange(constraint, c.Capabilities.KubeVersion.String()) {
+		return errors.Errorf("connected to Kubernetes %s which does not satisfy the expected kube version %s", c.Capabilities.KubeVersion.String(), constraint)
+	}
+	return nil
 }
 
-func createPatch(current runtime.Object, target *resource.Info) ([]byte, types.PatchType, error) {
-	oldData, err := json.Marshal(current)
-	if err != nil {
-		return nil, types.StrategicMergePatchType, errors.Wrap(err, "serializing current configuration")
+// diffRelease previews the upgrade of the named release within its own
+// --timeout and records its counts in the run's metrics.
+func diffRelease(c *action.Configuration, name string, ch *chart.Chart, vals map[string]interface{}, opts *options) (string, error) {
+	// every release gets the whole timeout, however many a run diffs
+	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+	defer cancel()
+	out, counts, err := patchdiff.DiffRelease(ctx, c, name, ch, vals, &opts.Options)
+	if opts.Output != "target-yaml" && (err == nil || out != "") {
+		// policy violations still produce a complete count
+		opts.metrics.record(name, counts)
+	}
+	if counts.Created+counts.Patched+counts.Deleted > 0 {
+		atomic.StoreInt32(&opts.changed, 1)
+	}
+	return out, err
+}
+
+// writeFleetSummary prints the fleet-summary outputs of many releases rolled
+// up into one, with --output fleet-summary.
+func writeFleetSummary(w io.Writer, summaries []string, opts *options) error {
+	if opts.Output != "fleet-summary" {
+		return nil
 	}
-	newData, err := json.Marshal(target.Object)
+	merged, err := patchdiff.MergeFleetSummaries(summaries)
 	if err != nil {
-		return nil, types.StrategicMergePatchType, errors.Wrap(err, "serializing target configuration")
+		return err
+	}
+	if merged != "" {
+		fmt.Fprintln(w, merged)
 	}
+	return nil
+}
 
-	// Fetch the current object for the three way merge
-	helper := resource.NewHelper(target.Client, target.Mapping)
-	currentObj, err := helper.Get(target.Namespace, target.Name, target.Export)
-	if err != nil && !apierrors.IsNotFound(err) {
-		return nil, types.StrategicMergePatchType, errors.Wrapf(err, "unable to get data for current object %s/%s", target.Namespace, target.Name)
+// exitOnChanges exits with status 2 when --detailed-exitcode is set and a
+// diffed release changes. Errors exit with 1 before getting here, so 0 is
+// left for no changes.
+func exitOnChanges(opts *options) {
+	if opts.detailedExitCode && atomic.LoadInt32(&opts.changed) != 0 {
+		os.Exit(2)
 	}
+}
 
-	// Even if currentObj is nil (because it was not found), it will marshal just fine
-	currentData, err := json.Marshal(currentObj)
+// releasesForSelector returns the names of the releases whose storage objects
+// match the label selector.
+func releasesForSelector(c *action.Configuration, selector string) ([]string, error) {
+	lbs, err := labels.ConvertSelectorToLabelsMap(selector)
 	if err != nil {
-		return nil, types.StrategicMergePatchType, errors.Wrap(err, "serializing live configuration")
+		return nil, errors.Wrapf(err, "invalid release selector %q", selector)
 	}
+	lbs["owner"] = "helm"
 
-	// Get a versioned object
-	versionedObject := kube.AsVersioned(target)
+	releases, err := c.Releases.Driver.Query(lbs)
+	if err != nil {
+		if errors.Is(err, driver.ErrReleaseNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
 
-	// Unstructured objects, such as CRDs, may not have an not registered error
-	// returned from ConvertToVersion. Anything that's unstructured should
-	// use the jsonpatch.CreateMergePatch. Strategic Merge Patch is not supported
-	// on objects like CRDs.
-	_, isUnstructured := versionedObject.(runtime.Unstructured)
+	seen := map[string]bool{}
+	var names []string
+	for _, r := range releases {
+		if !seen[r.Name] {
+			seen[r.Name] = true
+			names = append(names, r.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
 
-	// On newer K8s versions, CRDs aren't unstructured but has this dedicated type
-	_, isCRD := versionedObject.(*apiextv1.CustomResourceDefinition)
+// useTargetCluster points the rendering, capabilities and live lookups of c at
+// the cluster behind kubeContext. Release storage is left untouched so the
+// release is still read from the cluster it lives in.
+func useTargetCluster(c *action.Configuration, kubeContext string, timeout time.Duration) error {
+	namespace := settings.Namespace()
+	getter := genericclioptions.NewConfigFlags(true)
+	getter.Namespace = &namespace
+	getter.Context = &kubeContext
+	getter.KubeConfig = &settings.KubeConfig
+	setRequestTimeout(getter, timeout)
+
+	target := new(action.Configuration)
+	if err := target.Init(getter, namespace, os.Getenv("HELM_DRIVER"), log.Printf); err != nil {
+		return err
+	}
+
+	c.RESTClientGetter = target.RESTClientGetter
+	c.KubeClient = target.KubeClient
+	c.Capabilities = nil
+	return nil
+}
 
-	if isUnstructured || isCRD {
-		// fall back to generic JSON merge patch
-		patch, err := jsonpatch.CreateMergePatch(oldData, newData)
-		return patch, types.MergePatchType, err
+// setRequestTimeout makes each request of the clients of getter give up after
+// timeout. Discovery and helm's own actions take no context, so the request
+// timeout is what stops them when the cluster does not answer.
+func setRequestTimeout(getter genericclioptions.RESTClientGetter, timeout time.Duration) {
+	if flags, ok := getter.(*genericclioptions.ConfigFlags); ok {
+		t := timeout.String()
+		flags.Timeout = &t
 	}
+}
 
-	patchMeta, err := strategicpatch.NewPatchMetaFromStruct(versionedObject)
-	if err != nil {
-		return nil, types.StrategicMergePatchType, errors.Wrap(err, "unable to create patch metadata from object")
+// resolveArgs returns the release name and chart from the positional
+// arguments, falling back to $HELM_PATCHDIFF_RELEASE and $HELM_PATCHDIFF_CHART
+// for those that are omitted.
+func resolveArgs(args []string, needName, needChart bool) (string, string, error) {
+	var name, chartPath string
+	if needName {
+		if len(args) > 0 {
+			name, args = args[0], args[1:]
+		} else {
+			name = os.Getenv("HELM_PATCHDIFF_RELEASE")
+		}
+		if name == "" {
+			return "", "", errors.New("no release name set: pass <NAME> or set $HELM_PATCHDIFF_RELEASE")
+		}
 	}
-
-	patch, err := strategicpatch.CreateThreeWayMergePatch(oldData, newData, currentData, patchMeta, true)
-	return patch, types.StrategicMergePatchType, err
+	if needChart {
+		if len(args) > 0 {
+			chartPath = args[0]
+		} else {
+			chartPath = os.Getenv("HELM_PATCHDIFF_CHART")
+		}
+		if chartPath == "" {
+			return "", "", errors.New("no chart set: pass <CHART> or set $HELM_PATCHDIFF_CHART")
+		}
+	}
+	return name, chartPath, nil
 }
 
 func validateReleaseName(releaseName string) error {
@@ -339,9 +854,11 @@ func validateReleaseName(releaseName string) error {
 	return nil
 }
 
-func addValueOptionsFlags(f *pflag.FlagSet, v *values.Options) {
+func addValueOptionsFlags(f *pflag.FlagSet, v *valueOptions) {
 	f.StringSliceVarP(&v.ValueFiles, "values", "f", []string{}, "specify values in a YAML file or a URL (can specify multiple)")
 	f.StringArrayVar(&v.Values, "set", []string{}, "set values on the command line (can specify multiple or separate values with commas: key1=val1,key2=val2)")
 	f.StringArrayVar(&v.StringValues, "set-string", []string{}, "set STRING values on the command line (can specify multiple or separate values with commas: key1=val1,key2=val2)")
+	f.StringArrayVar(&v.JSONValues, "set-json", []string{}, "set JSON values on the command line (can specify multiple or separate values with commas: key1=jsonval1,key2=jsonval2)")
+	f.StringArrayVar(&v.LiteralValues, "set-literal", []string{}, "set a literal STRING value on the command line")
 	f.StringArrayVar(&v.FileValues, "set-file", []string{}, "set values from respective files specified via the command line (can specify multiple or separate values with commas: key1=path1,key2=path2)")
 }
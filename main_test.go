@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocateChartTimeout(t *testing.T) {
+	// a chart server that never answers
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	cache, config := settings.RepositoryCache, settings.RepositoryConfig
+	defer func() { settings.RepositoryCache, settings.RepositoryConfig = cache, config }()
+	settings.RepositoryCache = t.TempDir()
+	settings.RepositoryConfig = t.TempDir() + "/repositories.yaml"
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := locateChart(server.URL+"/foo-0.1.0.tgz", &options{timeout: 100 * time.Millisecond})
+		errs <- err
+	}()
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("got no error downloading from a stuck server")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the download was not bounded by the timeout")
+	}
+}
+
+func TestLocateChartDebug(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	cache, config, debug := settings.RepositoryCache, settings.RepositoryConfig, settings.Debug
+	defer func() { settings.RepositoryCache, settings.RepositoryConfig, settings.Debug = cache, config, debug }()
+	settings.RepositoryCache = t.TempDir()
+	settings.RepositoryConfig = t.TempDir() + "/repositories.yaml"
+	settings.Debug = true
+
+	var b bytes.Buffer
+	log.SetOutput(&b)
+	defer log.SetOutput(os.Stderr)
+	url := server.URL + "/foo-0.1.0.tgz"
+	if _, err := locateChart(url, &options{timeout: time.Second}); err == nil {
+		t.Error("got no error downloading a missing chart")
+	}
+	if !strings.Contains(b.String(), "fetching "+url) || !strings.Contains(b.String(), "failed to fetch "+url) {
+		t.Errorf("got debug output\n%s\nwant the URL being fetched", b.String())
+	}
+}
+
+func TestChartArchiveDigest(t *testing.T) {
+	dir := t.TempDir()
+	archive := writeFile(t, dir, "foo-0.1.0.tgz", "chart")
+	want := "sha256:cc57fc1903e444cf6a726490b43b27ee9f87facc037f86872201847c565b45fb"
+	for _, tt := range []struct {
+		name    string
+		path    string
+		pinned  string
+		want    string
+		wantErr string
+	}{
+		{name: "archive", path: archive, want: want},
+		{name: "pinned archive", path: archive, pinned: want, want: want},
+		{name: "other digest", path: archive, pinned: "sha256:0000", wantErr: "has digest " + want + ", not the pinned sha256:0000"},
+		{name: "directory", path: dir},
+		{name: "pinned directory", path: dir, pinned: want, wantErr: "requires a chart archive"},
+	} {
+		got, err := chartArchiveDigest(tt.path, tt.pinned)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLocateChartOCIDigest(t *testing.T) {
+	_, err := locateChart("oci://example.com/charts/app@sha256:8ebb2a1e", &options{})
+	if err == nil || !strings.Contains(err.Error(), "--chart-digest") {
+		t.Errorf("got error %v, want it to point to --chart-digest", err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bacongobbler/helm-patchdiff/pkg/patchdiff"
+)
+
+// metricsRecorder collects the patch counts of every release diffed in a run
+// for the node_exporter textfile collector.
+type metricsRecorder struct {
+	mu       sync.Mutex
+	releases map[string]patchdiff.Counts
+}
+
+func newMetricsRecorder() *metricsRecorder {
+	return &metricsRecorder{releases: map[string]patchdiff.Counts{}}
+}
+
+// record stores the counts of a release. It does nothing on a nil recorder.
+func (r *metricsRecorder) record(release string, counts patchdiff.Counts) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.releases[release] = counts
+}
+
+// writeTextfile writes the recorded metrics to path in the Prometheus text
+// format. The file is replaced atomically so the collector never reads a
+// partial file.
+func (r *metricsRecorder) writeTextfile(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.releases))
+	for name := range r.releases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	b := bytes.NewBuffer(nil)
+	for _, metric := range []struct {
+		name, help string
+		value      func(patchdiff.Counts) int
+	}{
+		{"patchdiff_changed_resources", "Resources an upgrade would create, patch or delete.", func(c patchdiff.Counts) int { return c.Created + c.Patched + c.Deleted }},
+		{"patchdiff_created_resources", "Resources an upgrade would create.", func(c patchdiff.Counts) int { return c.Created }},
+		{"patchdiff_deleted_resources", "Resources an upgrade would delete.", func(c patchdiff.Counts) int { return c.Deleted }},
+		{"patchdiff_patched_resources", "Resources an upgrade would patch.", func(c patchdiff.Counts) int { return c.Patched }},
+		{"patchdiff_unchanged_resources", "Resources an upgrade would leave unchanged.", func(c patchdiff.Counts) int { return c.Unchanged }},
+	} {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n", metric.name, metric.help, metric.name)
+		for _, name := range names {
+			fmt.Fprintf(b, "%s{release=%q} %d\n", metric.name, name, metric.value(r.releases[name]))
+		}
+	}
+	fmt.Fprintf(b, "# HELP patchdiff_last_run_timestamp_seconds Unix time the preview ran.\n# TYPE patchdiff_last_run_timestamp_seconds gauge\npatchdiff_last_run_timestamp_seconds %d\n", time.Now().Unix())
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	// the collector only reads *.prom files, so the temporary name is ignored
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+)
+
+// outputWriter prints results to stdout, gzip-compressed when requested.
+type outputWriter struct {
+	io.Writer
+	gz *gzip.Writer
+}
+
+func newOutputWriter(compress bool) *outputWriter {
+	if !compress {
+		return &outputWriter{Writer: os.Stdout}
+	}
+	gz := gzip.NewWriter(os.Stdout)
+	return &outputWriter{Writer: gz, gz: gz}
+}
+
+// Close ends the compressed stream. It must be called before exiting, since
+// log.Fatal skips deferred calls.
+func (w *outputWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+	return w.gz.Close()
+}
@@ -0,0 +1,294 @@
+package patchdiff
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/kube"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"sigs.k8s.io/yaml"
+)
+
+// testResource is a resource type the test cluster serves.
+type testResource struct {
+	groupVersion string
+	kind         string
+	resource     string
+	namespaced   bool
+}
+
+var testResources = []testResource{
+	{"v1", "ConfigMap", "configmaps", true},
+	{"v1", "Secret", "secrets", true},
+	{"v1", "Service", "services", true},
+	{"v1", "Namespace", "namespaces", false},
+	{"apps/v1", "Deployment", "deployments", true},
+	{"apps/v1", "StatefulSet", "statefulsets", true},
+	{"rbac.authorization.k8s.io/v1", "ClusterRole", "clusterroles", false},
+	{"apiextensions.k8s.io/v1", "CustomResourceDefinition", "customresourcedefinitions", false},
+	// the kind of an established CustomResourceDefinition
+	{"example.com/v1", "Gadget", "gadgets", true},
+}
+
+func (r testResource) prefix() string {
+	if r.groupVersion == "v1" {
+		return "/api/v1"
+	}
+	return "/apis/" + r.groupVersion
+}
+
+// testCluster is just enough of an API server for kube.Client to build
+// manifests against and for live objects to be read from. It serves the
+// discovery information of testResources and the objects added to it.
+type testCluster struct {
+	*httptest.Server
+
+	mu sync.Mutex
+	// objects are the JSON of the live objects, by path.
+	objects map[string][]byte
+	// requests are the paths of the object and list requests served.
+	requests []string
+	// forbidLists answers list requests with Forbidden, as RBAC that allows
+	// get but not list does.
+	forbidLists bool
+	// hold makes requests for a path wait until its channel is closed, after
+	// sending the path to held if that is set. Both are set before any
+	// request is made.
+	hold map[string]chan struct{}
+	held chan string
+}
+
+func newTestCluster(t *testing.T, manifests ...string) *testCluster {
+	c := &testCluster{objects: map[string][]byte{}}
+	c.Server = httptest.NewServer(c)
+	t.Cleanup(c.Close)
+	for _, m := range manifests {
+		for _, doc := range splitManifests(m) {
+			c.add(t, doc)
+		}
+	}
+	return c
+}
+
+// add stores the object of a YAML document as live.
+func (c *testCluster) add(t *testing.T, doc string) {
+	t.Helper()
+	data, err := yaml.YAMLToJSON([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var obj struct {
+		APIVersion string `json:"apiVersion"`
+		Kind       string `json:"kind"`
+		Metadata   struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range testResources {
+		if r.groupVersion != obj.APIVersion || r.kind != obj.Kind {
+			continue
+		}
+		p := r.prefix()
+		if r.namespaced {
+			ns := obj.Metadata.Namespace
+			if ns == "" {
+				ns = "default"
+			}
+			p += "/namespaces/" + ns
+		}
+		c.mu.Lock()
+		c.objects[p+"/"+r.resource+"/"+obj.Metadata.Name] = data
+		c.mu.Unlock()
+		return
+	}
+	t.Fatalf("the test cluster does not serve %s %s", obj.APIVersion, obj.Kind)
+}
+
+// served returns the paths of the object and list requests served so far.
+func (c *testCluster) served() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.requests...)
+}
+
+func (c *testCluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if doc := discoveryDoc(r.URL.Path); doc != nil {
+		writeJSON(w, http.StatusOK, doc)
+		return
+	}
+	if ch, ok := c.hold[r.URL.Path]; ok {
+		if c.held != nil {
+			c.held <- r.URL.Path
+		}
+		<-ch
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests = append(c.requests, r.URL.Path)
+	if data, ok := c.objects[r.URL.Path]; ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+	}
+	for _, res := range testResources {
+		if path.Base(r.URL.Path) != res.resource || !strings.HasPrefix(r.URL.Path, res.prefix()+"/") {
+			continue
+		}
+		if c.forbidLists {
+			writeJSON(w, http.StatusForbidden, map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Status",
+				"status":     "Failure",
+				"reason":     "Forbidden",
+				"code":       http.StatusForbidden,
+				"message":    res.resource + " is forbidden",
+			})
+			return
+		}
+		items := []json.RawMessage{}
+		for p, data := range c.objects {
+			if path.Dir(p) == r.URL.Path {
+				items = append(items, data)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"apiVersion": res.groupVersion,
+			"kind":       res.kind + "List",
+			"metadata":   map[string]interface{}{},
+			"items":      items,
+		})
+		return
+	}
+	writeJSON(w, http.StatusNotFound, map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Status",
+		"status":     "Failure",
+		"reason":     "NotFound",
+		"code":       http.StatusNotFound,
+		"message":    r.URL.Path + " not found",
+		"details":    map[string]interface{}{"name": path.Base(r.URL.Path)},
+	})
+}
+
+// discoveryDoc returns the discovery document served at p, or nil.
+func discoveryDoc(p string) interface{} {
+	switch p {
+	case "/version":
+		return map[string]string{"major": "1", "minor": "18", "gitVersion": "v1.18.8"}
+	case "/api":
+		return map[string]interface{}{"kind": "APIVersions", "versions": []string{"v1"}}
+	case "/apis":
+		var groups []interface{}
+		seen := map[string]bool{}
+		for _, r := range testResources {
+			if r.groupVersion == "v1" || seen[r.groupVersion] {
+				continue
+			}
+			seen[r.groupVersion] = true
+			version := map[string]string{"groupVersion": r.groupVersion, "version": path.Base(r.groupVersion)}
+			groups = append(groups, map[string]interface{}{
+				"name":             path.Dir(r.groupVersion),
+				"versions":         []interface{}{version},
+				"preferredVersion": version,
+			})
+		}
+		return map[string]interface{}{"kind": "APIGroupList", "apiVersion": "v1", "groups": groups}
+	}
+
+	var resources []interface{}
+	groupVersion := ""
+	for _, r := range testResources {
+		if r.prefix() == p {
+			groupVersion = r.groupVersion
+			resources = append(resources, map[string]interface{}{
+				"name":         r.resource,
+				"singularName": "",
+				"namespaced":   r.namespaced,
+				"kind":         r.kind,
+				"verbs":        []string{"get", "list"},
+			})
+		}
+	}
+	if resources == nil {
+		return nil
+	}
+	return map[string]interface{}{"kind": "APIResourceList", "apiVersion": "v1", "groupVersion": groupVersion, "resources": resources}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// testGetter is a RESTClientGetter for a test cluster, in namespace default.
+type testGetter struct {
+	config clientcmdapi.Config
+}
+
+func (g *testGetter) ToRawKubeConfigLoader() clientcmd.ClientConfig {
+	return clientcmd.NewDefaultClientConfig(g.config, &clientcmd.ConfigOverrides{})
+}
+
+func (g *testGetter) ToRESTConfig() (*rest.Config, error) {
+	return g.ToRawKubeConfigLoader().ClientConfig()
+}
+
+func (g *testGetter) ToDiscoveryClient() (discovery.CachedDiscoveryInterface, error) {
+	config, err := g.ToRESTConfig()
+	if err != nil {
+		return nil, err
+	}
+	dc, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return memory.NewMemCacheClient(dc), nil
+}
+
+func (g *testGetter) ToRESTMapper() (meta.RESTMapper, error) {
+	dc, err := g.ToDiscoveryClient()
+	if err != nil {
+		return nil, err
+	}
+	return restmapper.NewDeferredDiscoveryRESTMapper(dc), nil
+}
+
+// actionConfig returns an action configuration for the cluster, with release
+// storage in memory and the default capabilities.
+func (c *testCluster) actionConfig(t *testing.T) *action.Configuration {
+	config := clientcmdapi.NewConfig()
+	config.Clusters["test"] = &clientcmdapi.Cluster{Server: c.URL}
+	config.AuthInfos["test"] = &clientcmdapi.AuthInfo{}
+	config.Contexts["test"] = &clientcmdapi.Context{Cluster: "test", AuthInfo: "test", Namespace: "default"}
+	config.CurrentContext = "test"
+	getter := &testGetter{config: *config}
+
+	return &action.Configuration{
+		RESTClientGetter: getter,
+		KubeClient:       kube.New(getter),
+		Releases:         storage.Init(driver.NewMemory()),
+		Capabilities:     chartutil.DefaultCapabilities,
+		Log:              t.Logf,
+	}
+}
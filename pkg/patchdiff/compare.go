@@ -0,0 +1,143 @@
+package patchdiff
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/engine"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/yaml"
+)
+
+// RenderOffline renders a chart for installation without contacting a
+// cluster, using the default capabilities as helm template does.
+func RenderOffline(ch *chart.Chart, vals map[string]interface{}, name, namespace string) (string, error) {
+	if err := chartutil.ProcessDependencies(ch, vals); err != nil {
+		return "", err
+	}
+	caps := chartutil.DefaultCapabilities
+	options := chartutil.ReleaseOptions{
+		Name:      name,
+		Namespace: namespace,
+		Revision:  1,
+		IsInstall: true,
+	}
+	valuesToRender, err := chartutil.ToRenderValues(ch, vals, options, caps)
+	if err != nil {
+		return "", err
+	}
+	files, err := engine.Render(ch, valuesToRender)
+	if err != nil {
+		return "", err
+	}
+
+	b := bytes.NewBuffer(nil)
+	if _, err := writeManifests(b, files, caps.APIVersions); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// CompareManifests returns the patch entries from the objects of one
+// manifest to the matching objects of another, ordered as sortEntries orders
+// them. Kinds known to client-go get a two-way strategic merge patch, others
+// a JSON merge patch. Objects only found in after are created, and objects
+// only found in before are deleted.
+func CompareManifests(before, after string) ([]PatchEntry, error) {
+	oldObjs, oldOrder, err := manifestObjects(before)
+	if err != nil {
+		return nil, err
+	}
+	newObjs, order, err := manifestObjects(after)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []PatchEntry{}
+	for _, key := range order {
+		oldData, ok := oldObjs[key.String()]
+		if !ok {
+			entries = append(entries, offlinePatchEntry(key, createPatchType, newObjs[key.String()]))
+			continue
+		}
+		patch, patchType, err := twoWayPatch(key.gvk, oldData, newObjs[key.String()])
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to compare %s", key)
+		}
+		if !isEmptyPatch(patch) {
+			entries = append(entries, offlinePatchEntry(key, patchType, patch))
+		}
+	}
+	for _, key := range oldOrder {
+		if _, ok := newObjs[key.String()]; !ok {
+			entries = append(entries, offlinePatchEntry(key, deletePatchType, nil))
+		}
+	}
+	sortEntries(entries)
+	return entries, nil
+}
+
+// objectKey identifies an object of a rendered manifest.
+type objectKey struct {
+	gvk       schema.GroupVersionKind
+	namespace string
+	name      string
+}
+
+// String returns the key as kind.group namespace/name, as kubectl names
+// resources, so that kinds of the same name in different API groups differ.
+// Versions are left out, since they are views of the same object.
+func (k objectKey) String() string {
+	return fmt.Sprintf("%s %s", k.gvk.GroupKind(), strings.TrimPrefix(k.namespace+"/"+k.name, "/"))
+}
+
+// manifestObjects parses the documents of a manifest into JSON, indexed by
+// the string form of their key, along with the keys in manifest order.
+func manifestObjects(manifest string) (map[string][]byte, []objectKey, error) {
+	objs := map[string][]byte{}
+	var order []objectKey
+	for _, doc := range splitManifests(manifest) {
+		var obj struct {
+			APIVersion string `json:"apiVersion"`
+			Kind       string `json:"kind"`
+			Metadata   struct {
+				Name      string `json:"name"`
+				Namespace string `json:"namespace"`
+			} `json:"metadata"`
+		}
+		data, err := yaml.YAMLToJSON([]byte(doc))
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "unable to parse rendered manifest")
+		}
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return nil, nil, errors.Wrap(err, "unable to parse rendered manifest")
+		}
+		if obj.Kind == "" {
+			continue
+		}
+		key := objectKey{schema.FromAPIVersionAndKind(obj.APIVersion, obj.Kind), obj.Metadata.Namespace, obj.Metadata.Name}
+		objs[key.String()] = data
+		order = append(order, key)
+	}
+	return objs, order, nil
+}
+
+func twoWayPatch(gvk schema.GroupVersionKind, oldData, newData []byte) ([]byte, types.PatchType, error) {
+	obj, err := scheme.Scheme.New(gvk)
+	if err != nil {
+		// not a built-in kind, so there is no patch strategy to follow
+		patch, err := jsonpatch.CreateMergePatch(oldData, newData)
+		return patch, types.MergePatchType, err
+	}
+	patch, err := strategicpatch.CreateTwoWayMergePatch(oldData, newData, obj)
+	return patch, types.StrategicMergePatchType, err
+}
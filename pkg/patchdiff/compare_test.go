@@ -0,0 +1,79 @@
+package patchdiff
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestCompareManifests(t *testing.T) {
+	configMap := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: %s\n  namespace: web\ndata:\n  a: %q"
+	cm := func(name, value string) string {
+		return strings.NewReplacer("%s", name, "%q", `"`+value+`"`).Replace(configMap)
+	}
+	for _, tt := range []struct {
+		name          string
+		before, after []string
+		want          []string
+	}{
+		{
+			name:   "unchanged",
+			before: []string{cm("a", "1")},
+			after:  []string{cm("a", "1")},
+		},
+		{
+			name:   "patched",
+			before: []string{cm("a", "1")},
+			after:  []string{cm("a", "2")},
+			want:   []string{`ConfigMap a application/strategic-merge-patch+json {"data":{"a":"2"}}`},
+		},
+		{
+			name:   "created and deleted",
+			before: []string{cm("a", "1")},
+			after:  []string{cm("b", "1")},
+			want: []string{
+				`ConfigMap a delete null`,
+				`ConfigMap b create {"apiVersion":"v1","data":{"a":"1"},"kind":"ConfigMap","metadata":{"name":"b","namespace":"web"}}`,
+			},
+		},
+		{
+			name:   "same kind in different groups",
+			before: []string{widget, strings.Replace(widget, "example.com", "other.example.com", 1)},
+			after:  []string{widget, strings.Replace(strings.Replace(widget, "example.com", "other.example.com", 1), "size: 1", "size: 2", 1)},
+			want:   []string{`Widget w application/merge-patch+json {"spec":{"size":2}}`},
+		},
+	} {
+		entries, err := CompareManifests(manifest(tt.before), manifest(tt.after))
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, e := range entries {
+			patch := string(e.Patch)
+			if patch == "" {
+				patch = "null"
+			}
+			got = append(got, e.Kind+" "+e.Name+" "+string(e.PatchType)+" "+patch)
+		}
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s: got entries\n%s\nwant\n%s", tt.name, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+		}
+	}
+}
+
+func TestObjectKeyString(t *testing.T) {
+	for _, tt := range []struct {
+		key  objectKey
+		want string
+	}{
+		{objectKey{schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, "web", "a"}, "ConfigMap web/a"},
+		{objectKey{schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, "web", "a"}, "Deployment.apps web/a"},
+		{objectKey{schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Widget"}, "", "w"}, "Widget.example.com w"},
+	} {
+		if got := tt.key.String(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package patchdiff
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/action"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/cli-runtime/pkg/resource"
+	"k8s.io/client-go/discovery"
+)
+
+// IsReachable checks that the cluster of c can be reached before ctx is done.
+func IsReachable(ctx context.Context, c *action.Configuration) error {
+	dc, err := c.RESTClientGetter.ToDiscoveryClient()
+	if err != nil {
+		return errors.Wrap(err, "Kubernetes cluster unreachable")
+	}
+	_, err = serverVersion(ctx, dc)
+	return contextError(ctx, errors.Wrap(err, "Kubernetes cluster unreachable"))
+}
+
+// contextError replaces err with a timeout error when ctx ran out of time,
+// since the errors of cancelled requests do not say so plainly.
+func contextError(ctx context.Context, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errors.New("timed out contacting the cluster")
+	}
+	return err
+}
+
+// withContext runs fn, which cannot be cancelled itself, and stops waiting
+// for it once ctx is done. fn is left running, so callers rely on the
+// request timeout of the REST config to stop its requests, and must not
+// use what fn sets after withContext returns an error.
+func withContext(ctx context.Context, fn func() error) error {
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// serverVersion is DiscoveryClient.ServerVersion, cancelled along with ctx.
+func serverVersion(ctx context.Context, dc discovery.DiscoveryInterface) (*version.Info, error) {
+	body, err := dc.RESTClient().Get().AbsPath("/version").Do(ctx).Raw()
+	if err != nil {
+		return nil, err
+	}
+	var info version.Info
+	if err := json.Unmarshal(body, &info); err != nil {
+		return nil, errors.Wrap(err, "unable to parse the server version")
+	}
+	return &info, nil
+}
+
+// getObject is resource.Helper.Get, cancelled along with ctx.
+func getObject(ctx context.Context, info *resource.Info) (runtime.Object, error) {
+	req := info.Client.Get().
+		NamespaceIfScoped(info.Namespace, info.Mapping.Scope.Name() == meta.RESTScopeNameNamespace).
+		Resource(info.Mapping.Resource.Resource).
+		Name(info.Name)
+	if info.Export {
+		req.Param("export", strconv.FormatBool(info.Export))
+	}
+	return req.Do(ctx).Get()
+}
+
+// listObjects is resource.Helper.List for the objects of info's kind in
+// namespace, cancelled along with ctx.
+func listObjects(ctx context.Context, info *resource.Info, namespace string, options *metav1.ListOptions) (runtime.Object, error) {
+	req := info.Client.Get().
+		NamespaceIfScoped(namespace, info.Mapping.Scope.Name() == meta.RESTScopeNameNamespace).
+		Resource(info.Mapping.Resource.Resource).
+		VersionedParams(options, metav1.ParameterCodec)
+	if info.Export {
+		req.Param("export", strconv.FormatBool(info.Export))
+	}
+	return req.Do(ctx).Get()
+}
@@ -0,0 +1,63 @@
+package patchdiff
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newWedgedCluster returns a cluster that answers no request, and a channel
+// that receives when a request is cancelled.
+func newWedgedCluster(t *testing.T) (*testCluster, chan struct{}) {
+	cancelled := make(chan struct{}, 1)
+	c := &testCluster{Server: httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			select {
+			case cancelled <- struct{}{}:
+			default:
+			}
+		case <-time.After(10 * time.Second):
+		}
+	}))}
+	t.Cleanup(c.Close)
+	return c, cancelled
+}
+
+func TestIsReachableCancelsRequests(t *testing.T) {
+	cluster, cancelled := newWedgedCluster(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := IsReachable(ctx, cluster.actionConfig(t))
+	if err == nil || err.Error() != "timed out contacting the cluster" {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request was left running after the deadline")
+	}
+}
+
+func TestGetCapabilitiesCancelsRequests(t *testing.T) {
+	cluster, cancelled := newWedgedCluster(t)
+
+	c := cluster.actionConfig(t)
+	c.Capabilities = nil
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := GetCapabilities(ctx, c); err == nil || err.Error() != "timed out contacting the cluster" {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if c.Capabilities != nil {
+		t.Error("capabilities were set although discovery timed out")
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request was left running after the deadline")
+	}
+}
@@ -0,0 +1,61 @@
+package patchdiff
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/cli-runtime/pkg/resource"
+)
+
+// absentCRDs returns the manifest of the CustomResourceDefinitions in the
+// crds/ directories of ch that the cluster does not have yet. Helm only ever
+// creates these, so those already present are left out rather than patched.
+func absentCRDs(ctx context.Context, c *action.Configuration, ch *chart.Chart) (string, error) {
+	b := bytes.NewBuffer(nil)
+	for _, crd := range ch.CRDObjects() {
+		for _, doc := range splitManifests(string(crd.File.Data)) {
+			resources, err := c.KubeClient.Build(bytes.NewBufferString(doc), false)
+			if err != nil {
+				return "", errors.Wrapf(err, "unable to build kubernetes objects from CRD %s", crd.Filename)
+			}
+			absent := false
+			err = resources.Visit(func(info *resource.Info, err error) error {
+				if err != nil {
+					return err
+				}
+				if _, err := getObject(ctx, info); apierrors.IsNotFound(err) {
+					absent = true
+				} else if err != nil {
+					return errors.Wrapf(err, "unable to get live state of CRD %q", info.Name)
+				} else {
+					c.Log("CRD %s is already present and is not upgraded, skipping", info.Name)
+				}
+				return nil
+			})
+			if err != nil {
+				return "", err
+			}
+			if absent {
+				fmt.Fprintf(b, "---\n# Source: %s\n%s\n", crd.Filename, doc)
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+// chartCRDs returns the manifest of the CRDs of ch the upgrade would create.
+// Without a cluster to look them up in, none are diffed.
+func chartCRDs(ctx context.Context, c *action.Configuration, ch *chart.Chart, opts *Options) (string, error) {
+	if !opts.Offline {
+		return absentCRDs(ctx, c, ch)
+	}
+	if len(ch.CRDObjects()) > 0 {
+		c.Log("the CRDs of the chart cannot be looked up offline, so they are not diffed")
+	}
+	return "", nil
+}
@@ -0,0 +1,91 @@
+package patchdiff
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+const widgetCRD = `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+spec:
+  group: example.com
+  names:
+    kind: Widget
+    plural: widgets
+  scope: Namespaced
+  versions:
+  - name: v1
+    served: true
+    storage: true`
+
+const widget = `apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: w
+  namespace: web
+spec:
+  size: 1`
+
+// gadgetCRD and gadget are of the kind the test cluster already serves.
+var (
+	gadgetCRD = strings.NewReplacer("widgets", "gadgets", "Widget", "Gadget").Replace(widgetCRD)
+	gadget    = strings.Replace(widget, "Widget", "Gadget", 1)
+)
+
+func TestPendingCustomResources(t *testing.T) {
+	c := newTestCluster(t).actionConfig(t)
+	for _, tt := range []struct {
+		name    string
+		docs    []string
+		want    []string
+		pending []string
+	}{
+		{"no CRDs", []string{releaseDocs[0], widget}, []string{releaseDocs[0], widget}, nil},
+		{"pending CRD", []string{widgetCRD, widget, releaseDocs[0]}, []string{widgetCRD, releaseDocs[0]}, []string{"example.com/v1, Kind=Widget web/w"}},
+		{"established CRD", []string{gadgetCRD, gadget}, []string{gadgetCRD, gadget}, nil},
+		{"pending and established CRDs", []string{gadget, widget, gadgetCRD, widgetCRD}, []string{gadget, gadgetCRD, widgetCRD}, []string{"example.com/v1, Kind=Widget web/w"}},
+	} {
+		got, pending, err := pendingCustomResources(c, manifest(tt.docs))
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if strings.Join(splitManifests(got), "\n---\n") != strings.Join(tt.want, "\n---\n") {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, got, manifest(tt.want))
+		}
+		var names []string
+		for _, info := range pending {
+			names = append(names, info.Mapping.GroupVersionKind.String()+" "+info.Namespace+"/"+info.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(tt.pending, ",") {
+			t.Errorf("%s: got pending %v, want %v", tt.name, names, tt.pending)
+		}
+	}
+}
+
+func TestCreatePatchsetCreatesPendingCustomResources(t *testing.T) {
+	cluster := newTestCluster(t, manifest(releaseDocs))
+	ps, err := createPatchset(context.Background(), cluster.actionConfig(t), "r", manifest(releaseDocs), manifest(append([]string{widgetCRD, widget}, releaseDocs...)), &Options{Install: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range ps.entries {
+		got = append(got, e.Kind+" "+e.Name+" "+string(e.PatchType))
+	}
+	// the custom resource is created along with its CRD
+	if want := "CustomResourceDefinition widgets.example.com create\nWidget w create"; strings.Join(got, "\n") != want {
+		t.Errorf("got entries\n%s\nwant\n%s", strings.Join(got, "\n"), want)
+	}
+	if ps.counts.Created != 2 || ps.kinds.of("Widget").Created != 1 {
+		t.Errorf("got counts %+v, want 2 created, one of them a Widget", ps.counts)
+	}
+	for _, path := range cluster.served() {
+		if strings.Contains(path, "/widgets/") {
+			t.Errorf("looked up %s, whose kind is not served yet", path)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package patchdiff
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// deltaLines lists the fields a patch sets or removes, one per line, with a
+// "+" when live does not have the field yet, "~" when the patch changes it
+// and "-" when the patch removes it, followed by the new value. Values longer
+// than maxWidth runes are truncated; a maxWidth of 0 keeps them whole. Fields
+// nested deeper than limit are listed as the collapsed sub-object holding
+// them.
+func deltaLines(patch, live []byte, maxWidth int, limit *depthLimit) ([]string, error) {
+	var doc, liveDoc interface{}
+	if err := json.Unmarshal(patch, &doc); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(live, &liveDoc); err != nil {
+		return nil, err
+	}
+	var lines []string
+	walkDelta(doc, liveDoc, "", maxWidth, limit, &lines)
+	return lines, nil
+}
+
+func walkDelta(node, live interface{}, path string, maxWidth int, limit *depthLimit, lines *[]string) {
+	if limit != nil && isContainer(node) && strings.Count(path, "/") > limit.max {
+		limit.collapsed++
+		prefix := "~"
+		if live == nil {
+			prefix = "+"
+		}
+		*lines = append(*lines, fmt.Sprintf("%s %s: %s", prefix, path, collapsedValue(node, false)))
+		return
+	}
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if len(n) == 0 && path != "" {
+			deltaLine(live, path, n, maxWidth, lines)
+			return
+		}
+		liveMap, _ := live.(map[string]interface{})
+		keys := make([]string, 0, len(n))
+		for k := range n {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := n[k]
+			switch {
+			case k == "$patch":
+				if v == "delete" {
+					*lines = append(*lines, "- "+orRoot(path))
+				}
+			case k == "$retainKeys" || strings.HasPrefix(k, "$setElementOrder/"):
+				// ordering and retention hints accompany real changes
+			case strings.HasPrefix(k, "$deleteFromPrimitiveList/"):
+				*lines = append(*lines, fmt.Sprintf("- %s/%s: %s", path, escapePointer(strings.TrimPrefix(k, "$deleteFromPrimitiveList/")), deltaValue(v, maxWidth)))
+			case v == nil:
+				*lines = append(*lines, fmt.Sprintf("- %s/%s", path, escapePointer(k)))
+			default:
+				walkDelta(v, liveMap[k], path+"/"+escapePointer(k), maxWidth, limit, lines)
+			}
+		}
+	case []interface{}:
+		objects := len(n) > 0
+		for _, v := range n {
+			if _, ok := v.(map[string]interface{}); !ok {
+				objects = false
+			}
+		}
+		if !objects {
+			deltaLine(live, path, n, maxWidth, lines)
+			return
+		}
+		// like patchPaths, list items are walked without an index, each
+		// against the live item it most likely patches
+		liveItems, _ := live.([]interface{})
+		for _, v := range n {
+			walkDelta(v, matchingItem(v.(map[string]interface{}), liveItems), path, maxWidth, limit, lines)
+		}
+	default:
+		deltaLine(live, path, n, maxWidth, lines)
+	}
+}
+
+func deltaLine(live interface{}, path string, value interface{}, maxWidth int, lines *[]string) {
+	if reflect.DeepEqual(live, value) {
+		// merge keys of list items repeat the live value
+		return
+	}
+	prefix := "~"
+	if live == nil {
+		prefix = "+"
+	}
+	*lines = append(*lines, fmt.Sprintf("%s %s: %s", prefix, orRoot(path), deltaValue(value, maxWidth)))
+}
+
+// matchingItem returns the live list item sharing the most scalar fields with
+// a patch item, which strategic merge patches always identify by merge key,
+// or nil if none shares any.
+func matchingItem(item map[string]interface{}, liveItems []interface{}) interface{} {
+	var best interface{}
+	bestShared := 0
+	for _, candidate := range liveItems {
+		c, ok := candidate.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		shared := 0
+		for k, v := range item {
+			switch v.(type) {
+			case map[string]interface{}, []interface{}:
+				continue
+			}
+			if c[k] == v {
+				shared++
+			}
+		}
+		if shared > bestShared {
+			best, bestShared = c, shared
+		}
+	}
+	return best
+}
+
+func deltaValue(value interface{}, maxWidth int) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	s := []rune(string(data))
+	if maxWidth > 0 && len(s) > maxWidth {
+		if maxWidth <= 3 {
+			return string(s[:maxWidth])
+		}
+		return string(s[:maxWidth-3]) + "..."
+	}
+	return string(s)
+}
@@ -0,0 +1,172 @@
+package patchdiff
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"helm.sh/helm/v3/pkg/action"
+)
+
+// depthLimit collapses the sub-objects of displayed objects that are nested
+// deeper than max, counting how many it collapsed. A nil depthLimit, or one
+// with a max of 0, displays objects whole. Only what is displayed is
+// collapsed, never the patches.
+type depthLimit struct {
+	max       int
+	collapsed int
+}
+
+func newDepthLimit(max int) *depthLimit {
+	if max <= 0 {
+		return nil
+	}
+	return &depthLimit{max: max}
+}
+
+// The markers of collapsed objects and lists. A collapsed value that differs
+// between the two sides of a diff is marked as changed on the second.
+const (
+	collapsedObject        = "{...}"
+	collapsedList          = "[...]"
+	collapsedChangedObject = "{... changed}"
+	collapsedChangedList   = "[... changed]"
+)
+
+// collapse returns the JSON documents before and after, either of which may
+// be nil, with their sub-objects deeper than the limit collapsed. The two are
+// walked side by side, so that a change below the limit still shows.
+func (l *depthLimit) collapse(before, after []byte) ([]byte, []byte, error) {
+	if l == nil {
+		return before, after, nil
+	}
+	var a, b interface{}
+	for _, side := range []struct {
+		data []byte
+		v    *interface{}
+	}{{before, &a}, {after, &b}} {
+		if side.data != nil {
+			if err := json.Unmarshal(side.data, side.v); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	a, b = l.collapsePair(a, b, 0)
+	var err error
+	if before != nil {
+		if before, err = json.Marshal(a); err != nil {
+			return nil, nil, err
+		}
+	}
+	if after != nil {
+		if after, err = json.Marshal(b); err != nil {
+			return nil, nil, err
+		}
+	}
+	return before, after, nil
+}
+
+// collapsePair collapses a and b, the values at the same place of the two
+// sides at the given depth, where the fields of the root are at depth 1.
+func (l *depthLimit) collapsePair(a, b interface{}, depth int) (interface{}, interface{}) {
+	if depth > l.max && (isContainer(a) || isContainer(b)) {
+		l.collapsed++
+		return collapsedValue(a, false), collapsedValue(b, !reflect.DeepEqual(a, b))
+	}
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		ca, cb := map[string]interface{}{}, map[string]interface{}{}
+		for k, v := range av {
+			if w, ok := bv[k]; ok {
+				ca[k], cb[k] = l.collapsePair(v, w, depth+1)
+			} else {
+				ca[k] = l.collapseOne(v, depth+1)
+			}
+		}
+		for k, w := range bv {
+			if _, ok := av[k]; !ok {
+				cb[k] = l.collapseOne(w, depth+1)
+			}
+		}
+		return ca, cb
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		// list items are paired by index, which is only for display
+		ca, cb := make([]interface{}, len(av)), make([]interface{}, len(bv))
+		for i := range ca {
+			if i < len(cb) {
+				ca[i], cb[i] = l.collapsePair(av[i], bv[i], depth+1)
+			} else {
+				ca[i] = l.collapseOne(av[i], depth+1)
+			}
+		}
+		for i := len(ca); i < len(cb); i++ {
+			cb[i] = l.collapseOne(bv[i], depth+1)
+		}
+		return ca, cb
+	}
+	return l.collapseOne(a, depth), l.collapseOne(b, depth)
+}
+
+// collapseOne collapses a value that the other side has nothing in common
+// with.
+func (l *depthLimit) collapseOne(v interface{}, depth int) interface{} {
+	if depth > l.max {
+		if isContainer(v) {
+			l.collapsed++
+		}
+		return collapsedValue(v, false)
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for k, w := range v {
+			c[k] = l.collapseOne(w, depth+1)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, w := range v {
+			c[i] = l.collapseOne(w, depth+1)
+		}
+		return c
+	}
+	return v
+}
+
+// note logs how many sub-objects were collapsed, if any.
+func (l *depthLimit) note(c *action.Configuration) {
+	if l != nil && l.collapsed > 0 {
+		c.Log("collapsed %d sub-object(s) nested deeper than --max-depth %d into %s; json output has them in full", l.collapsed, l.max, collapsedObject)
+	}
+}
+
+func isContainer(v interface{}) bool {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		return true
+	}
+	return false
+}
+
+func collapsedValue(v interface{}, changed bool) interface{} {
+	switch v.(type) {
+	case map[string]interface{}:
+		if changed {
+			return collapsedChangedObject
+		}
+		return collapsedObject
+	case []interface{}:
+		if changed {
+			return collapsedChangedList
+		}
+		return collapsedList
+	}
+	return v
+}
@@ -0,0 +1,122 @@
+package patchdiff
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDepthLimitCollapse(t *testing.T) {
+	for _, tt := range []struct {
+		name                  string
+		max                   int
+		before, after         string
+		wantBefore, wantAfter string
+		wantCollapsed         int
+	}{
+		{
+			name:       "no limit",
+			before:     `{"spec":{"template":{"a":1}}}`,
+			after:      `{"spec":{"template":{"a":2}}}`,
+			wantBefore: `{"spec":{"template":{"a":1}}}`,
+			wantAfter:  `{"spec":{"template":{"a":2}}}`,
+		},
+		{
+			name:          "unchanged sub-object",
+			max:           1,
+			before:        `{"spec":{"replicas":1,"template":{"a":1}}}`,
+			after:         `{"spec":{"replicas":2,"template":{"a":1}}}`,
+			wantBefore:    `{"spec":{"replicas":1,"template":"{...}"}}`,
+			wantAfter:     `{"spec":{"replicas":2,"template":"{...}"}}`,
+			wantCollapsed: 1,
+		},
+		{
+			name:          "changed sub-object and list",
+			max:           1,
+			before:        `{"spec":{"template":{"a":1},"ports":[{"port":80}]}}`,
+			after:         `{"spec":{"template":{"a":2},"ports":[{"port":80}]}}`,
+			wantBefore:    `{"spec":{"ports":"[...]","template":"{...}"}}`,
+			wantAfter:     `{"spec":{"ports":"[...]","template":"{... changed}"}}`,
+			wantCollapsed: 2,
+		},
+		{
+			name:          "one side",
+			max:           2,
+			after:         `{"spec":{"template":{"spec":{"containers":[]}},"selector":{"app":"a"}}}`,
+			wantAfter:     `{"spec":{"selector":{"app":"a"},"template":{"spec":"{...}"}}}`,
+			wantCollapsed: 1,
+		},
+		{
+			name:          "fields on one side",
+			max:           1,
+			before:        `{"spec":{}}`,
+			after:         `{"spec":{"template":{"a":1}}}`,
+			wantBefore:    `{"spec":{}}`,
+			wantAfter:     `{"spec":{"template":"{...}"}}`,
+			wantCollapsed: 1,
+		},
+	} {
+		limit := newDepthLimit(tt.max)
+		var before, after []byte
+		if tt.before != "" {
+			before = []byte(tt.before)
+		}
+		if tt.after != "" {
+			after = []byte(tt.after)
+		}
+		gotBefore, gotAfter, err := limit.collapse(before, after)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if string(gotBefore) != tt.wantBefore || string(gotAfter) != tt.wantAfter {
+			t.Errorf("%s: got %s and %s, want %s and %s", tt.name, gotBefore, gotAfter, tt.wantBefore, tt.wantAfter)
+		}
+		if limit != nil && limit.collapsed != tt.wantCollapsed {
+			t.Errorf("%s: collapsed %d, want %d", tt.name, limit.collapsed, tt.wantCollapsed)
+		}
+	}
+}
+
+func TestDeltaLinesMaxDepth(t *testing.T) {
+	patch := `{"spec":{"replicas":3,"template":{"spec":{"containers":[{"name":"app","image":"b"}]}}},"metadata":{"labels":{"a":"b"}}}`
+	live := `{"spec":{"replicas":1,"template":{"spec":{"containers":[{"name":"app","image":"a"}]}}},"metadata":{}}`
+	got, err := deltaLines([]byte(patch), []byte(live), 0, newDepthLimit(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "+ /metadata/labels: {...}\n~ /spec/replicas: 3\n~ /spec/template: {...}"
+	if strings.Join(got, "\n") != want {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), want)
+	}
+}
+
+func TestCreatePatchsetMaxDepth(t *testing.T) {
+	deployment := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: a
+  namespace: web
+spec:
+  template:
+    spec:
+      containers:
+      - name: app
+        image: %s`
+	release, target := fmt.Sprintf(deployment, "a"), fmt.Sprintf(deployment, "b")
+	for _, output := range []string{"diff", "argocd", "delta"} {
+		cluster := newTestCluster(t, release)
+		ps, err := createPatchset(context.Background(), cluster.actionConfig(t), "r", release, target, &Options{Output: output, MaxDepth: 2})
+		if err != nil {
+			t.Fatalf("%s: %s", output, err)
+		}
+		if !strings.Contains(ps.output, collapsedObject) || strings.Contains(ps.output, "image") {
+			t.Errorf("%s: got output\n%s\nwant spec.template.spec collapsed", output, ps.output)
+		}
+		// the patches are complete whatever is displayed
+		if len(ps.entries) != 1 || !strings.Contains(string(ps.entries[0].Patch), `"image":"b"`) {
+			t.Errorf("%s: got entries %+v, want one whole patch", output, ps.entries)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package patchdiff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// lineDiff compares two texts line by line and returns the differences in the
+// normal format of diff(1), as Argo CD presents them. The change markers and
+// changed lines are passed through removed and added for coloring.
+func lineDiff(before, after string, removed, added func(string) string) string {
+	a, b := splitLines(before), splitLines(after)
+	lcs := commonLengths(a, b)
+
+	var out strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		if i < len(a) && j < len(b) && a[i] == b[j] {
+			i++
+			j++
+			continue
+		}
+
+		// collect the run of changes up to the next common line
+		i0, j0 := i, j
+		for i < len(a) || j < len(b) {
+			if i < len(a) && j < len(b) && a[i] == b[j] {
+				break
+			}
+			if j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]) {
+				i++
+			} else {
+				j++
+			}
+		}
+
+		switch {
+		case i > i0 && j > j0:
+			fmt.Fprintf(&out, "%sc%s\n", lineRange(i0, i), lineRange(j0, j))
+		case i > i0:
+			fmt.Fprintf(&out, "%sd%d\n", lineRange(i0, i), j0)
+		default:
+			fmt.Fprintf(&out, "%da%s\n", i0, lineRange(j0, j))
+		}
+		for _, line := range a[i0:i] {
+			out.WriteString(removed("< "+line) + "\n")
+		}
+		if i > i0 && j > j0 {
+			out.WriteString("---\n")
+		}
+		for _, line := range b[j0:j] {
+			out.WriteString(added("> "+line) + "\n")
+		}
+	}
+	return out.String()
+}
+
+// unifiedContext is the number of unchanged lines around each hunk of a
+// unified diff, as diff -u prints.
+const unifiedContext = 3
+
+// unifiedDiff compares two texts line by line and returns the differences in
+// the unified format of diff -u, under headers naming fromFile and toFile. It
+// returns "" when the texts are the same. Removed and added lines are passed
+// through removed and added for coloring.
+func unifiedDiff(before, after, fromFile, toFile string, removed, added func(string) string) string {
+	a, b := splitLines(before), splitLines(after)
+	lcs := commonLengths(a, b)
+
+	// ops is the edit script, one of ' ', '-' or '+' per line, and aPos and
+	// bPos the number of lines of a and b before each op
+	var ops []byte
+	var lines []string
+	var aPos, bPos []int
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		aPos, bPos = append(aPos, i), append(bPos, j)
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops, lines = append(ops, ' '), append(lines, a[i])
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			ops, lines = append(ops, '-'), append(lines, a[i])
+			i++
+		default:
+			ops, lines = append(ops, '+'), append(lines, b[j])
+			j++
+		}
+	}
+	aPos, bPos = append(aPos, i), append(bPos, j)
+
+	var out strings.Builder
+	for start := 0; start < len(ops); {
+		first := start
+		for first < len(ops) && ops[first] == ' ' {
+			first++
+		}
+		if first == len(ops) {
+			break
+		}
+		// a hunk runs on while the next change is close enough for their
+		// context to touch
+		end := first
+		for k := first; k < len(ops); k++ {
+			if ops[k] != ' ' {
+				end = k + 1
+			} else if k-end >= 2*unifiedContext {
+				break
+			}
+		}
+		lo, hi := first-unifiedContext, end+unifiedContext
+		if lo < start {
+			lo = start
+		}
+		if hi > len(ops) {
+			hi = len(ops)
+		}
+
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromFile, toFile)
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(aPos[lo], aPos[hi]), hunkRange(bPos[lo], bPos[hi]))
+		for k := lo; k < hi; k++ {
+			line := string(ops[k]) + lines[k]
+			switch ops[k] {
+			case '-':
+				line = removed(line)
+			case '+':
+				line = added(line)
+			}
+			out.WriteString(line + "\n")
+		}
+		start = hi
+	}
+	return out.String()
+}
+
+// hunkRange formats the 0-based half-open range [from, to) of lines as a
+// unified diff hunk header does.
+func hunkRange(from, to int) string {
+	switch to - from {
+	case 0:
+		return fmt.Sprintf("%d,0", from)
+	case 1:
+		return fmt.Sprint(to)
+	}
+	return fmt.Sprintf("%d,%d", from+1, to-from)
+}
+
+// commonLengths returns the table whose [i][j] entry is the length of the
+// longest common subsequence of a[i:] and b[j:].
+func commonLengths(a, b []string) [][]int {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	return lcs
+}
+
+// lineRange formats the 0-based half-open range [from, to) as 1-based line
+// numbers.
+func lineRange(from, to int) string {
+	if to-from == 1 {
+		return fmt.Sprint(to)
+	}
+	return fmt.Sprintf("%d,%d", from+1, to)
+}
+
+func splitLines(s string) []string {
+	s = strings.TrimSuffix(s, "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
@@ -0,0 +1,94 @@
+package patchdiff
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/kube"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/jsonmergepatch"
+	"k8s.io/cli-runtime/pkg/resource"
+)
+
+// ReportDrift prints the fields of each live object that no longer match the
+// stored manifest. The stored manifest is used as both the original and the
+// target of a three-way merge with the live object, so the patch holds
+// exactly what an upgrade to the same manifest would reset.
+func ReportDrift(ctx context.Context, out io.Writer, c *action.Configuration, manifest string, opts *Options) error {
+	stored, err := c.KubeClient.Build(bytes.NewBufferString(manifest), false)
+	if err != nil {
+		return errors.Wrap(err, "unable to build kubernetes objects from release manifest")
+	}
+	if err := clearClusterScopedNamespaces(stored); err != nil {
+		return err
+	}
+
+	drifted := 0
+	live := newLiveFetcher(stored, opts.BatchFetch)
+	err = stored.Visit(func(info *resource.Info, err error) error {
+		if err != nil {
+			return err
+		}
+		kind := info.Mapping.GroupVersionKind.Kind
+
+		liveObj, err := live.Get(ctx, info)
+		if apierrors.IsNotFound(err) {
+			drifted++
+			fmt.Fprintf(out, "%s %q: missing from the cluster\n", kind, info.Name)
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "unable to get data for current object %s/%s", info.Namespace, info.Name)
+		}
+
+		patch, err := driftPatch(info, liveObj, opts, c.Log)
+		if err != nil {
+			return err
+		}
+		if isEmptyPatch(patch) {
+			return nil
+		}
+
+		paths, err := patchPaths(patch)
+		if err != nil {
+			return errors.Wrapf(err, "unable to analyze patch for %s %q", kind, info.Name)
+		}
+		drifted++
+		fmt.Fprintf(out, "%s %q:\n  - %s\n", kind, info.Name, strings.Join(paths, "\n  - "))
+		return nil
+	})
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	if drifted == 0 {
+		fmt.Fprintln(out, "No drift detected")
+	}
+	return nil
+}
+
+// driftPatch returns the patch that resets the fields of liveObj that the
+// stored object info sets to something else. Kinds without a patch strategy,
+// such as custom resources, are patched with a JSON merge patch from the
+// stored to the target object, which never looks at the live object, so their
+// patch is computed from the live object instead. Fields only the live object
+// has are left alone, as with a strategic merge patch.
+func driftPatch(info *resource.Info, liveObj runtime.Object, opts *Options, logf action.DebugLog) ([]byte, error) {
+	if patchType, _ := patchStrategy(kube.AsVersioned(info)); patchType != types.MergePatchType {
+		patch, _, _, _, err := createPatch(info.Object, info, liveObj, opts, logf)
+		return patch, err
+	}
+	// with the live object as the original, the configurations come back
+	// normalized as those of any other patch
+	_, _, liveData, storedData, err := createPatch(liveObj, info, liveObj, opts, logf)
+	if err != nil {
+		return nil, err
+	}
+	return jsonmergepatch.CreateThreeWayJSONMergePatch(storedData, storedData, liveData)
+}
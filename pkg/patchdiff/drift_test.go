@@ -0,0 +1,54 @@
+package patchdiff
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestReportDrift(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		stored string
+		live   string
+		want   string
+	}{
+		{
+			name:   "no drift",
+			stored: gadget,
+			live:   gadget,
+			want:   "No drift detected\n",
+		},
+		{
+			name:   "custom resource",
+			stored: gadget,
+			// fields only the live object has are not drift
+			live: strings.Replace(gadget, "size: 1", "size: 2\n  color: red", 1),
+			want: "Gadget \"w\":\n  - /spec/size\n",
+		},
+		{
+			name:   "custom resource definition",
+			stored: gadgetCRD,
+			live:   strings.Replace(gadgetCRD, "served: true", "served: false", 1),
+			// a merge patch replaces lists as a whole
+			want: "CustomResourceDefinition \"gadgets.example.com\":\n  - /spec/versions/name\n  - /spec/versions/served\n  - /spec/versions/storage\n",
+		},
+		{
+			name:   "built-in kind",
+			stored: "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: c\n  namespace: web\ndata:\n  a: \"1\"",
+			live:   "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: c\n  namespace: web\ndata:\n  a: \"2\"",
+			want:   "ConfigMap \"c\":\n  - /data/a\n",
+		},
+	} {
+		cluster := newTestCluster(t, tt.live)
+		var out bytes.Buffer
+		if err := ReportDrift(context.Background(), &out, cluster.actionConfig(t), tt.stored, &Options{}); err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if out.String() != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, out.String(), tt.want)
+		}
+	}
+}
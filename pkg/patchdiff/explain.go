@@ -0,0 +1,90 @@
+package patchdiff
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/action"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/cli-runtime/pkg/resource"
+)
+
+// ExplainCreate reports the outcome of the live lookup for the target
+// resource matching kind and name, and the likely reason it is missing.
+func ExplainCreate(ctx context.Context, out io.Writer, c *action.Configuration, originalManifest, targetManifest, kind, name string) error {
+	original, err := c.KubeClient.Build(bytes.NewBufferString(originalManifest), false)
+	if err != nil {
+		return errors.Wrap(err, "unable to build kubernetes objects from original release manifest")
+	}
+	if err := clearClusterScopedNamespaces(original); err != nil {
+		return err
+	}
+	target, err := c.KubeClient.Build(bytes.NewBufferString(targetManifest), false)
+	if err != nil {
+		return errors.Wrap(err, "unable to build kubernetes objects from new release manifest")
+	}
+	if err := clearClusterScopedNamespaces(target); err != nil {
+		return err
+	}
+
+	var info *resource.Info
+	for _, i := range target {
+		if strings.EqualFold(i.Mapping.GroupVersionKind.Kind, kind) && i.Name == name {
+			info = i
+			break
+		}
+	}
+	if info == nil {
+		return fmt.Errorf("%s/%s is not part of the rendered chart", kind, name)
+	}
+
+	gvk := info.Mapping.GroupVersionKind
+	fmt.Fprintf(out, "Looking up %s %q in namespace %q\n", gvk, info.Name, info.Namespace)
+
+	_, err = getObject(ctx, info)
+	if err == nil {
+		fmt.Fprintln(out, "Result: found. The resource will be patched, not created.")
+		return nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return errors.Wrapf(contextError(ctx, err), "unable to get data for current object %s/%s", info.Namespace, info.Name)
+	}
+	fmt.Fprintln(out, "Result: NotFound. The resource will be created.")
+
+	// The same name may live in another namespace if the chart's namespace
+	// handling changed.
+	if info.Mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		list, err := listObjects(ctx, info, "", &metav1.ListOptions{FieldSelector: "metadata.name=" + info.Name})
+		if err != nil {
+			return errors.Wrapf(contextError(ctx, err), "unable to list %s named %q across namespaces", gvk.Kind, info.Name)
+		}
+		items, err := meta.ExtractList(list)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			accessor, err := meta.Accessor(item)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Cause: wrong namespace. A %s named %q exists in namespace %q.\n", gvk.Kind, info.Name, accessor.GetNamespace())
+		}
+	}
+
+	// The current release may manage the same object under another API
+	// group or version.
+	for _, o := range original {
+		ogvk := o.Mapping.GroupVersionKind
+		if o.Name == info.Name && ogvk.Kind == gvk.Kind && ogvk != gvk {
+			fmt.Fprintf(out, "Cause: GVK mismatch. The current release manages %q as %s, the chart now renders it as %s.\n", o.Name, ogvk, gvk)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package patchdiff
+
+import (
+	"context"
+	"sync"
+
+	"helm.sh/helm/v3/pkg/kube"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/cli-runtime/pkg/resource"
+)
+
+// liveFetcher looks up the live state of target resources. With batching
+// enabled, kinds with several resources in the same namespace are fetched
+// with a single list call and matched by name, instead of one get each.
+type liveFetcher struct {
+	batch bool
+	// pending are resources of kinds the cluster does not serve yet, which
+	// cannot exist and are not looked up.
+	pending map[*resource.Info]bool
+	// counts is the number of target resources per kind and namespace.
+	counts map[string]int
+	// lists caches the listed objects per kind and namespace. mu guards the
+	// map, since resources are fetched concurrently, but not the list calls,
+	// so that a slow list does not hold up other kinds and namespaces.
+	mu    sync.Mutex
+	lists map[string]*fetchedList
+}
+
+// fetchedList is the list of one kind in one namespace, fetched once however
+// many of its resources ask for it.
+type fetchedList struct {
+	once sync.Once
+	// objs are the listed objects by name. nil means the list failed and
+	// individual gets are used instead.
+	objs map[string]runtime.Object
+}
+
+func newLiveFetcher(target kube.ResourceList, batch bool) *liveFetcher {
+	f := &liveFetcher{
+		batch:   batch,
+		pending: map[*resource.Info]bool{},
+		counts:  map[string]int{},
+		lists:   map[string]*fetchedList{},
+	}
+	for _, info := range target {
+		f.counts[fetchKey(info)]++
+	}
+	return f
+}
+
+// Get returns the live object for info, or a NotFound error if it does not
+// exist.
+func (f *liveFetcher) Get(ctx context.Context, info *resource.Info) (runtime.Object, error) {
+	if f.pending[info] {
+		return nil, apierrors.NewNotFound(info.Mapping.Resource.GroupResource(), info.Name)
+	}
+	key := fetchKey(info)
+	if f.batch && f.counts[key] > 1 {
+		f.mu.Lock()
+		l, ok := f.lists[key]
+		if !ok {
+			l = &fetchedList{}
+			f.lists[key] = l
+		}
+		f.mu.Unlock()
+		// the first resource lists its kind, the others wait for it
+		l.once.Do(func() { l.objs = f.list(ctx, info) })
+		if l.objs != nil {
+			if obj, ok := l.objs[info.Name]; ok {
+				return obj, nil
+			}
+			return nil, apierrors.NewNotFound(info.Mapping.Resource.GroupResource(), info.Name)
+		}
+	}
+
+	return getObject(ctx, info)
+}
+
+// list fetches every object of info's kind in its namespace, indexed by name.
+// It returns nil if the list call fails, for example when RBAC allows get but
+// not list.
+func (f *liveFetcher) list(ctx context.Context, info *resource.Info) map[string]runtime.Object {
+	list, err := listObjects(ctx, info, info.Namespace, &metav1.ListOptions{})
+	if err != nil {
+		return nil
+	}
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return nil
+	}
+
+	objs := make(map[string]runtime.Object, len(items))
+	for _, item := range items {
+		accessor, err := meta.Accessor(item)
+		if err != nil {
+			return nil
+		}
+		objs[accessor.GetName()] = item
+	}
+	return objs
+}
+
+// clearClusterScopedNamespaces removes the namespace from cluster-scoped
+// objects, which a template may set by mistake. The API server ignores it, so
+// keeping it would make the objects fail to match their stored and live
+// counterparts.
+func clearClusterScopedNamespaces(list kube.ResourceList) error {
+	for _, info := range list {
+		if info.Mapping.Scope.Name() != meta.RESTScopeNameRoot || info.Namespace == "" {
+			continue
+		}
+		accessor, err := meta.Accessor(info.Object)
+		if err != nil {
+			return err
+		}
+		accessor.SetNamespace("")
+		info.Namespace = ""
+	}
+	return nil
+}
+
+func fetchKey(info *resource.Info) string {
+	return info.Mapping.GroupVersionKind.String() + "/" + info.Namespace
+}
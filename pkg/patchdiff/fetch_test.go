@@ -0,0 +1,263 @@
+package patchdiff
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/cli-runtime/pkg/resource"
+)
+
+func TestLiveFetcher(t *testing.T) {
+	// every ConfigMap of releaseDocs, and new, which does not exist
+	target := manifest(append([]string{targetDocs[0]}, releaseDocs...))
+	for _, tt := range []struct {
+		name        string
+		batch       bool
+		forbidLists bool
+		want        []string
+	}{
+		{
+			name: "individual",
+			want: []string{
+				"/api/v1/namespaces/api/configmaps/a",
+				"/api/v1/namespaces/api/configmaps/gone",
+				"/api/v1/namespaces/web/configmaps/b",
+				"/api/v1/namespaces/web/configmaps/new",
+				"/apis/apps/v1/namespaces/web/deployments/a",
+			},
+		},
+		{
+			// the Deployment is alone of its kind, so it is still a get
+			name:  "batched",
+			batch: true,
+			want: []string{
+				"/api/v1/namespaces/api/configmaps",
+				"/api/v1/namespaces/web/configmaps",
+				"/apis/apps/v1/namespaces/web/deployments/a",
+			},
+		},
+		{
+			name:        "batched without list access",
+			batch:       true,
+			forbidLists: true,
+			want: []string{
+				"/api/v1/namespaces/api/configmaps",
+				"/api/v1/namespaces/api/configmaps/a",
+				"/api/v1/namespaces/api/configmaps/gone",
+				"/api/v1/namespaces/web/configmaps",
+				"/api/v1/namespaces/web/configmaps/b",
+				"/api/v1/namespaces/web/configmaps/new",
+				"/apis/apps/v1/namespaces/web/deployments/a",
+			},
+		},
+	} {
+		cluster := newTestCluster(t, manifest(releaseDocs))
+		cluster.forbidLists = tt.forbidLists
+		infos, err := cluster.actionConfig(t).KubeClient.Build(bytes.NewBufferString(target), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f := newLiveFetcher(infos, tt.batch)
+		for _, info := range infos {
+			obj, err := f.Get(context.Background(), info)
+			if info.Name == "new" {
+				if !apierrors.IsNotFound(err) {
+					t.Errorf("%s: expected NotFound for ConfigMap new, got %v", tt.name, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s: %s %s: %s", tt.name, info.Namespace, info.Name, err)
+				continue
+			}
+			// whichever the request, the live object is the one stored
+			got, err := json.Marshal(obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored := cluster.objects[info.Client.Get().NamespaceIfScoped(info.Namespace, info.Namespaced()).Resource(info.Mapping.Resource.Resource).Name(info.Name).URL().Path]
+			if !jsonEqual(t, got, stored) {
+				t.Errorf("%s: got %s for %s %s, want %s", tt.name, got, info.Namespace, info.Name, stored)
+			}
+		}
+
+		served := cluster.served()
+		sort.Strings(served)
+		if strings.Join(served, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s: got requests\n%s\nwant\n%s", tt.name, strings.Join(served, "\n"), strings.Join(tt.want, "\n"))
+		}
+	}
+}
+
+func TestLiveFetcherConcurrentLists(t *testing.T) {
+	cluster := newTestCluster(t, manifest(releaseDocs))
+	// the list of the api namespace is slow
+	slow := make(chan struct{})
+	var release sync.Once
+	// the test server waits for held requests when it closes
+	t.Cleanup(func() { release.Do(func() { close(slow) }) })
+	cluster.hold = map[string]chan struct{}{"/api/v1/namespaces/api/configmaps": slow}
+	cluster.held = make(chan string, 1)
+	// two ConfigMaps in each namespace, so each is listed
+	target := manifest(append([]string{targetDocs[0]}, releaseDocs...))
+	infos, err := cluster.actionConfig(t).KubeClient.Build(bytes.NewBufferString(target), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := newLiveFetcher(infos, true)
+	errs := make(chan error, len(infos))
+	for _, info := range infos {
+		if info.Namespace == "api" {
+			go func(info *resource.Info) {
+				_, err := f.Get(context.Background(), info)
+				errs <- err
+			}(info)
+		}
+	}
+	<-cluster.held
+	// the web namespace is listed while the api list is in flight
+	for _, info := range infos {
+		if info.Namespace != "web" {
+			continue
+		}
+		done := make(chan error, 1)
+		go func(info *resource.Info) {
+			_, err := f.Get(context.Background(), info)
+			done <- err
+		}(info)
+		select {
+		case err := <-done:
+			if err != nil && !apierrors.IsNotFound(err) {
+				t.Errorf("%s %s: %s", info.Namespace, info.Name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s %s: waited for the list of another namespace", info.Namespace, info.Name)
+		}
+	}
+	release.Do(func() { close(slow) })
+	for _, info := range infos {
+		if info.Namespace == "api" {
+			if err := <-errs; err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	// the api namespace is still listed only once
+	lists := 0
+	for _, p := range cluster.served() {
+		if p == "/api/v1/namespaces/api/configmaps" {
+			lists++
+		}
+	}
+	if lists != 1 {
+		t.Errorf("got %d lists of the api namespace, want 1", lists)
+	}
+}
+
+// jsonEqual reports whether a and b hold the same JSON document.
+func jsonEqual(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var av, bv interface{}
+	if err := json.Unmarshal(a, &av); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &bv); err != nil {
+		t.Fatal(err)
+	}
+	ad, _ := json.Marshal(av)
+	bd, _ := json.Marshal(bv)
+	return bytes.Equal(ad, bd)
+}
+
+func TestClearClusterScopedNamespaces(t *testing.T) {
+	// a ClusterRole and a Namespace templated with a namespace by mistake
+	docs := []string{`apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: reader
+  namespace: web
+rules: []`, `apiVersion: v1
+kind: Namespace
+metadata:
+  name: web
+  namespace: web`, releaseDocs[0]}
+	cluster := newTestCluster(t)
+	infos, err := cluster.actionConfig(t).KubeClient.Build(bytes.NewBufferString(manifest(docs)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Build already drops the namespace of cluster-scoped objects, so set it
+	// again to stand for objects listed any other way
+	for _, info := range infos {
+		accessor, err := meta.Accessor(info.Object)
+		if err != nil {
+			t.Fatal(err)
+		}
+		accessor.SetNamespace("web")
+		info.Namespace = "web"
+	}
+	if err := clearClusterScopedNamespaces(infos); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"ClusterRole": "", "Namespace": "", "ConfigMap": "web"}
+	for _, info := range infos {
+		kind := info.Mapping.GroupVersionKind.Kind
+		data, err := json.Marshal(info.Object)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var obj struct {
+			Metadata struct {
+				Namespace string `json:"namespace"`
+			} `json:"metadata"`
+		}
+		if err := json.Unmarshal(data, &obj); err != nil {
+			t.Fatal(err)
+		}
+		if info.Namespace != want[kind] || obj.Metadata.Namespace != want[kind] {
+			t.Errorf("%s %s: got namespace %q and %q in its object, want %q", kind, info.Name, info.Namespace, obj.Metadata.Namespace, want[kind])
+		}
+	}
+}
+
+func TestCreatePatchsetMatchesClusterScopedObjects(t *testing.T) {
+	clusterRole := `apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: reader%s
+rules:
+- apiGroups: [""]
+  resources: [configmaps]
+  verbs: [%s]`
+	// the release stored the ClusterRole without a namespace, and the chart
+	// now sets one
+	release := fmt.Sprintf(clusterRole, "", "get")
+	target := fmt.Sprintf(clusterRole, "\n  namespace: web", "get, list")
+	cluster := newTestCluster(t, release)
+	ps, err := createPatchset(context.Background(), cluster.actionConfig(t), "r", release, target, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, e := range ps.entries {
+		got = append(got, e.Namespace+" "+e.Kind+" "+e.Name+" "+string(e.PatchType)+" "+string(e.Patch))
+	}
+	want := ` ClusterRole reader application/strategic-merge-patch+json {"rules":[{"apiGroups":[""],"resources":["configmaps"],"verbs":["get","list"]}]}`
+	if strings.Join(got, "\n") != want {
+		t.Errorf("got entries\n%s\nwant\n%s", strings.Join(got, "\n"), want)
+	}
+}
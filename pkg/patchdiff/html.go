@@ -0,0 +1,153 @@
+package patchdiff
+
+import (
+	"bytes"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/action"
+	"k8s.io/cli-runtime/pkg/resource"
+)
+
+// htmlSection is the change to one resource in html output.
+type htmlSection struct {
+	// Change is "created", "modified", "replaced" or "deleted".
+	Change string
+	Title  string
+	Lines  []htmlLine
+}
+
+// htmlLine is a line of the unified diff of a section, with the class it is
+// colored by.
+type htmlLine struct {
+	Class string
+	Text  string
+}
+
+// newHTMLSection renders the change to a resource as a unified diff of its
+// release and target configurations, as diff output does, uncolored.
+func newHTMLSection(info *resource.Info, change string, before, after []byte, limit *depthLimit) (htmlSection, error) {
+	same := func(s string) string { return s }
+	diff, err := unifiedYAMLDiff(info, before, after, limit, same, same)
+	if err != nil {
+		return htmlSection{}, err
+	}
+	section := htmlSection{Change: change, Title: resourceName(info)}
+	for _, line := range splitLines(diff) {
+		class := "context"
+		switch {
+		case strings.HasPrefix(line, "--- ") || strings.HasPrefix(line, "+++ "):
+			class = "file"
+		case strings.HasPrefix(line, "@@"):
+			class = "hunk"
+		case strings.HasPrefix(line, "-"):
+			class = "removed"
+		case strings.HasPrefix(line, "+"):
+			class = "added"
+		}
+		section.Lines = append(section.Lines, htmlLine{Class: class, Text: line})
+	}
+	return section, nil
+}
+
+// htmlReport is what html output shows.
+type htmlReport struct {
+	Release string
+	// Revision is that of the release the upgrade starts from, 0 when it
+	// is not installed.
+	Revision int
+	Counts   Counts
+	Sections []htmlSection
+}
+
+// releaseRevision returns the revision of the release the named release is
+// diffed against, or 0 when there is none.
+func releaseRevision(c *action.Configuration, name string, opts *Options) int {
+	if opts.Revision > 0 {
+		return opts.Revision
+	}
+	rel, err := c.Releases.Last(baseRelease(name, opts))
+	if err != nil {
+		return 0
+	}
+	return rel.Version
+}
+
+// writeReport writes the html report of the named release to a file named
+// after it in dir, compressed when compress is set, and returns its path.
+func writeReport(dir, name, report string, compress bool) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	data, path := []byte(report), filepath.Join(dir, unsafeFilenameChars.ReplaceAllString(name, "-")+".html")
+	if compress {
+		path += ".gz"
+		var err error
+		if data, err = gzipData(data); err != nil {
+			return "", err
+		}
+	}
+	return path, ioutil.WriteFile(path, data, 0644)
+}
+
+func (r *htmlReport) render() (string, error) {
+	var b bytes.Buffer
+	if err := htmlTemplate.Execute(&b, r); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// htmlTemplate is a single page with its styles and scripts inline, so that
+// it can be shared as one file.
+var htmlTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Upgrade preview of {{.Release}}</title>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #24292e; }
+header { border-bottom: 1px solid #e1e4e8; margin-bottom: 1em; }
+.counts span { display: inline-block; margin-right: 1em; }
+details { border: 1px solid #e1e4e8; border-radius: 4px; margin: 0.5em 0; }
+summary { cursor: pointer; padding: 0.5em; background: #f6f8fa; font-family: monospace; }
+.change { display: inline-block; min-width: 6em; font-weight: bold; }
+.created .change { color: #22863a; }
+.modified .change, .replaced .change { color: #b08800; }
+.deleted .change { color: #cb2431; }
+pre { margin: 0; padding: 0.5em; overflow-x: auto; }
+pre span { display: block; }
+.file { color: #6a737d; font-weight: bold; }
+.hunk { color: #6f42c1; }
+.removed { background: #ffeef0; color: #cb2431; }
+.added { background: #e6ffed; color: #22863a; }
+</style>
+</head>
+<body>
+<header>
+<h1>Upgrade preview of {{.Release}}</h1>
+<p>{{if .Revision}}From revision {{.Revision}}{{else}}Not installed yet{{end}}</p>
+<p class="counts"><span>{{.Counts.Patched}} modified</span><span>{{.Counts.Created}} created</span><span>{{.Counts.Deleted}} deleted</span><span>{{.Counts.Unchanged}} unchanged</span></p>
+{{- if .Sections}}
+<p><button type="button" onclick="toggleAll(true)">Expand all</button> <button type="button" onclick="toggleAll(false)">Collapse all</button></p>
+{{- end}}
+</header>
+{{- range .Sections}}
+<details class="{{.Change}}" open>
+<summary><span class="change">{{.Change}}</span> {{.Title}}</summary>
+<pre>{{range .Lines}}<span class="{{.Class}}">{{.Text}}</span>{{end}}</pre>
+</details>
+{{- else}}
+<p>No changes.</p>
+{{- end}}
+<script>
+function toggleAll(open) {
+  document.querySelectorAll("details").forEach(function (d) { d.open = open; });
+}
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,78 @@
+package patchdiff
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWritePatchsetHTML(t *testing.T) {
+	cluster := newTestCluster(t, manifest(releaseDocs))
+	c := cluster.actionConfig(t)
+	storeRelease(t, c, manifest(releaseDocs), nil, nil)
+	opts := &Options{Output: "html"}
+	ps, err := createPatchset(context.Background(), c, "r", manifest(releaseDocs), manifest(targetDocs), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range ps.sections {
+		got = append(got, s.Change+" "+s.Title)
+	}
+	if want := "modified ConfigMap api/a\ndeleted ConfigMap api/gone\nmodified ConfigMap web/b\ncreated ConfigMap web/new\nmodified Deployment web/a"; strings.Join(got, "\n") != want {
+		t.Errorf("got sections\n%s\nwant\n%s", strings.Join(got, "\n"), want)
+	}
+
+	out, counts, err := writePatchset(c, "r", ps, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"<h1>Upgrade preview of r</h1>",
+		"From revision 1",
+		"<span>3 modified</span><span>1 created</span><span>1 deleted</span>",
+		`<details class="deleted" open>`,
+		`<span class="removed">-  name: gone</span>`,
+		"<style>",
+		"<script>",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("got report\n%s\nwant it to contain %s", out, want)
+		}
+	}
+	if counts != ps.counts {
+		t.Errorf("got counts %+v, want %+v", counts, ps.counts)
+	}
+
+	opts.OutputDir = t.TempDir()
+	note, _, err := writePatchset(c, "r", ps, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(opts.OutputDir, "r.html")
+	if note != "Wrote report to "+path {
+		t.Errorf("got note %q", note)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != out {
+		t.Errorf("wrote\n%s\nwant\n%s", data, out)
+	}
+}
+
+func TestHTMLReportEscapes(t *testing.T) {
+	out, err := (&htmlReport{Release: "<r>", Sections: []htmlSection{{Change: "modified", Title: "ConfigMap web/a", Lines: []htmlLine{{Class: "added", Text: "+  a: <script>"}}}}}).render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, "<r>") || strings.Contains(out, "a: <script>") {
+		t.Errorf("got unescaped report\n%s", out)
+	}
+	if !strings.Contains(out, "Not installed yet") {
+		t.Errorf("got report\n%s\nwant a release without a revision", out)
+	}
+}
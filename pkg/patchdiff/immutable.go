@@ -0,0 +1,60 @@
+package patchdiff
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// immutableFields are JSON pointers, per kind, of fields the API server
+// refuses to change once an object exists.
+var immutableFields = map[string][]string{
+	"StatefulSet": {"/spec/volumeClaimTemplates"},
+}
+
+// withoutImmutableChanges removes changes to the immutable fields of kind from
+// patch, since they can never apply, and returns the fields it removed.
+func withoutImmutableChanges(kind string, patch []byte) ([]byte, []string, error) {
+	fields := immutableFields[kind]
+	if len(fields) == 0 || isEmptyPatch(patch) {
+		return patch, nil, nil
+	}
+
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal(patch, &doc); err != nil {
+		return nil, nil, err
+	}
+	var removed []string
+	for _, field := range fields {
+		if removeFromPatch(doc, strings.Split(strings.TrimPrefix(field, "/"), "/")) {
+			removed = append(removed, field)
+		}
+	}
+	if len(removed) == 0 {
+		return patch, nil, nil
+	}
+
+	stripped, err := json.Marshal(doc)
+	return stripped, removed, err
+}
+
+// removeFromPatch deletes the field at the JSON pointer segments from a merge
+// patch, along with its ordering directive, and prunes parents left empty. It
+// reports whether the field was present.
+func removeFromPatch(patch map[string]interface{}, segments []string) bool {
+	key := segments[0]
+	if len(segments) > 1 {
+		child, ok := patch[key].(map[string]interface{})
+		if !ok || !removeFromPatch(child, segments[1:]) {
+			return false
+		}
+		if len(child) == 0 {
+			delete(patch, key)
+		}
+		return true
+	}
+
+	_, ok := patch[key]
+	delete(patch, key)
+	delete(patch, "$setElementOrder/"+key)
+	return ok
+}
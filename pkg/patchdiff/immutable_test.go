@@ -0,0 +1,210 @@
+package patchdiff
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+func TestWithoutImmutableChanges(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		kind    string
+		patch   string
+		want    string
+		removed []string
+	}{
+		{
+			name:  "other kinds",
+			kind:  "Deployment",
+			patch: `{"spec":{"volumeClaimTemplates":[{"metadata":{"name":"data"}}]}}`,
+			want:  `{"spec":{"volumeClaimTemplates":[{"metadata":{"name":"data"}}]}}`,
+		},
+		{
+			name:  "no immutable changes",
+			kind:  "StatefulSet",
+			patch: `{"spec":{"replicas":3}}`,
+			want:  `{"spec":{"replicas":3}}`,
+		},
+		{
+			name:    "volumeClaimTemplates and other changes",
+			kind:    "StatefulSet",
+			patch:   `{"spec":{"$setElementOrder/volumeClaimTemplates":[{"metadata":{"name":"data"}}],"replicas":3,"volumeClaimTemplates":[{"metadata":{"name":"data"},"spec":{"resources":{"requests":{"storage":"2Gi"}}}}]}}`,
+			want:    `{"spec":{"replicas":3}}`,
+			removed: []string{"/spec/volumeClaimTemplates"},
+		},
+		{
+			name:    "only volumeClaimTemplates",
+			kind:    "StatefulSet",
+			patch:   `{"spec":{"volumeClaimTemplates":[{"metadata":{"name":"data"},"spec":{"resources":{"requests":{"storage":"2Gi"}}}}]}}`,
+			want:    `{}`,
+			removed: []string{"/spec/volumeClaimTemplates"},
+		},
+		{
+			name:    "volumeClaimTemplates removed",
+			kind:    "StatefulSet",
+			patch:   `{"metadata":{"labels":{"a":"b"}},"spec":{"volumeClaimTemplates":null}}`,
+			want:    `{"metadata":{"labels":{"a":"b"}}}`,
+			removed: []string{"/spec/volumeClaimTemplates"},
+		},
+		{
+			name:  "empty patch",
+			kind:  "StatefulSet",
+			patch: `{}`,
+			want:  `{}`,
+		},
+	} {
+		got, removed, err := withoutImmutableChanges(tt.kind, []byte(tt.patch))
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got patch %s, want %s", tt.name, got, tt.want)
+		}
+		if strings.Join(removed, ",") != strings.Join(tt.removed, ",") {
+			t.Errorf("%s: got removed fields %v, want %v", tt.name, removed, tt.removed)
+		}
+	}
+}
+
+func TestCreatePatchsetImmutableChanges(t *testing.T) {
+	statefulSet := `apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: db
+  namespace: web
+spec:
+  replicas: %s
+  volumeClaimTemplates:
+  - metadata:
+      name: data
+    spec:
+      resources:
+        requests:
+          storage: %s`
+	release := fmt.Sprintf(statefulSet, "1", "1Gi")
+	for _, tt := range []struct {
+		name   string
+		target string
+		force  bool
+		want   string
+	}{
+		{
+			name:   "dropped",
+			target: fmt.Sprintf(statefulSet, "3", "2Gi"),
+			want:   `{"spec":{"replicas":3}}`,
+		},
+		{
+			name:   "only immutable changes",
+			target: fmt.Sprintf(statefulSet, "1", "2Gi"),
+		},
+	} {
+		cluster := newTestCluster(t, release)
+		ps, err := createPatchset(context.Background(), cluster.actionConfig(t), "r", release, tt.target, &Options{Force: tt.force})
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		var got string
+		for _, e := range ps.entries {
+			got += string(e.Patch)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got patch %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCreatePatchsetReplacedEntries(t *testing.T) {
+	statefulSet := `apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: db
+  namespace: web
+spec:
+  replicas: %s
+  volumeClaimTemplates:
+  - metadata:
+      name: data
+    spec:
+      resources:
+        requests:
+          storage: %s`
+	release := fmt.Sprintf(statefulSet, "1", "1Gi")
+	target := fmt.Sprintf(statefulSet, "3", "2Gi")
+	want, err := yaml.YAMLToJSON([]byte(target))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []*Options{
+		{Force: true},
+		{Force: true, PatchType: "json"},
+		{Force: true, Offline: true},
+	} {
+		cluster := newTestCluster(t, release)
+		ps, err := createPatchset(context.Background(), cluster.actionConfig(t), "r", release, target, opts)
+		if err != nil {
+			t.Errorf("%+v: %s", opts, err)
+			continue
+		}
+		// json output has the whole target object in place of a patch that
+		// the server would reject
+		var entries []PatchEntry
+		if err := json.Unmarshal([]byte(ps.output), &entries); err != nil {
+			t.Fatalf("%+v: %s", opts, err)
+		}
+		if len(entries) != 1 || entries[0].PatchType != replacePatchType {
+			t.Errorf("%+v: got entries %s, want one replace entry", opts, ps.output)
+			continue
+		}
+		if !jsonEqual(t, entries[0].Patch, want) {
+			t.Errorf("%+v: got patch %s, want %s", opts, entries[0].Patch, want)
+		}
+	}
+}
+
+func TestCreatePatchsetImmutableWarnings(t *testing.T) {
+	statefulSet := `apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: db
+  namespace: web
+spec:
+  volumeClaimTemplates:
+  - metadata:
+      name: data
+    spec:
+      resources:
+        requests:
+          storage: %s`
+	release := fmt.Sprintf(statefulSet, "1Gi")
+	target := fmt.Sprintf(statefulSet, "2Gi")
+	for _, tt := range []struct {
+		opts *Options
+		want string
+	}{
+		{&Options{}, `{"patches":[],"warnings":[{"code":"ImmutableField","message":"StatefulSet \"db\": changes to /spec/volumeClaimTemplates will not apply (immutable on StatefulSet)"}],`},
+		{&Options{Offline: true}, `{"patches":[],"warnings":[{"code":"ImmutableField","message":"StatefulSet \"db\": changes to /spec/volumeClaimTemplates will not apply (immutable on StatefulSet)"}],`},
+		{&Options{Force: true, Offline: true}, `{"code":"Replaced","message":"StatefulSet \"db\": replaced (deleted and recreated), since /spec/volumeClaimTemplates cannot change in place"}`},
+	} {
+		cluster := newTestCluster(t, release)
+		ps, err := createPatchset(context.Background(), cluster.actionConfig(t), "r", release, target, tt.opts)
+		if err != nil {
+			t.Errorf("%+v: %s", tt.opts, err)
+			continue
+		}
+		got, err := envelopeOutput(ps)
+		if err != nil {
+			t.Errorf("%+v: %s", tt.opts, err)
+			continue
+		}
+		if !strings.Contains(got, tt.want) {
+			t.Errorf("%+v: got %s, want it to contain %s", tt.opts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package patchdiff
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/kube"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// createPatchType marks an entry whose resource is created. Its patch is the
+// whole target object.
+const createPatchType types.PatchType = "create"
+
+// releaseMissing reports whether the named release has never been installed,
+// which is when helm upgrade --install installs it instead.
+func releaseMissing(c *action.Configuration, name string) (bool, error) {
+	if _, err := c.Releases.Last(name); errors.Is(err, driver.ErrReleaseNotFound) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// installNamespace returns the namespace a new release is installed into,
+// the namespace of the kube client as with helm install.
+func installNamespace(c *action.Configuration) string {
+	if kc, ok := c.KubeClient.(*kube.Client); ok {
+		if kc.Namespace != "" {
+			return kc.Namespace
+		}
+		if ns, _, err := kc.Factory.ToRawKubeConfigLoader().Namespace(); err == nil {
+			return ns
+		}
+	}
+	return "default"
+}
+
+// prepareInstall returns an empty original manifest and the manifest of the
+// chart rendered for installing the named release.
+func prepareInstall(ctx context.Context, c *action.Configuration, name string, ch *chart.Chart, vals map[string]interface{}, opts *Options) (string, string, error) {
+	c.Log("release %q does not exist, previewing an install", name)
+	if err := chartutil.ProcessDependencies(ch, vals); err != nil {
+		return "", "", err
+	}
+
+	options := chartutil.ReleaseOptions{
+		Name:      name,
+		Namespace: installNamespace(c),
+		Revision:  1,
+		IsInstall: true,
+	}
+	if err := GetCapabilities(ctx, c); err != nil {
+		return "", "", err
+	}
+	valuesToRender, err := chartutil.ToRenderValues(ch, vals, options, c.Capabilities)
+	if err != nil {
+		return "", "", err
+	}
+	if err := dumpValues(valuesToRender, opts); err != nil {
+		return "", "", err
+	}
+
+	manifestDoc, hooks, err := renderResources(ctx, c, ch, valuesToRender, opts)
+	if err != nil {
+		return "", "", err
+	}
+	crds, err := chartCRDs(ctx, c, ch, opts)
+	if err != nil {
+		return "", "", err
+	}
+	targetManifest := crds + manifestDoc.String()
+	if opts.IncludeTestHooks {
+		targetManifest += testHookManifests(hooks)
+	}
+	if opts.IncludeHooks {
+		return "", targetManifest + hookManifests(hooks), nil
+	}
+	return "", targetManifest, nil
+}
+
+// prepareHelmInstall returns an empty original manifest and the manifest
+// produced by a dry-run of Helm's own install action.
+func prepareHelmInstall(ctx context.Context, c *action.Configuration, name string, ch *chart.Chart, vals map[string]interface{}, opts *Options) (string, string, error) {
+	c.Log("release %q does not exist, previewing an install", name)
+	install := action.NewInstall(c)
+	install.DryRun = true
+	install.ReleaseName = name
+	install.Namespace = installNamespace(c)
+	install.PostRenderer = opts.PostRenderer
+	var installedRelease *release.Release
+	err := withContext(ctx, func() error {
+		var err error
+		installedRelease, err = install.Run(ch, vals)
+		return err
+	})
+	if err != nil {
+		return "", "", errors.Wrap(err, "helm install dry-run failed")
+	}
+
+	crds, err := chartCRDs(ctx, c, ch, opts)
+	if err != nil {
+		return "", "", err
+	}
+	targetManifest := crds + installedRelease.Manifest
+	if opts.IncludeTestHooks {
+		targetManifest += testHookManifests(installedRelease.Hooks)
+	}
+	if opts.IncludeHooks {
+		return "", targetManifest + hookManifests(installedRelease.Hooks), nil
+	}
+	return "", targetManifest, nil
+}
@@ -0,0 +1,203 @@
+package patchdiff
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// jsonPatchOp is an operation of an RFC 6902 JSON Patch.
+type jsonPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+	// from is the value a replace or remove finds at Path.
+	from interface{}
+}
+
+// jsonPatchOps returns the RFC 6902 JSON Patch that turns the JSON document
+// from into to. Callers pass the live object as from and the desired object
+// as to, so the operations apply to the live object. Objects are compared key
+// by key, in sorted order, and lists by their longest common subsequence of
+// items, so an item inserted, removed or moved is a single operation rather
+// than a rewrite of every item after it. With tests, each replace and remove
+// is preceded by a test operation asserting the value it finds, so the patch
+// fails to apply to a from that changed since.
+func jsonPatchOps(from, to []byte, tests bool) ([]byte, error) {
+	var a, b interface{}
+	for _, doc := range []struct {
+		data []byte
+		v    *interface{}
+	}{{from, &a}, {to, &b}} {
+		d := json.NewDecoder(bytes.NewReader(doc.data))
+		// keep numbers as written, since float64 loses large integers
+		d.UseNumber()
+		if err := d.Decode(doc.v); err != nil {
+			return nil, err
+		}
+	}
+
+	ops := []jsonPatchOp{}
+	if err := diffValues("", a, b, &ops); err != nil {
+		return nil, err
+	}
+	if tests {
+		guarded := make([]jsonPatchOp, 0, 2*len(ops))
+		for _, op := range ops {
+			if op.Op == "replace" || op.Op == "remove" {
+				// the operations so far leave from at op.Path, however
+				// earlier operations shifted the items of a list
+				value, err := json.Marshal(op.from)
+				if err != nil {
+					return nil, err
+				}
+				guarded = append(guarded, jsonPatchOp{Op: "test", Path: op.Path, Value: value})
+			}
+			guarded = append(guarded, op)
+		}
+		ops = guarded
+	}
+	return json.Marshal(ops)
+}
+
+func diffValues(path string, a, b interface{}, ops *[]jsonPatchOp) error {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		if b, ok := b.(map[string]interface{}); ok {
+			return diffObjects(path, a, b, ops)
+		}
+	case []interface{}:
+		if b, ok := b.([]interface{}); ok {
+			return diffLists(path, a, b, ops)
+		}
+	}
+	if reflect.DeepEqual(a, b) {
+		return nil
+	}
+	return addOp(ops, "replace", path, a, b)
+}
+
+func diffObjects(path string, a, b map[string]interface{}, ops *[]jsonPatchOp) error {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		av, inA := a[k]
+		bv, inB := b[k]
+		p := path + "/" + escapePointer(k)
+		var err error
+		switch {
+		case !inB:
+			err = addOp(ops, "remove", p, av, nil)
+		case !inA:
+			err = addOp(ops, "add", p, nil, bv)
+		default:
+			err = diffValues(p, av, bv, ops)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func diffLists(path string, a, b []interface{}, ops *[]jsonPatchOp) error {
+	// idx is the index in the list as the operations so far leave it, where
+	// the items before idx are b's and the items from idx on are a's
+	idx := 0
+	i, j := 0, 0
+	for _, m := range commonItems(a, b) {
+		if err := diffGap(path, a[i:m[0]], b[j:m[1]], &idx, ops); err != nil {
+			return err
+		}
+		i, j = m[0]+1, m[1]+1
+		idx++
+	}
+	return diffGap(path, a[i:], b[j:], &idx, ops)
+}
+
+// diffGap turns the items a, found at *idx, into the items b. Items are paired
+// by position and diffed, so a changed item is patched in place, and the rest
+// are added or removed.
+func diffGap(path string, a, b []interface{}, idx *int, ops *[]jsonPatchOp) error {
+	for k := 0; k < len(a) || k < len(b); k++ {
+		p := path + "/" + strconv.Itoa(*idx)
+		var err error
+		switch {
+		case k >= len(b):
+			// the items after the removed one shift down to idx
+			err = addOp(ops, "remove", p, a[k], nil)
+		case k >= len(a):
+			err = addOp(ops, "add", p, nil, b[k])
+			*idx++
+		default:
+			err = diffValues(p, a[k], b[k], ops)
+			*idx++
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commonItems returns the index pairs of a longest common subsequence of equal
+// items of a and b, in order.
+func commonItems(a, b []interface{}) [][2]int {
+	// lengths[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:]
+	lengths := make([][]int, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case reflect.DeepEqual(a[i], b[j]):
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			case lengths[i+1][j] >= lengths[i][j+1]:
+				lengths[i][j] = lengths[i+1][j]
+			default:
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+
+	var pairs [][2]int
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case reflect.DeepEqual(a[i], b[j]):
+			pairs = append(pairs, [2]int{i, j})
+			i++
+			j++
+		case lengths[i+1][j] >= lengths[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return pairs
+}
+
+func addOp(ops *[]jsonPatchOp, op, path string, from, value interface{}) error {
+	o := jsonPatchOp{Op: op, Path: path, from: from}
+	if op != "remove" {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		o.Value = data
+	}
+	*ops = append(*ops, o)
+	return nil
+}
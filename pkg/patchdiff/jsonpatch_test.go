@@ -0,0 +1,179 @@
+package patchdiff
+
+import (
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+)
+
+func TestJSONPatchOps(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		from, to string
+		want     string
+	}{
+		{
+			name: "unchanged",
+			from: `{"a":[1,2],"b":{"c":"d"}}`,
+			to:   `{"a":[1,2],"b":{"c":"d"}}`,
+			want: `[]`,
+		},
+		{
+			name: "keys",
+			from: `{"a":1,"b":2,"c":{"d":3}}`,
+			to:   `{"b":3,"c":{"d":3,"e":4},"f":5}`,
+			want: `[{"op":"remove","path":"/a"},{"op":"replace","path":"/b","value":3},{"op":"add","path":"/c/e","value":4},{"op":"add","path":"/f","value":5}]`,
+		},
+		{
+			name: "large integers",
+			from: `{"a":9007199254740993}`,
+			to:   `{"a":9007199254740995}`,
+			want: `[{"op":"replace","path":"/a","value":9007199254740995}]`,
+		},
+		{
+			name: "escaped keys",
+			from: `{"metadata":{"annotations":{"example.com/a~b":"x"}}}`,
+			to:   `{"metadata":{"annotations":{"example.com/a~b":"y","example.com/new":"z"}}}`,
+			want: `[{"op":"replace","path":"/metadata/annotations/example.com~1a~0b","value":"y"},{"op":"add","path":"/metadata/annotations/example.com~1new","value":"z"}]`,
+		},
+		{
+			name: "insert at the front",
+			from: `{"args":["--a","--b","--c"]}`,
+			to:   `{"args":["--x","--a","--b","--c"]}`,
+			want: `[{"op":"add","path":"/args/0","value":"--x"}]`,
+		},
+		{
+			name: "insert in the middle",
+			from: `{"env":[{"name":"A"},{"name":"C"}]}`,
+			to:   `{"env":[{"name":"A"},{"name":"B"},{"name":"C"}]}`,
+			want: `[{"op":"add","path":"/env/1","value":{"name":"B"}}]`,
+		},
+		{
+			name: "append",
+			from: `{"args":["--a"]}`,
+			to:   `{"args":["--a","--b","--c"]}`,
+			want: `[{"op":"add","path":"/args/1","value":"--b"},{"op":"add","path":"/args/2","value":"--c"}]`,
+		},
+		{
+			name: "remove from the front",
+			from: `{"env":[{"name":"A"},{"name":"B"},{"name":"C"}]}`,
+			to:   `{"env":[{"name":"B"},{"name":"C"}]}`,
+			want: `[{"op":"remove","path":"/env/0"}]`,
+		},
+		{
+			name: "remove several",
+			from: `{"args":["--a","--b","--c","--d","--e"]}`,
+			to:   `{"args":["--a","--c","--e"]}`,
+			want: `[{"op":"remove","path":"/args/1"},{"op":"remove","path":"/args/2"}]`,
+		},
+		{
+			name: "move",
+			from: `{"args":["--a","--b","--c"]}`,
+			to:   `{"args":["--b","--c","--a"]}`,
+			want: `[{"op":"remove","path":"/args/0"},{"op":"add","path":"/args/2","value":"--a"}]`,
+		},
+		{
+			name: "change an item in place",
+			from: `{"containers":[{"name":"app","image":"app:1"},{"name":"sidecar","image":"sidecar:1"}]}`,
+			to:   `{"containers":[{"name":"app","image":"app:2"},{"name":"sidecar","image":"sidecar:1"}]}`,
+			want: `[{"op":"replace","path":"/containers/0/image","value":"app:2"}]`,
+		},
+		{
+			name: "change and insert",
+			from: `{"env":[{"name":"A","value":"1"},{"name":"C","value":"3"}]}`,
+			to:   `{"env":[{"name":"A","value":"2"},{"name":"B","value":"2"},{"name":"C","value":"3"}]}`,
+			want: `[{"op":"replace","path":"/env/0/value","value":"2"},{"op":"add","path":"/env/1","value":{"name":"B","value":"2"}}]`,
+		},
+		{
+			name: "empty to items",
+			from: `{"args":[]}`,
+			to:   `{"args":["--a","--b"]}`,
+			want: `[{"op":"add","path":"/args/0","value":"--a"},{"op":"add","path":"/args/1","value":"--b"}]`,
+		},
+		{
+			name: "items to empty",
+			from: `{"args":["--a","--b"]}`,
+			to:   `{"args":[]}`,
+			want: `[{"op":"remove","path":"/args/0"},{"op":"remove","path":"/args/0"}]`,
+		},
+		{
+			name: "type change",
+			from: `{"a":[1]}`,
+			to:   `{"a":{"b":1}}`,
+			want: `[{"op":"replace","path":"/a","value":{"b":1}}]`,
+		},
+	} {
+		ops, err := jsonPatchOps([]byte(tt.from), []byte(tt.to), false)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if string(ops) != tt.want {
+			t.Errorf("%s: got operations\n%s\nwant\n%s", tt.name, ops, tt.want)
+		}
+
+		// whatever the operations, they must turn from into to
+		patch, err := jsonpatch.DecodePatch(ops)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		applied, err := patch.Apply([]byte(tt.from))
+		if err != nil {
+			t.Errorf("%s: applying %s: %s", tt.name, ops, err)
+			continue
+		}
+		if !jsonpatch.Equal(applied, []byte(tt.to)) {
+			t.Errorf("%s: applying %s gives %s, want %s", tt.name, ops, applied, tt.to)
+		}
+	}
+}
+
+func TestJSONPatchTestOps(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		from, to string
+		drifted  string
+		want     string
+	}{
+		{
+			name:    "replace and remove",
+			from:    `{"a":1,"b":{"c":"d"},"e":2}`,
+			to:      `{"a":2,"b":{},"f":3}`,
+			drifted: `{"a":5,"b":{"c":"d"},"e":2}`,
+			want:    `[{"op":"test","path":"/a","value":1},{"op":"replace","path":"/a","value":2},{"op":"test","path":"/b/c","value":"d"},{"op":"remove","path":"/b/c"},{"op":"test","path":"/e","value":2},{"op":"remove","path":"/e"},{"op":"add","path":"/f","value":3}]`,
+		},
+		{
+			name:    "shifted list items",
+			from:    `{"args":["--a","--b","--c"]}`,
+			to:      `{"args":["--c"]}`,
+			drifted: `{"args":["--b","--a","--c"]}`,
+			want:    `[{"op":"test","path":"/args/0","value":"--a"},{"op":"remove","path":"/args/0"},{"op":"test","path":"/args/0","value":"--b"},{"op":"remove","path":"/args/0"}]`,
+		},
+	} {
+		ops, err := jsonPatchOps([]byte(tt.from), []byte(tt.to), true)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if string(ops) != tt.want {
+			t.Errorf("%s: got operations\n%s\nwant\n%s", tt.name, ops, tt.want)
+		}
+
+		patch, err := jsonpatch.DecodePatch(ops)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		applied, err := patch.Apply([]byte(tt.from))
+		if err != nil {
+			t.Errorf("%s: applying %s: %s", tt.name, ops, err)
+		} else if !jsonpatch.Equal(applied, []byte(tt.to)) {
+			t.Errorf("%s: applying %s gives %s, want %s", tt.name, ops, applied, tt.to)
+		}
+		// the tests reject an object that drifted since the preview
+		if _, err := patch.Apply([]byte(tt.drifted)); err == nil {
+			t.Errorf("%s: %s applies to the drifted %s", tt.name, ops, tt.drifted)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package patchdiff
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+)
+
+// sortLists sorts every list of objects in the JSON document data so that
+// lists differing only in order compare equal. Lists with a merge key, such
+// as env vars, are sorted by it; other lists of objects, such as tolerations,
+// by their content. Lists of primitives are left alone since their order is
+// usually meaningful, as with command arguments, and so are lists in
+// orderedLists.
+func sortLists(data []byte, schema strategicpatch.LookupPatchMeta) ([]byte, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return data, nil
+	}
+	sortListsIn(doc, schema)
+	return json.Marshal(doc)
+}
+
+// orderedLists are lists of objects whose order matters, so that reordering
+// them is a change.
+var orderedLists = map[string]bool{
+	// init containers run one after the other
+	"initContainers": true,
+}
+
+func sortListsIn(obj map[string]interface{}, schema strategicpatch.LookupPatchMeta) {
+	for key, value := range obj {
+		if orderedLists[key] {
+			continue
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			sub, _, err := schema.LookupPatchMetadataForStruct(key)
+			if err != nil {
+				continue
+			}
+			sortListsIn(v, sub)
+		case []interface{}:
+			sub, patchMeta, err := schema.LookupPatchMetadataForSlice(key)
+			if err != nil {
+				continue
+			}
+			sortKeys := make([]string, len(v))
+			objects := true
+			for i, item := range v {
+				m, ok := item.(map[string]interface{})
+				if !ok {
+					objects = false
+					break
+				}
+				sortListsIn(m, sub)
+				sortKeys[i] = listSortKey(m, patchMeta.GetPatchMergeKey())
+			}
+			if objects {
+				sort.Sort(byListSortKey{items: v, keys: sortKeys})
+			}
+		}
+	}
+}
+
+// listSortKey orders list items by their merge key, falling back to their
+// content when the list has none or two items share it.
+func listSortKey(item map[string]interface{}, mergeKey string) string {
+	content, _ := json.Marshal(item)
+	if mergeKey == "" {
+		return string(content)
+	}
+	return fmt.Sprintf("%v\x00%s", item[mergeKey], content)
+}
+
+type byListSortKey struct {
+	items []interface{}
+	keys  []string
+}
+
+func (s byListSortKey) Len() int           { return len(s.items) }
+func (s byListSortKey) Less(i, j int) bool { return s.keys[i] < s.keys[j] }
+func (s byListSortKey) Swap(i, j int) {
+	s.items[i], s.items[j] = s.items[j], s.items[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
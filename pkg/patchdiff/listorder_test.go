@@ -0,0 +1,124 @@
+package patchdiff
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+)
+
+func TestSortLists(t *testing.T) {
+	schema, err := strategicpatch.NewPatchMetaFromStruct(&appsv1.Deployment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		data string
+		want string
+	}{
+		{
+			name: "env by name",
+			data: `{"spec":{"template":{"spec":{"containers":[{"name":"app","env":[{"name":"B","value":"1"},{"name":"A","value":"2"}]}]}}}}`,
+			want: `{"spec":{"template":{"spec":{"containers":[{"env":[{"name":"A","value":"2"},{"name":"B","value":"1"}],"name":"app"}]}}}}`,
+		},
+		{
+			name: "containers by name, and their lists",
+			data: `{"spec":{"template":{"spec":{"containers":[{"name":"sidecar","ports":[{"containerPort":9090},{"containerPort":8080}]},{"name":"app","env":[{"name":"Z"},{"name":"Y"}]}]}}}}`,
+			want: `{"spec":{"template":{"spec":{"containers":[{"env":[{"name":"Y"},{"name":"Z"}],"name":"app"},{"name":"sidecar","ports":[{"containerPort":8080},{"containerPort":9090}]}]}}}}`,
+		},
+		{
+			name: "tolerations by content",
+			data: `{"spec":{"template":{"spec":{"tolerations":[{"key":"b","operator":"Exists"},{"effect":"NoSchedule","key":"a"}]}}}}`,
+			want: `{"spec":{"template":{"spec":{"tolerations":[{"effect":"NoSchedule","key":"a"},{"key":"b","operator":"Exists"}]}}}}`,
+		},
+		{
+			name: "args keep their order",
+			data: `{"spec":{"template":{"spec":{"containers":[{"name":"app","args":["--z","--a"],"command":["sh","-c"]}]}}}}`,
+			want: `{"spec":{"template":{"spec":{"containers":[{"args":["--z","--a"],"command":["sh","-c"],"name":"app"}]}}}}`,
+		},
+		{
+			name: "shared merge keys by content",
+			data: `{"spec":{"template":{"spec":{"containers":[{"name":"app","image":"b"},{"name":"app","image":"a"}]}}}}`,
+			want: `{"spec":{"template":{"spec":{"containers":[{"image":"a","name":"app"},{"image":"b","name":"app"}]}}}}`,
+		},
+		{
+			name: "unknown fields",
+			data: `{"spec":{"extra":[{"b":1},{"a":2}]},"status":{"conditions":[{"type":"B"},{"type":"A"}]}}`,
+			want: `{"spec":{"extra":[{"b":1},{"a":2}]},"status":{"conditions":[{"type":"A"},{"type":"B"}]}}`,
+		},
+		{
+			name: "init containers keep their order",
+			data: `{"spec":{"template":{"spec":{"initContainers":[{"name":"migrate"},{"name":"fetch"}]}}}}`,
+			want: `{"spec":{"template":{"spec":{"initContainers":[{"name":"migrate"},{"name":"fetch"}]}}}}`,
+		},
+		{
+			name: "null",
+			data: `null`,
+			want: `null`,
+		},
+	} {
+		got, err := sortLists([]byte(tt.data), schema)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCreatePatchsetIgnoreListOrder(t *testing.T) {
+	deployment := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: a
+  namespace: web
+spec:
+  template:
+    spec:
+      containers:
+      - name: app
+        args: [%s]
+        env: [%s]
+      tolerations: [%s]`
+	release := fmt.Sprintf(deployment, "--a, --b", "{name: A}, {name: B}", "{key: a}, {key: b}")
+	for _, tt := range []struct {
+		name   string
+		target string
+		want   string
+	}{
+		{
+			name:   "reordered env and tolerations",
+			target: fmt.Sprintf(deployment, "--a, --b", "{name: B}, {name: A}", "{key: b}, {key: a}"),
+		},
+		{
+			name:   "reordered args",
+			target: fmt.Sprintf(deployment, "--b, --a", "{name: A}, {name: B}", "{key: a}, {key: b}"),
+			want:   `{"spec":{"template":{"spec":{"$setElementOrder/containers":[{"name":"app"}],"containers":[{"args":["--b","--a"],"name":"app"}]}}}}`,
+		},
+		{
+			name:   "reordered env with a changed value",
+			target: fmt.Sprintf(deployment, "--a, --b", "{name: B}, {name: A, value: x}", "{key: a}, {key: b}"),
+			// the patch keeps the target order, as helm would send it
+			want: `{"spec":{"template":{"spec":{"$setElementOrder/containers":[{"name":"app"}],"containers":[{"$setElementOrder/env":[{"name":"B"},{"name":"A"}],"env":[{"name":"A","value":"x"}],"name":"app"}]}}}}`,
+		},
+	} {
+		cluster := newTestCluster(t, release)
+		ps, err := createPatchset(context.Background(), cluster.actionConfig(t), "r", release, tt.target, &Options{IgnoreListOrder: true})
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		var got string
+		for _, e := range ps.entries {
+			got += string(e.Patch)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got patch %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
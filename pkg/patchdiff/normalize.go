@@ -0,0 +1,214 @@
+package patchdiff
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"sigs.k8s.io/yaml"
+)
+
+// normalizeConfigSchema is the JSON schema a --normalize-config file is
+// validated against.
+const normalizeConfigSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "title": "patchdiff normalize config",
+  "type": "object",
+  "additionalProperties": false,
+  "definitions": {
+    "rules": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "ignorePaths": {
+          "type": "array",
+          "items": {"type": "string", "pattern": "^/"}
+        },
+        "ignoreAnnotationPrefixes": {
+          "type": "array",
+          "items": {"type": "string", "minLength": 1}
+        },
+        "ignoreLabelPrefixes": {
+          "type": "array",
+          "items": {"type": "string", "minLength": 1}
+        }
+      }
+    }
+  },
+  "properties": {
+    "ignorePaths": {"$ref": "#/definitions/rules/properties/ignorePaths"},
+    "ignoreAnnotationPrefixes": {"$ref": "#/definitions/rules/properties/ignoreAnnotationPrefixes"},
+    "ignoreLabelPrefixes": {"$ref": "#/definitions/rules/properties/ignoreLabelPrefixes"},
+    "kinds": {
+      "type": "object",
+      "additionalProperties": {"$ref": "#/definitions/rules"}
+    }
+  }
+}`
+
+// normalizeRules describe fields that are removed from every side of the
+// diff before patches are computed.
+type normalizeRules struct {
+	// IgnorePaths are JSON pointers to remove. A list along the path applies
+	// the rest of the path to each of its items.
+	IgnorePaths []string `json:"ignorePaths,omitempty"`
+	// IgnoreAnnotationPrefixes and IgnoreLabelPrefixes remove matching keys
+	// from the object's metadata and from its pod template's metadata.
+	IgnoreAnnotationPrefixes []string `json:"ignoreAnnotationPrefixes,omitempty"`
+	IgnoreLabelPrefixes      []string `json:"ignoreLabelPrefixes,omitempty"`
+}
+
+// NormalizeConfig holds rules for every kind, plus rules for specific kinds.
+type NormalizeConfig struct {
+	normalizeRules
+	Kinds map[string]normalizeRules `json:"kinds,omitempty"`
+}
+
+// LoadNormalizeConfig reads and validates a normalize config file.
+func LoadNormalizeConfig(path string) (*NormalizeConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse normalize config %s", path)
+	}
+	if err := chartutil.ValidateAgainstSingleSchema(raw, []byte(normalizeConfigSchema)); err != nil {
+		return nil, errors.Wrapf(err, "invalid normalize config %s", path)
+	}
+
+	config := &NormalizeConfig{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse normalize config %s", path)
+	}
+	return config, nil
+}
+
+// normalize removes the fields matched by the config's rules for kind from the
+// JSON document data.
+func (c *NormalizeConfig) normalize(kind string, data []byte) ([]byte, error) {
+	if c == nil {
+		return data, nil
+	}
+
+	var obj interface{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return data, nil
+	}
+
+	for _, rules := range []normalizeRules{c.normalizeRules, c.Kinds[kind]} {
+		for _, p := range rules.IgnorePaths {
+			removePath(obj, strings.Split(strings.TrimPrefix(p, "/"), "/"))
+		}
+		for _, metadata := range [][]string{{"metadata"}, {"spec", "template", "metadata"}} {
+			removePrefixed(obj, append(metadata, "annotations"), rules.IgnoreAnnotationPrefixes)
+			removePrefixed(obj, append(metadata, "labels"), rules.IgnoreLabelPrefixes)
+		}
+	}
+	return json.Marshal(obj)
+}
+
+// removePath deletes the field at the JSON pointer segments from node.
+func removePath(node interface{}, segments []string) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		key := strings.NewReplacer("~1", "/", "~0", "~").Replace(segments[0])
+		if len(segments) == 1 {
+			delete(n, key)
+			return
+		}
+		if child, ok := n[key]; ok {
+			removePath(child, segments[1:])
+		}
+	case []interface{}:
+		for _, item := range n {
+			removePath(item, segments)
+		}
+	}
+}
+
+// removePrefixed deletes the keys starting with any of prefixes from the map
+// at path.
+func removePrefixed(obj interface{}, path []string, prefixes []string) {
+	if len(prefixes) == 0 {
+		return
+	}
+	m, ok := obj.(map[string]interface{})
+	if !ok {
+		return
+	}
+	target, ok := lookup(m, path...).(map[string]interface{})
+	if !ok {
+		return
+	}
+	for k := range target {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(k, prefix) {
+				delete(target, k)
+				break
+			}
+		}
+	}
+}
+
+// serverFields are the fields the API server maintains on every object, which
+// the chart cannot control.
+var serverFields = [][]string{
+	{"metadata", "managedFields"},
+	{"metadata", "resourceVersion"},
+	{"metadata", "uid"},
+	{"metadata", "creationTimestamp"},
+	{"status"},
+}
+
+// withoutServerFields removes the serverFields from the JSON document data.
+func withoutServerFields(data []byte) ([]byte, error) {
+	var obj map[string]interface{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return data, nil
+	}
+	for _, path := range serverFields {
+		removePath(obj, path)
+	}
+	return json.Marshal(obj)
+}
+
+// specFields are the top-level fields kept by --spec-only, per kind.
+var specFields = map[string][]string{
+	"ConfigMap": {"data", "binaryData"},
+	"Secret":    {"data", "stringData", "type"},
+}
+
+// onlySpec removes every top-level field of the JSON document data except its
+// spec, or for kinds without one their data, so that metadata and status
+// changes are ignored.
+func onlySpec(kind string, data []byte) ([]byte, error) {
+	var obj map[string]interface{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return data, nil
+	}
+
+	keep := map[string]bool{"apiVersion": true, "kind": true, "spec": true}
+	for _, field := range specFields[kind] {
+		keep[field] = true
+	}
+	for k := range obj {
+		if !keep[k] {
+			delete(obj, k)
+		}
+	}
+	return json.Marshal(obj)
+}
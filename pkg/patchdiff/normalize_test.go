@@ -0,0 +1,212 @@
+package patchdiff
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadNormalizeConfig(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{
+			name: "valid",
+			config: `ignorePaths: [/spec/replicas]
+ignoreAnnotationPrefixes: [sidecar.istio.io/]
+ignoreLabelPrefixes: [cost-center]
+kinds:
+  Deployment:
+    ignorePaths: [/spec/template/spec/containers/resources]
+`,
+		},
+		{name: "empty", config: ``},
+		{name: "unknown field", config: "ignorepaths: [/spec]\n", wantErr: "ignorepaths"},
+		{name: "unknown field of a kind", config: "kinds:\n  Deployment:\n    paths: [/spec]\n", wantErr: "paths"},
+		{name: "relative path", config: "ignorePaths: [spec/replicas]\n", wantErr: "ignorePaths.0"},
+		{name: "relative path of a kind", config: "kinds:\n  Service:\n    ignorePaths: [spec]\n", wantErr: "ignorePaths.0"},
+		{name: "empty prefix", config: "ignoreLabelPrefixes: ['']\n", wantErr: "ignoreLabelPrefixes.0"},
+		{name: "not a list", config: "ignorePaths: /spec\n", wantErr: "ignorePaths"},
+		{name: "not YAML", config: "ignorePaths: [\n", wantErr: "unable to parse normalize config"},
+	} {
+		path := filepath.Join(dir, "normalize.yaml")
+		if err := ioutil.WriteFile(path, []byte(tt.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadNormalizeConfig(path)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: %s", tt.name, err)
+		case tt.wantErr != "" && err == nil:
+			t.Errorf("%s: expected the config to be rejected", tt.name)
+		case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+			t.Errorf("%s: error %q does not mention %q", tt.name, err, tt.wantErr)
+		}
+	}
+
+	config, err := LoadNormalizeConfig(filepath.Join(dir, "missing.yaml"))
+	if err == nil {
+		t.Errorf("expected a missing config to fail, got %+v", config)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	config := &NormalizeConfig{
+		normalizeRules: normalizeRules{
+			IgnorePaths:              []string{"/spec/template/spec/containers/env", "/metadata/annotations/example.com~1checksum"},
+			IgnoreAnnotationPrefixes: []string{"sidecar.istio.io/"},
+		},
+		Kinds: map[string]normalizeRules{
+			"Deployment": {
+				IgnorePaths:         []string{"/spec/replicas", "/spec/template/spec/containers/ports/containerPort"},
+				IgnoreLabelPrefixes: []string{"cost"},
+			},
+		},
+	}
+	for _, tt := range []struct {
+		name   string
+		config *NormalizeConfig
+		kind   string
+		data   string
+		want   string
+	}{
+		{
+			name:   "through lists",
+			config: config,
+			kind:   "Deployment",
+			data:   `{"spec":{"replicas":3,"template":{"spec":{"containers":[{"name":"a","env":[{"name":"X"}],"ports":[{"containerPort":80,"name":"http"},{"containerPort":81}]},{"name":"b","env":[]}]}}}}`,
+			want:   `{"spec":{"template":{"spec":{"containers":[{"name":"a","ports":[{"name":"http"},{}]},{"name":"b"}]}}}}`,
+		},
+		{
+			name:   "escaped keys and prefixes",
+			config: config,
+			kind:   "Deployment",
+			data:   `{"metadata":{"annotations":{"example.com/checksum":"1","example.com/other":"2","sidecar.istio.io/inject":"true"},"labels":{"app":"a","cost-center":"x"}},"spec":{"template":{"metadata":{"annotations":{"sidecar.istio.io/status":"{}"},"labels":{"cost":"y","app":"a"}}}}}`,
+			want:   `{"metadata":{"annotations":{"example.com/other":"2"},"labels":{"app":"a"}},"spec":{"template":{"metadata":{"annotations":{},"labels":{"app":"a"}}}}}`,
+		},
+		{
+			name:   "rules of other kinds",
+			config: config,
+			kind:   "StatefulSet",
+			data:   `{"metadata":{"labels":{"cost-center":"x"}},"spec":{"replicas":3,"template":{"spec":{"containers":[{"env":[],"ports":[{"containerPort":80}]}]}}}}`,
+			want:   `{"metadata":{"labels":{"cost-center":"x"}},"spec":{"replicas":3,"template":{"spec":{"containers":[{"ports":[{"containerPort":80}]}]}}}}`,
+		},
+		{
+			name:   "missing paths",
+			config: config,
+			kind:   "Deployment",
+			data:   `{"spec":{"template":"not an object"},"metadata":{"annotations":null}}`,
+			want:   `{"metadata":{"annotations":null},"spec":{"template":"not an object"}}`,
+		},
+		{
+			name: "no config",
+			kind: "Deployment",
+			data: `{"spec":{"replicas":3}}`,
+			want: `{"spec":{"replicas":3}}`,
+		},
+		{
+			name:   "null",
+			config: config,
+			kind:   "Deployment",
+			data:   `null`,
+			want:   `null`,
+		},
+	} {
+		got, err := tt.config.normalize(tt.kind, []byte(tt.data))
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOnlySpec(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		kind string
+		data string
+		want string
+	}{
+		{
+			name: "spec",
+			kind: "Deployment",
+			data: `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"labels":{"a":"b"}},"spec":{"replicas":1},"status":{"replicas":1}}`,
+			want: `{"apiVersion":"apps/v1","kind":"Deployment","spec":{"replicas":1}}`,
+		},
+		{
+			name: "ConfigMap data",
+			kind: "ConfigMap",
+			data: `{"apiVersion":"v1","binaryData":{"b":"AA=="},"data":{"a":"1"},"kind":"ConfigMap","metadata":{"name":"c"}}`,
+			want: `{"apiVersion":"v1","binaryData":{"b":"AA=="},"data":{"a":"1"},"kind":"ConfigMap"}`,
+		},
+		{
+			name: "Secret data and type",
+			kind: "Secret",
+			data: `{"apiVersion":"v1","data":{"a":"MQ=="},"kind":"Secret","metadata":{"annotations":{"x":"y"}},"stringData":{"b":"2"},"type":"Opaque"}`,
+			want: `{"apiVersion":"v1","data":{"a":"MQ=="},"kind":"Secret","stringData":{"b":"2"},"type":"Opaque"}`,
+		},
+		{
+			name: "data of other kinds",
+			kind: "Deployment",
+			data: `{"data":{"a":"1"},"spec":{}}`,
+			want: `{"spec":{}}`,
+		},
+		{
+			name: "null",
+			kind: "Deployment",
+			data: `null`,
+			want: `null`,
+		},
+	} {
+		got, err := onlySpec(tt.kind, []byte(tt.data))
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCreatePatchsetSpecOnly(t *testing.T) {
+	release := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: a
+  namespace: web
+  labels:
+    version: "1"
+spec:
+  replicas: 1`
+	for _, tt := range []struct {
+		name   string
+		target string
+		want   string
+	}{
+		{name: "metadata", target: strings.Replace(release, `version: "1"`, `version: "2"`, 1)},
+		{name: "spec", target: strings.Replace(strings.Replace(release, `version: "1"`, `version: "2"`, 1), "replicas: 1", "replicas: 2", 1), want: `{"spec":{"replicas":2}}`},
+	} {
+		cluster := newTestCluster(t, release)
+		ps, err := createPatchset(context.Background(), cluster.actionConfig(t), "r", release, tt.target, &Options{SpecOnly: true})
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		var got string
+		for _, e := range ps.entries {
+			got += string(e.Patch)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got patch %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
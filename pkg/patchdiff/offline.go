@@ -0,0 +1,268 @@
+package patchdiff
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/kube"
+	"helm.sh/helm/v3/pkg/release"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// createOfflinePatchset diffs the objects of two manifests without a cluster.
+// There is no live state to take part in a three-way merge, so each patch is a
+// two-way JSON merge patch from the object in the original manifest to the
+// object in the target manifest, and changes made to the live object since
+// the last upgrade are not reflected. The patches are checked and transformed
+// as createPatchset checks and transforms those of live objects.
+func createOfflinePatchset(c *action.Configuration, originalManifest, targetManifest string, opts *Options) (*patchset, error) {
+	oldObjs, oldOrder, err := manifestObjects(originalManifest)
+	if err != nil {
+		return nil, err
+	}
+	newObjs, order, err := manifestObjects(targetManifest)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range order {
+		if newObjs[key.String()], err = annotateData(newObjs[key.String()], opts.PatchAnnotations); err != nil {
+			return nil, errors.Wrapf(err, "unable to add patch annotations to %s", key)
+		}
+	}
+
+	entries := []PatchEntry{}
+	violations := []string{}
+	var counts Counts
+	kinds := kindCounts{}
+	patchTypes := map[string]int{}
+	warnings := []Warning{}
+	for _, key := range order {
+		kind := key.gvk.Kind
+		if !kindAllowed(opts.PatchOnlyKinds, kind) || !selected(opts.Include, opts.Exclude, kind, key.name) {
+			continue
+		}
+		oldData, ok := oldObjs[key.String()]
+		if !ok {
+			counts.Created++
+			kinds.of(kind).Created++
+			if opts.Install {
+				entry := offlinePatchEntry(key, createPatchType, newObjs[key.String()])
+				entry.Hook = dataAnnotation(newObjs[key.String()], release.HookAnnotation)
+				if opts.WithHashes {
+					if err := entry.addHashes(newObjs[key.String()]); err != nil {
+						return nil, errors.Wrapf(err, "unable to hash the patch of %s", key)
+					}
+				}
+				entries = append(entries, entry)
+			}
+			continue
+		}
+		patch, err := offlinePatch(c, key, oldData, newObjs[key.String()], opts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to diff %s", key)
+		}
+		if opts.ExplainPatchType {
+			patchTypes[patchTypeName(types.MergePatchType, "offline")]++
+		}
+
+		stripped, immutable, err := withoutImmutableChanges(kind, patch)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to analyze patch for %s", key)
+		}
+		replaced := opts.Force && len(immutable) > 0
+		if replaced {
+			c.Log("%s %q: replaced (deleted and recreated), since %s cannot change in place", kind, key.name, strings.Join(immutable, ", "))
+			warnings = append(warnings, replacedWarning(kind, key.name, immutable))
+		} else {
+			patch = stripped
+			for _, field := range immutable {
+				c.Log("%s %q: changes to %s will not apply (immutable on %s)", kind, key.name, field, kind)
+			}
+			warnings = append(warnings, immutableWarnings(kind, key.name, immutable)...)
+		}
+		if keptData(newObjs[key.String()]) && (!isEmptyPatch(patch) || len(immutable) > 0) {
+			c.Log("%s %q: still updated, although %s=%s keeps it on uninstall", kind, key.name, kube.ResourcePolicyAnno, kube.KeepPolicy)
+		}
+
+		problems, err := protectedChanges(kind, key.name, patch, opts.FailOnChangeTo)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to analyze patch for %s", key)
+		}
+		violations = append(violations, problems...)
+
+		if isEmptyPatch(patch) {
+			counts.Unchanged++
+			kinds.of(kind).Unchanged++
+			continue
+		}
+		counts.Patched++
+		kinds.of(kind).Patched++
+		entry := offlinePatchEntry(key, types.MergePatchType, patch)
+		if replaced {
+			entry = offlinePatchEntry(key, replacePatchType, newObjs[key.String()])
+		} else if opts.PatchType == "json" {
+			// the operations turn the original object into what the
+			// patch makes of it
+			desired, err := jsonpatch.MergePatch(oldData, patch)
+			if err != nil {
+				return nil, errors.Wrapf(err, "unable to apply patch to %s", key)
+			}
+			ops, err := jsonPatchOps(oldData, desired, false)
+			if err != nil {
+				return nil, errors.Wrapf(err, "unable to create JSON patch for %s", key)
+			}
+			entry = offlinePatchEntry(key, types.JSONPatchType, ops)
+		}
+		entry.Hook = dataAnnotation(newObjs[key.String()], release.HookAnnotation)
+		if opts.WithHashes {
+			if err := entry.addHashes(newObjs[key.String()]); err != nil {
+				return nil, errors.Wrapf(err, "unable to hash the patch of %s", key)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	for _, key := range oldOrder {
+		if _, ok := newObjs[key.String()]; ok || !kindAllowed(opts.PatchOnlyKinds, key.gvk.Kind) || !selected(opts.Include, opts.Exclude, key.gvk.Kind, key.name) {
+			continue
+		}
+		if dataAnnotation(oldObjs[key.String()], release.HookAnnotation) != "" {
+			continue
+		}
+		if keptData(oldObjs[key.String()]) {
+			c.Log("%s %q: not deleted, since %s=%s keeps it", key.gvk.Kind, key.name, kube.ResourcePolicyAnno, kube.KeepPolicy)
+			continue
+		}
+		counts.Deleted++
+		kinds.of(key.gvk.Kind).Deleted++
+		entries = append(entries, offlinePatchEntry(key, deletePatchType, nil))
+	}
+
+	if opts.ExplainPatchType {
+		c.Log("patch types: %s", describePatchTypes(patchTypes))
+	}
+
+	sortEntries(entries)
+	output, err := formatEntries(entries, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.CountOnly {
+		output = strconv.Itoa(counts.Created + counts.Patched + counts.Deleted)
+	}
+	ps := &patchset{output: output, entries: entries, counts: counts, kinds: kinds, warnings: warnings}
+	if opts.ExplainPatchType {
+		ps.patchTypes = patchTypes
+	}
+	if len(violations) > 0 {
+		return ps, errors.Errorf("patches change protected paths:\n  %s", strings.Join(violations, "\n  "))
+	}
+	return ps, nil
+}
+
+// offlinePatch returns the JSON merge patch from oldData to newData, after
+// the normalization selected by opts. Lists of built-in kinds are sorted
+// first with IgnoreListOrder, and the patch is verified with VerifyPatches.
+func offlinePatch(c *action.Configuration, key objectKey, oldData, newData []byte, opts *Options) ([]byte, error) {
+	var err error
+	if !opts.ShowManagedFields {
+		for _, data := range []*[]byte{&oldData, &newData} {
+			if *data, err = withoutServerFields(*data); err != nil {
+				return nil, errors.Wrap(err, "removing server-managed fields")
+			}
+		}
+	}
+	if opts.Normalizer != nil {
+		if oldData, err = opts.Normalizer.normalize(key.gvk.Kind, oldData); err != nil {
+			return nil, errors.Wrap(err, "normalizing current configuration")
+		}
+		if newData, err = opts.Normalizer.normalize(key.gvk.Kind, newData); err != nil {
+			return nil, errors.Wrap(err, "normalizing target configuration")
+		}
+	}
+	if opts.SpecOnly {
+		for _, data := range []*[]byte{&oldData, &newData} {
+			if *data, err = onlySpec(key.gvk.Kind, *data); err != nil {
+				return nil, errors.Wrap(err, "removing fields outside spec")
+			}
+		}
+	}
+	if obj, err := scheme.Scheme.New(key.gvk); err == nil && opts.IgnoreListOrder {
+		// as online, only kinds with a patch strategy have merge keys
+		patchMeta, err := strategicpatch.NewPatchMetaFromStruct(obj)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to create patch metadata from object")
+		}
+		sorted := [][]byte{oldData, newData}
+		for i := range sorted {
+			if sorted[i], err = sortLists(sorted[i], patchMeta); err != nil {
+				return nil, errors.Wrap(err, "sorting lists")
+			}
+		}
+		// the sorted sides only tell whether there is a change, the patch
+		// keeps the real order
+		patch, err := jsonpatch.CreateMergePatch(sorted[0], sorted[1])
+		if err != nil || isEmptyPatch(patch) {
+			return patch, err
+		}
+	}
+
+	patch, err := jsonpatch.CreateMergePatch(oldData, newData)
+	if err == nil && opts.VerifyPatches {
+		warnUnverifiedPatch(c.Log, key.gvk.Kind, key.name, oldData, patch, newData, types.MergePatchType, nil)
+	}
+	return patch, err
+}
+
+// offlinePatchEntry is newPatchEntry for an object identified by its
+// manifest key rather than built against the cluster.
+func offlinePatchEntry(key objectKey, patchType types.PatchType, patch []byte) PatchEntry {
+	return PatchEntry{
+		APIVersion: key.gvk.GroupVersion().String(),
+		Kind:       key.gvk.Kind,
+		Namespace:  key.namespace,
+		Name:       key.name,
+		PatchType:  patchType,
+		Patch:      json.RawMessage(patch),
+	}
+}
+
+// annotateData is addAnnotations for an object in JSON form.
+func annotateData(data []byte, annotations map[string]string) ([]byte, error) {
+	if len(annotations) == 0 {
+		return data, nil
+	}
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON(data); err != nil {
+		return nil, err
+	}
+	if err := addAnnotations(obj, annotations); err != nil {
+		return nil, err
+	}
+	return obj.MarshalJSON()
+}
+
+// keptData is isKept for an object in JSON form.
+func keptData(data []byte) bool {
+	policy := dataAnnotation(data, kube.ResourcePolicyAnno)
+	return strings.ToLower(strings.TrimSpace(policy)) == kube.KeepPolicy
+}
+
+// dataAnnotation returns the annotation of an object in JSON form.
+func dataAnnotation(data []byte, name string) string {
+	var obj struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return ""
+	}
+	return obj.Metadata.Annotations[name]
+}
@@ -0,0 +1,649 @@
+package patchdiff
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/release"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/cli-runtime/pkg/resource"
+	"sigs.k8s.io/yaml"
+)
+
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// createTargetYAML builds the objects in the target manifest and prints them
+// back as multi-document YAML. Unlike the rendered manifest this is the
+// normalized form that is sent to the API server. Sub-objects deeper than
+// limit are collapsed.
+func createTargetYAML(c *action.Configuration, targetManifest string, sourceComments bool, limit *depthLimit) (string, error) {
+	b := bytes.NewBuffer(nil)
+	for _, doc := range splitManifests(targetManifest) {
+		infos, err := c.KubeClient.Build(bytes.NewBufferString(doc), false)
+		if err != nil {
+			return "", errors.Wrap(err, "unable to build kubernetes objects from new release manifest")
+		}
+		for _, info := range infos {
+			data, err := json.Marshal(info.Object)
+			if err != nil {
+				return "", errors.Wrapf(err, "serializing %s", info.Name)
+			}
+			if _, data, err = limit.collapse(nil, data); err != nil {
+				return "", errors.Wrapf(err, "serializing %s", info.Name)
+			}
+			if data, err = yaml.JSONToYAML(data); err != nil {
+				return "", errors.Wrapf(err, "serializing %s", info.Name)
+			}
+			b.WriteString("---\n")
+			if source := manifestSource(doc); sourceComments && source != "" {
+				fmt.Fprintf(b, "# Source: %s\n", source)
+			}
+			b.Write(data)
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// manifestSource returns the template name recorded in a rendered manifest's
+// "# Source:" comment, if any.
+func manifestSource(doc string) string {
+	for _, line := range strings.Split(doc, "\n") {
+		if strings.HasPrefix(line, "# Source: ") {
+			return strings.TrimPrefix(line, "# Source: ")
+		}
+	}
+	return ""
+}
+
+// writeSnapshot writes the original and target objects of a resource to
+// before.yaml and after.yaml in a directory named after its identity.
+func writeSnapshot(dir string, original, target *resource.Info, compress bool) error {
+	dir = filepath.Join(dir, resourceFilename(target))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for name, info := range map[string]*resource.Info{"before.yaml": original, "after.yaml": target} {
+		data, err := yaml.Marshal(info.Object)
+		if err != nil {
+			return errors.Wrapf(err, "serializing %s", info.Name)
+		}
+		if compress {
+			name += ".gz"
+			if data, err = gzipData(data); err != nil {
+				return err
+			}
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func gzipData(data []byte) ([]byte, error) {
+	b := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(b)
+	if _, err := gz.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// resourceFilename returns a file name that identifies the resource, safe to
+// use on any filesystem.
+func resourceFilename(info *resource.Info) string {
+	parts := []string{info.Mapping.GroupVersionKind.Kind, info.Name}
+	if info.Namespace != "" {
+		parts = append([]string{info.Namespace}, parts...)
+	}
+	return unsafeFilenameChars.ReplaceAllString(strings.Join(parts, "_"), "-")
+}
+
+// writePatchFiles writes the patch of each entry to a file of its own in dir,
+// named after the identity of its resource, and returns how many it wrote.
+// Entries without a patch, such as deletes, get no file.
+func writePatchFiles(dir string, entries []PatchEntry, compress bool) (int, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, e := range entries {
+		if isEmptyPatch(e.Patch) {
+			continue
+		}
+		b := bytes.NewBuffer(nil)
+		if err := json.Indent(b, e.Patch, "", "  "); err != nil {
+			return n, errors.Wrapf(err, "serializing patch of %s %q", e.Kind, e.Name)
+		}
+		b.WriteString("\n")
+		data, name := b.Bytes(), patchFilename(e)
+		if compress {
+			name += ".gz"
+			var err error
+			if data, err = gzipData(data); err != nil {
+				return n, err
+			}
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// patchFilename returns the file name the patch of e is written to,
+// <namespace>-<kind>-<name>.json, safe to use on any filesystem.
+func patchFilename(e PatchEntry) string {
+	parts := []string{e.Kind, e.Name}
+	if e.Namespace != "" {
+		parts = append([]string{e.Namespace}, parts...)
+	}
+	return unsafeFilenameChars.ReplaceAllString(strings.Join(parts, "-"), "-") + ".json"
+}
+
+// argocdBlock renders the live and desired state of a resource the way
+// argocd app diff does: a header naming the resource followed by a diff of the
+// two as YAML. Either side may be nil.
+func argocdBlock(info *resource.Info, live, desired []byte, limit *depthLimit) (string, error) {
+	live, desired, err := limit.collapse(live, desired)
+	if err != nil {
+		return "", errors.Wrapf(err, "serializing %s", info.Name)
+	}
+	var yamls [2]string
+	for i, data := range [][]byte{live, desired} {
+		if data == nil {
+			continue
+		}
+		y, err := yaml.JSONToYAML(data)
+		if err != nil {
+			return "", errors.Wrapf(err, "serializing %s", info.Name)
+		}
+		yamls[i] = string(y)
+	}
+
+	gvk := info.Mapping.GroupVersionKind
+	red, green := color.New(color.FgRed).SprintFunc(), color.New(color.FgGreen).SprintFunc()
+	return fmt.Sprintf("\n===== %s/%s %s/%s ======\n%s", gvk.Group, gvk.Kind, info.Namespace, info.Name,
+		lineDiff(yamls[0], yamls[1], func(s string) string { return red(s) }, func(s string) string { return green(s) })), nil
+}
+
+// unifiedBlock renders the change to a resource as a unified diff of its
+// release and target configurations as YAML, as helm diff does. Either side
+// may be nil. Sub-objects deeper than limit are collapsed.
+func unifiedBlock(info *resource.Info, before, after []byte, limit *depthLimit) (string, error) {
+	red, green := color.New(color.FgRed).SprintFunc(), color.New(color.FgGreen).SprintFunc()
+	return unifiedYAMLDiff(info, before, after, limit, func(s string) string { return red(s) }, func(s string) string { return green(s) })
+}
+
+// unifiedYAMLDiff is unifiedBlock with the removed and added lines passed
+// through removed and added.
+func unifiedYAMLDiff(info *resource.Info, before, after []byte, limit *depthLimit, removed, added func(string) string) (string, error) {
+	before, after, err := limit.collapse(before, after)
+	if err != nil {
+		return "", errors.Wrapf(err, "serializing %s", info.Name)
+	}
+	var yamls [2]string
+	for i, data := range [][]byte{before, after} {
+		if data == nil {
+			continue
+		}
+		y, err := yaml.JSONToYAML(data)
+		if err != nil {
+			return "", errors.Wrapf(err, "serializing %s", info.Name)
+		}
+		yamls[i] = string(y)
+	}
+
+	name := resourceName(info)
+	return unifiedDiff(yamls[0], yamls[1], name+" (release)", name+" (target)", removed, added), nil
+}
+
+// resourceName names a resource by kind, namespace and name, as diffs
+// head them.
+func resourceName(info *resource.Info) string {
+	return fmt.Sprintf("%s %s", info.Mapping.GroupVersionKind.Kind, strings.TrimPrefix(info.Namespace+"/"+info.Name, "/"))
+}
+
+// patchBundleAPIVersion versions the schema of patchbundle output. It must be
+// bumped on incompatible changes.
+const patchBundleAPIVersion = "patchdiff.helm.sh/v1alpha1"
+
+// patchBundle is a versioned document of patches a controller can iterate
+// over and apply in order.
+type patchBundle struct {
+	APIVersion string              `json:"apiVersion"`
+	Kind       string              `json:"kind"`
+	Metadata   patchBundleMetadata `json:"metadata"`
+	Patches    []patchBundleEntry  `json:"patches"`
+}
+
+type patchBundleMetadata struct {
+	Release string `json:"release"`
+	// ChartDigest identifies the chart archive the target was rendered
+	// from.
+	ChartDigest string `json:"chartDigest,omitempty"`
+	KubeVersion string `json:"kubeVersion,omitempty"`
+	// APIVersions are the API versions available when the target was
+	// rendered.
+	APIVersions []string `json:"apiVersions,omitempty"`
+	GeneratedAt string   `json:"generatedAt"`
+}
+
+// PatchEntry is a patch of json output and the resource it applies to.
+type PatchEntry struct {
+	APIVersion string          `json:"apiVersion"`
+	Kind       string          `json:"kind"`
+	Namespace  string          `json:"namespace,omitempty"`
+	Name       string          `json:"name"`
+	PatchType  types.PatchType `json:"patchType"`
+	Patch      json.RawMessage `json:"patch"`
+	// Hook is the value of the helm.sh/hook annotation of a hook resource,
+	// such as "pre-upgrade,post-upgrade".
+	Hook string `json:"hook,omitempty"`
+	// PatchHash and TargetHash, set with Options.WithHashes, identify the
+	// patch and the target object by content, as set by addHashes.
+	PatchHash  string `json:"patchHash,omitempty"`
+	TargetHash string `json:"targetHash,omitempty"`
+}
+
+// addHashes sets the PatchHash of e, and its TargetHash from target, the
+// object the entry upgrades to, unless it is nil. Each is the hex encoded
+// sha256 of the canonical JSON of the document, prefixed with "sha256:".
+func (e *PatchEntry) addHashes(target []byte) error {
+	var err error
+	if !isEmptyPatch(e.Patch) {
+		if e.PatchHash, err = contentHash(e.Patch); err != nil {
+			return err
+		}
+	}
+	if target != nil {
+		if e.TargetHash, err = contentHash(target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// contentHash returns the sha256 of data in canonical form: object keys
+// sorted, no insignificant whitespace, numbers as written and strings escaped
+// as encoding/json escapes them. Documents that differ only in formatting
+// hash the same.
+func contentHash(data []byte) (string, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return "", err
+	}
+	canonical, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(canonical)), nil
+}
+
+// The codes of warnings.
+const (
+	// OrphanedAPIServiceWarning is an API service the cluster registers but
+	// does not serve, so discovery is incomplete.
+	OrphanedAPIServiceWarning = "OrphanedAPIService"
+	// ImmutableFieldWarning is a change to an immutable field, which the
+	// upgrade does not apply.
+	ImmutableFieldWarning = "ImmutableField"
+	// ReplacedWarning is a resource deleted and recreated by --force, since
+	// immutable fields of it change.
+	ReplacedWarning = "Replaced"
+)
+
+// Warning is a problem noted while diffing, printed with the patch entries
+// of json output by Options.Envelope.
+type Warning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func immutableWarnings(kind, name string, fields []string) []Warning {
+	var warnings []Warning
+	for _, field := range fields {
+		warnings = append(warnings, Warning{Code: ImmutableFieldWarning, Message: fmt.Sprintf("%s %q: changes to %s will not apply (immutable on %s)", kind, name, field, kind)})
+	}
+	return warnings
+}
+
+func replacedWarning(kind, name string, fields []string) Warning {
+	return Warning{Code: ReplacedWarning, Message: fmt.Sprintf("%s %q: replaced (deleted and recreated), since %s cannot change in place", kind, name, strings.Join(fields, ", "))}
+}
+
+// envelope is json output with Options.Envelope.
+type envelope struct {
+	Patches  []PatchEntry    `json:"patches"`
+	Warnings []Warning       `json:"warnings"`
+	Summary  envelopeSummary `json:"summary"`
+}
+
+// envelopeSummary counts the resources of an envelope by what the upgrade
+// does to them.
+type envelopeSummary struct {
+	Modified  int `json:"modified"`
+	Created   int `json:"created"`
+	Deleted   int `json:"deleted"`
+	Unchanged int `json:"unchanged"`
+	// Breakdown, set with Options.ExplainPatchType, counts the patched
+	// resources per patch type and the reason it was chosen, as logged.
+	Breakdown map[string]int `json:"breakdown,omitempty"`
+}
+
+func envelopeOutput(ps *patchset) (string, error) {
+	env := envelope{
+		Patches:  ps.entries,
+		Warnings: ps.warnings,
+		Summary: envelopeSummary{
+			Modified:  ps.counts.Patched,
+			Created:   ps.counts.Created,
+			Deleted:   ps.counts.Deleted,
+			Unchanged: ps.counts.Unchanged,
+			Breakdown: ps.patchTypes,
+		},
+	}
+	if env.Warnings == nil {
+		env.Warnings = []Warning{}
+	}
+	data, err := json.Marshal(env)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to serialize patchset")
+	}
+	return string(data), nil
+}
+
+func newPatchEntry(info *resource.Info, patchType types.PatchType, patch []byte) PatchEntry {
+	gvk := info.Mapping.GroupVersionKind
+	return PatchEntry{
+		APIVersion: gvk.GroupVersion().String(),
+		Kind:       gvk.Kind,
+		Namespace:  info.Namespace,
+		Name:       info.Name,
+		PatchType:  patchType,
+		Patch:      json.RawMessage(patch),
+		Hook:       hookAnnotation(info),
+	}
+}
+
+// sortEntries orders entries by namespace, kind and name, then API version,
+// so that the patchset does not depend on the order of the manifests.
+func sortEntries(entries []PatchEntry) {
+	sort.SliceStable(entries, func(i, j int) bool { return entryLess(entries[i], entries[j]) })
+}
+
+// sortResources orders resources as sortEntries orders their entries.
+func sortResources(infos []*resource.Info) {
+	sort.SliceStable(infos, func(i, j int) bool {
+		return entryLess(newPatchEntry(infos[i], "", nil), newPatchEntry(infos[j], "", nil))
+	})
+}
+
+func entryLess(a, b PatchEntry) bool {
+	if a.Namespace != b.Namespace {
+		return a.Namespace < b.Namespace
+	}
+	if a.Kind != b.Kind {
+		return a.Kind < b.Kind
+	}
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	return a.APIVersion < b.APIVersion
+}
+
+// hookAnnotation returns the hook events of a hook resource, or "" for a
+// resource of the release manifest.
+func hookAnnotation(info *resource.Info) string {
+	accessor, err := meta.Accessor(info.Object)
+	if err != nil {
+		return ""
+	}
+	return accessor.GetAnnotations()[release.HookAnnotation]
+}
+
+// deletePatchType marks an entry whose resource is deleted. It has no patch.
+const deletePatchType types.PatchType = "delete"
+
+// replacePatchType marks an entry whose patch is the whole target object,
+// which replaces the live object rather than patching it.
+const replacePatchType types.PatchType = "replace"
+
+type patchBundleEntry struct {
+	Resource  patchBundleResource `json:"resource"`
+	PatchType types.PatchType     `json:"patchType"`
+	Patch     json.RawMessage     `json:"patch"`
+	// Rollback undoes Patch once it was applied, with the same patch type.
+	Rollback json.RawMessage `json:"rollback,omitempty"`
+}
+
+type patchBundleResource struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+}
+
+func newPatchBundleEntry(info *resource.Info, patchType types.PatchType, patch []byte) patchBundleEntry {
+	gvk := info.Mapping.GroupVersionKind
+	return patchBundleEntry{
+		Resource: patchBundleResource{
+			APIVersion: gvk.GroupVersion().String(),
+			Kind:       gvk.Kind,
+			Namespace:  info.Namespace,
+			Name:       info.Name,
+		},
+		PatchType: patchType,
+		Patch:     json.RawMessage(patch),
+	}
+}
+
+// junitTestSuite reports each resource as a test case that fails when it
+// would be deleted, when its patch changes immutable fields or when it
+// violates a policy such as --fail-on-change-to.
+type junitTestSuite struct {
+	XMLName   xml.Name        `xml:"testsuite"`
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// add records a test case for info, failing it with the given failures. A nil
+// patch means the resource would be created.
+func (s *junitTestSuite) add(info *resource.Info, patch []byte, failures []string) {
+	tc := junitTestCase{
+		ClassName: info.Mapping.GroupVersionKind.Kind,
+		Name:      strings.TrimPrefix(info.Namespace+"/"+info.Name, "/"),
+	}
+	switch {
+	case patch == nil:
+		tc.SystemOut = "created"
+	case len(failures) > 0:
+		tc.Failure = &junitFailure{Message: strings.Join(failures, "; "), Body: string(patch)}
+		s.Failures++
+	case !isEmptyPatch(patch):
+		tc.SystemOut = string(patch)
+	}
+	s.TestCases = append(s.TestCases, tc)
+	s.Tests++
+}
+
+// addDeleted records a failed test case for info, which would be deleted.
+func (s *junitTestSuite) addDeleted(info *resource.Info) {
+	s.TestCases = append(s.TestCases, junitTestCase{
+		ClassName: info.Mapping.GroupVersionKind.Kind,
+		Name:      strings.TrimPrefix(info.Namespace+"/"+info.Name, "/"),
+		Failure:   &junitFailure{Message: fmt.Sprintf("%s %s would be deleted", info.Mapping.GroupVersionKind.Kind, info.Name)},
+	})
+	s.Tests++
+	s.Failures++
+}
+
+func (s *junitTestSuite) xml() (string, error) {
+	data, err := xml.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return xml.Header + string(data), nil
+}
+
+// csvHeader names the columns of csv output.
+var csvHeader = []string{"namespace", "kind", "name", "change", "fields_changed", "patch_type"}
+
+// csvRecord is the csv output row of a resource the upgrade changes in the
+// way change says. fields_changed is the number of fields the patch sets or
+// removes, and is left empty for created and deleted resources, whose every
+// field changes.
+func csvRecord(info *resource.Info, change string, paths []string, patchType types.PatchType) []string {
+	fields := ""
+	if change != "created" && change != "deleted" {
+		fields = strconv.Itoa(len(paths))
+	}
+	return []string{info.Namespace, info.Mapping.GroupVersionKind.Kind, info.Name, change, fields, string(patchType)}
+}
+
+// csvOutput formats records as CSV with a header row, quoting fields as RFC
+// 4180 does.
+func csvOutput(records [][]string) (string, error) {
+	b := bytes.NewBuffer(nil)
+	w := csv.NewWriter(b)
+	if err := w.WriteAll(append([][]string{csvHeader}, records...)); err != nil {
+		return "", errors.Wrap(err, "unable to write csv output")
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// kindCounts holds the counts of the resources of each kind.
+type kindCounts map[string]*Counts
+
+func (k kindCounts) of(kind string) *Counts {
+	if k[kind] == nil {
+		k[kind] = &Counts{}
+	}
+	return k[kind]
+}
+
+// summary describes the changes to each kind that changes, such as
+// "Deployment: 2 modified, 1 created", in order of kind.
+func (k kindCounts) summary() []string {
+	kinds := make([]string, 0, len(k))
+	for kind := range k {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	var lines []string
+	for _, kind := range kinds {
+		c := k[kind]
+		var parts []string
+		for _, n := range []struct {
+			count  int
+			action string
+		}{{c.Patched, "modified"}, {c.Created, "created"}, {c.Deleted, "deleted"}} {
+			if n.count > 0 {
+				parts = append(parts, fmt.Sprintf("%d %s", n.count, n.action))
+			}
+		}
+		if len(parts) > 0 {
+			lines = append(lines, fmt.Sprintf("%s: %s", kind, strings.Join(parts, ", ")))
+		}
+	}
+	return lines
+}
+
+// clusterScoped stands for the namespace of cluster-scoped resources in
+// fleet-summary output. Namespace names cannot contain parentheses.
+const clusterScoped = "(cluster)"
+
+// namespaceKinds holds the kinds of the resources that change in each
+// namespace.
+type namespaceKinds map[string]map[string]bool
+
+func (n namespaceKinds) add(namespace, kind string) {
+	if namespace == "" {
+		namespace = clusterScoped
+	}
+	if n[namespace] == nil {
+		n[namespace] = map[string]bool{}
+	}
+	n[namespace][kind] = true
+}
+
+// fleetSummary describes the kinds that change in each namespace, such as
+// "web: ConfigMap, Deployment", a line a namespace in order.
+func (n namespaceKinds) fleetSummary() string {
+	namespaces := make([]string, 0, len(n))
+	for ns := range n {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+
+	lines := make([]string, 0, len(namespaces))
+	for _, ns := range namespaces {
+		kinds := make([]string, 0, len(n[ns]))
+		for kind := range n[ns] {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		lines = append(lines, fmt.Sprintf("%s: %s", ns, strings.Join(kinds, ", ")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// MergeFleetSummaries rolls the fleet-summary outputs of many releases up
+// into one, listing each namespace once with every kind that changes in it
+// in any of the releases.
+func MergeFleetSummaries(summaries []string) (string, error) {
+	merged := namespaceKinds{}
+	for _, summary := range summaries {
+		for _, line := range strings.Split(summary, "\n") {
+			if line == "" {
+				continue
+			}
+			i := strings.Index(line, ": ")
+			if i < 0 {
+				return "", errors.Errorf("invalid fleet summary line %q", line)
+			}
+			for _, kind := range strings.Split(line[i+2:], ", ") {
+				merged.add(line[:i], kind)
+			}
+		}
+	}
+	return merged.fleetSummary(), nil
+}
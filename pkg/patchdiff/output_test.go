@@ -0,0 +1,223 @@
+package patchdiff
+
+import (
+	"context"
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestJUnitFailures(t *testing.T) {
+	statefulSet := `apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: db
+  namespace: web
+spec:
+  replicas: 1
+  volumeClaimTemplates:
+  - metadata:
+      name: data
+    spec:
+      resources:
+        requests:
+          storage: `
+	// the Deployment is unchanged, the StatefulSet changes an immutable
+	// field, ConfigMap b a protected path and ConfigMap gone is deleted
+	release := []string{statefulSet + "1Gi", releaseDocs[0], releaseDocs[1], releaseDocs[3]}
+	target := []string{statefulSet + "2Gi", targetDocs[1], releaseDocs[1]}
+	cluster := newTestCluster(t, manifest(release))
+
+	ps, err := createPatchset(context.Background(), cluster.actionConfig(t), "r", manifest(release), manifest(target), &Options{
+		Output:         "junit",
+		FailOnChangeTo: []string{"/data"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "patches change protected paths") {
+		t.Fatalf("expected the protected path to fail the run, got %v", err)
+	}
+
+	var suite junitTestSuite
+	if err := xml.Unmarshal([]byte(ps.output), &suite); err != nil {
+		t.Fatal(err)
+	}
+	if suite.Tests != 4 || suite.Failures != 3 {
+		t.Errorf("got %d tests and %d failures, want 4 and 3", suite.Tests, suite.Failures)
+	}
+	want := map[string]string{
+		"ConfigMap web/b":    "/data",
+		"ConfigMap api/gone": "ConfigMap gone would be deleted",
+		"Deployment web/a":   "",
+		"StatefulSet web/db": "changes to /spec/volumeClaimTemplates will not apply (immutable on StatefulSet)",
+	}
+	for _, tc := range suite.TestCases {
+		name := tc.ClassName + " " + tc.Name
+		message, ok := want[name]
+		if !ok {
+			t.Errorf("unexpected test case %s", name)
+			continue
+		}
+		delete(want, name)
+		switch {
+		case message == "" && tc.Failure != nil:
+			t.Errorf("%s: unexpected failure %q", name, tc.Failure.Message)
+		case message != "" && tc.Failure == nil:
+			t.Errorf("%s: did not fail, want a failure with %q", name, message)
+		case message != "" && !strings.Contains(tc.Failure.Message, message):
+			t.Errorf("%s: failure %q does not contain %q", name, tc.Failure.Message, message)
+		}
+	}
+	for name := range want {
+		t.Errorf("no test case for %s", name)
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	a, err := contentHash([]byte(`{"b":1,"a":[9007199254740993,"x"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the content counts, not its formatting or key order
+	b, err := contentHash([]byte("{\n  \"a\": [9007199254740993, \"x\"],\n  \"b\": 1\n}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Errorf("got hashes %s and %s of the same document", a, b)
+	}
+	// the sha256 of {"a":[9007199254740993,"x"],"b":1}
+	if want := "sha256:9f6c840d39fa8c74b2ff5d8f04347e25e07fedaedc8196a24d5355022bd378ad"; a != want {
+		t.Errorf("got hash %s, want %s", a, want)
+	}
+	if c, _ := contentHash([]byte(`{"a":[9007199254740993,"x"],"b":2}`)); c == a {
+		t.Errorf("got the same hash %s for different documents", c)
+	}
+}
+
+func TestCreatePatchsetWithHashes(t *testing.T) {
+	cluster := newTestCluster(t, manifest(releaseDocs))
+	for _, opts := range []*Options{
+		{Install: true, WithHashes: true},
+		{Install: true, WithHashes: true, Offline: true},
+	} {
+		ps, err := createPatchset(context.Background(), cluster.actionConfig(t), "r", manifest(releaseDocs), manifest(targetDocs), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range ps.entries {
+			want := ""
+			if e.PatchType != deletePatchType {
+				want, _ = contentHash(e.Patch)
+			}
+			if e.PatchHash != want {
+				t.Errorf("offline %t: %s %s: got patch hash %q, want %q", opts.Offline, e.Kind, e.Name, e.PatchHash, want)
+			}
+			if (e.TargetHash == "") != (e.PatchType == deletePatchType) {
+				t.Errorf("offline %t: %s %s %s: got target hash %q", opts.Offline, e.PatchType, e.Kind, e.Name, e.TargetHash)
+			}
+		}
+	}
+}
+
+func TestCreatePatchsetCSVOutput(t *testing.T) {
+	cluster := newTestCluster(t, manifest(releaseDocs))
+	ps, err := createPatchset(context.Background(), cluster.actionConfig(t), "r", manifest(releaseDocs), manifest(targetDocs), &Options{Output: "csv"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `namespace,kind,name,change,fields_changed,patch_type
+api,ConfigMap,a,modified,1,application/strategic-merge-patch+json
+api,ConfigMap,gone,deleted,,delete
+web,ConfigMap,b,modified,1,application/strategic-merge-patch+json
+web,ConfigMap,new,created,,create
+web,Deployment,a,modified,1,application/strategic-merge-patch+json`
+	if ps.output != want {
+		t.Errorf("got\n%s\nwant\n%s", ps.output, want)
+	}
+}
+
+func TestCSVOutputQuotes(t *testing.T) {
+	got, err := csvOutput([][]string{{"", "Widget", "a", "modified", "2", `application/x-"odd",type`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "namespace,kind,name,change,fields_changed,patch_type\n,Widget,a,modified,2,\"application/x-\"\"odd\"\",type\""
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestEnvelopeOutputWithoutWarnings(t *testing.T) {
+	got, err := envelopeOutput(&patchset{entries: []PatchEntry{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"patches":[],"warnings":[],"summary":{"modified":0,"created":0,"deleted":0,"unchanged":0}}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestEnvelopeOutputBreakdown(t *testing.T) {
+	for _, tt := range []struct {
+		opts *Options
+		want string
+	}{
+		{&Options{Envelope: true}, `"summary":{"modified":3,"created":1,"deleted":1,"unchanged":0}}`},
+		{&Options{Envelope: true, ExplainPatchType: true}, `"summary":{"modified":3,"created":1,"deleted":1,"unchanged":0,"breakdown":{"strategic":3}}}`},
+		{&Options{Envelope: true, ExplainPatchType: true, Offline: true}, `"breakdown":{"merge (offline)":3}}}`},
+	} {
+		cluster := newTestCluster(t, manifest(releaseDocs))
+		ps, err := createPatchset(context.Background(), cluster.actionConfig(t), "r", manifest(releaseDocs), manifest(targetDocs), tt.opts)
+		if err != nil {
+			t.Errorf("%+v: %s", tt.opts, err)
+			continue
+		}
+		got, err := envelopeOutput(ps)
+		if err != nil {
+			t.Errorf("%+v: %s", tt.opts, err)
+			continue
+		}
+		if !strings.HasSuffix(got, tt.want) {
+			t.Errorf("%+v: got %s, want it to end with %s", tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestCreatePatchsetFleetSummary(t *testing.T) {
+	cluster := newTestCluster(t, manifest(releaseDocs))
+	ps, err := createPatchset(context.Background(), cluster.actionConfig(t), "r", manifest(releaseDocs), manifest(targetDocs), &Options{Output: "fleet-summary"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "api: ConfigMap\nweb: ConfigMap, Deployment"; ps.output != want {
+		t.Errorf("got\n%s\nwant\n%s", ps.output, want)
+	}
+}
+
+func TestMergeFleetSummaries(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		summaries []string
+		want      string
+	}{
+		{"none", nil, ""},
+		{"unchanged releases", []string{"", ""}, ""},
+		{"one release", []string{"web: ConfigMap, Deployment"}, "web: ConfigMap, Deployment"},
+		{
+			name:      "shared namespaces",
+			summaries: []string{"api: Deployment\nweb: Deployment", "", "(cluster): ClusterRole\nweb: ConfigMap, Deployment"},
+			want:      "(cluster): ClusterRole\napi: Deployment\nweb: ConfigMap, Deployment",
+		},
+	} {
+		got, err := MergeFleetSummaries(tt.summaries)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+	if _, err := MergeFleetSummaries([]string{`[{"kind":"ConfigMap"}]`}); err == nil {
+		t.Error("merged json output, want an error")
+	}
+}
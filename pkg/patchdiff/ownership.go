@@ -0,0 +1,110 @@
+package patchdiff
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// ownershipConflicts returns, for each field the patch changes, the other
+// field managers of the live object that own it. Fields are compared without
+// list item keys, the same way patchPaths reports them, so a field of one list
+// item also matches the same field of its siblings.
+func ownershipConflicts(live runtime.Object, patchPaths []string, fieldManager string) ([]string, error) {
+	accessor, err := meta.Accessor(live)
+	if err != nil {
+		return nil, err
+	}
+
+	owners := map[string]map[string]bool{}
+	for _, entry := range accessor.GetManagedFields() {
+		if entry.Manager == fieldManager || entry.FieldsV1 == nil {
+			continue
+		}
+		fields, err := managedPaths(entry)
+		if err != nil {
+			return nil, err
+		}
+		for _, owned := range fields {
+			if owners[owned] == nil {
+				owners[owned] = map[string]bool{}
+			}
+			owners[owned][entry.Manager] = true
+		}
+	}
+
+	var conflicts []string
+	for _, p := range patchPaths {
+		managers := map[string]bool{}
+		for owned, ms := range owners {
+			if pathTouches(p, owned) {
+				for m := range ms {
+					managers[m] = true
+				}
+			}
+		}
+		if len(managers) == 0 {
+			continue
+		}
+		names := make([]string, 0, len(managers))
+		for m := range managers {
+			names = append(names, fmt.Sprintf("%q", m))
+		}
+		sort.Strings(names)
+		conflicts = append(conflicts, fmt.Sprintf("%s is owned by %s", p, strings.Join(names, ", ")))
+	}
+	return conflicts, nil
+}
+
+// managedPaths returns the JSON pointers of the leaf fields in a managed
+// fields entry.
+func managedPaths(entry metav1.ManagedFieldsEntry) ([]string, error) {
+	var set map[string]interface{}
+	if err := json.Unmarshal(entry.FieldsV1.Raw, &set); err != nil {
+		return nil, err
+	}
+	var paths []string
+	walkFieldSet(set, "", &paths)
+	return paths, nil
+}
+
+func walkFieldSet(set map[string]interface{}, path string, paths *[]string) {
+	if len(set) == 0 && path != "" {
+		*paths = append(*paths, path)
+		return
+	}
+	for k, v := range set {
+		child, _ := v.(map[string]interface{})
+		switch {
+		case strings.HasPrefix(k, "f:"):
+			walkFieldSet(child, path+"/"+escapePointer(strings.TrimPrefix(k, "f:")), paths)
+		case strings.HasPrefix(k, "k:"), strings.HasPrefix(k, "v:"), strings.HasPrefix(k, "i:"):
+			// list items are not addressed by patch paths
+			walkFieldSet(child, path, paths)
+		}
+		// "." marks ownership of the map itself, which does not conflict
+		// with changes to its fields
+	}
+}
+
+// lastModified returns the latest time a field manager changed the live
+// object, or the zero time if its managed fields record none.
+func lastModified(live runtime.Object) (time.Time, error) {
+	accessor, err := meta.Accessor(live)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var latest time.Time
+	for _, entry := range accessor.GetManagedFields() {
+		if entry.Time != nil && entry.Time.After(latest) {
+			latest = entry.Time.Time
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,1983 @@
+// Package patchdiff previews the patches helm upgrade would send to the API
+// server for each resource of a release.
+package patchdiff
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/mitchellh/copystructure"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/engine"
+	"helm.sh/helm/v3/pkg/kube"
+	"helm.sh/helm/v3/pkg/postrender"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	apiextv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/cli-runtime/pkg/kustomize"
+	"k8s.io/cli-runtime/pkg/resource"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/kustomize/pkg/fs"
+	"sigs.k8s.io/yaml"
+)
+
+// PatchOnlyKindsAnnotation is the Chart.yaml annotation holding a comma
+// separated default for Options.PatchOnlyKinds.
+const PatchOnlyKindsAnnotation = "patchdiff.helm.sh/patch-only-kinds"
+
+// Options control how patches are computed and printed. The zero value
+// renders with the builtin engine and prints json output.
+type Options struct {
+	// PatchAnnotations are merged into every target object before diffing.
+	PatchAnnotations map[string]string
+	// KustomizeDir, when set, builds the target from a kustomization instead
+	// of rendering a chart.
+	KustomizeDir string
+	// BaseReleaseName, when set, is the release whose manifest is diffed
+	// against, while the chart is still rendered for the release name given.
+	BaseReleaseName string
+	// PatchOnlyKinds, when set, is the allowlist of kinds that are diffed.
+	// Charts may set it with the PatchOnlyKindsAnnotation instead.
+	PatchOnlyKinds []string
+	// FailOnChangeTo lists JSON pointers no patch may touch.
+	FailOnChangeTo []string
+	// Force previews helm upgrade --force, which replaces resources whose
+	// changes cannot be patched in place.
+	Force bool
+	// CheckFieldOwnership reports fields the patch changes that a field
+	// manager other than FieldManager owns on the live object.
+	CheckFieldOwnership bool
+	FieldManager        string
+	// WithRollback adds, to each patchbundle entry, the patch that undoes it.
+	WithRollback bool
+	// FreshnessWindow notes resources whose live state changed within it, as
+	// the baseline of their patch may still be shifting.
+	FreshnessWindow time.Duration
+	// VerifyPatches applies each patch and warns when the result does not
+	// match the target.
+	VerifyPatches bool
+	// SpecOnly ignores changes outside of spec, or of data for kinds without
+	// a spec.
+	SpecOnly bool
+	// IgnoreListOrder treats lists of objects that differ only in order as
+	// unchanged.
+	IgnoreListOrder bool
+	// SkipForbidden reports resources whose live state cannot be read
+	// because of RBAC instead of failing the diff.
+	SkipForbidden bool
+	// BatchFetch lists kinds with several target resources once per
+	// namespace instead of getting each resource.
+	BatchFetch bool
+	// Normalizer removes noise before diffing, as loaded by
+	// LoadNormalizeConfig.
+	Normalizer *NormalizeConfig
+	// Strict fails rendering when a template references a value that was not
+	// passed in.
+	Strict bool
+	// Engine selects how the target manifest is rendered: "builtin" or "helm".
+	Engine string
+	// Output selects what is printed: "json" patch entries, "raw" patches,
+	// "target-yaml", or one of the reports, such as "csv". "fleet-summary"
+	// lists the kinds that change in each namespace, to be rolled up across
+	// releases with MergeFleetSummaries.
+	Output string
+	// MaxValueWidth truncates the values printed by delta output.
+	MaxValueWidth int
+	// MaxDepth, when positive, collapses the sub-objects nested deeper than
+	// this in the objects printed by diff, argocd, delta, target-yaml and
+	// html output. The fields of an object are at depth 1.
+	MaxDepth int
+	// SourceComments adds "# Source:" comments to target-yaml output.
+	SourceComments bool
+	// DiffFormat selects how json output describes changes: as raw "patch"
+	// bodies or as "semantic" sentences for well-known fields.
+	DiffFormat string
+	// ExplainPatchType prints how many resources were patched with each
+	// patch type and why.
+	ExplainPatchType bool
+	// WithContextResources lists, with each described change, the unchanged
+	// resources of the same kind in the same namespace.
+	WithContextResources bool
+	// Gzip compresses the files written to SnapshotDir and OutputDir.
+	Gzip bool
+	// CountOnly prints only the number of resources that would change.
+	CountOnly bool
+	// SnapshotDir is where snapshots output writes before and after files.
+	SnapshotDir string
+	// OutputDir, when set, is where the patch of each resource is written to
+	// a file of its own instead of printing the patchset.
+	OutputDir string
+	// DumpValues, when set, is where the values passed to the template engine
+	// are printed before rendering.
+	DumpValues io.Writer
+	// ValidateRender builds every rendered document before diffing and
+	// reports all that fail.
+	ValidateRender bool
+	// ReuseValues merges the values on the command line over the values of
+	// the current release, as helm upgrade --reuse-values does.
+	ReuseValues bool
+	// ResetValues renders with only the values on the command line, as helm
+	// upgrade --reset-values does. It takes precedence over ReuseValues.
+	ResetValues bool
+	// IncludeHooks diffs the hooks of the chart along with its manifests.
+	IncludeHooks bool
+	// IncludeTestHooks lists the resources helm test would create after the
+	// patch entries, as created. They are left out otherwise, even with
+	// IncludeHooks, since an upgrade does not run them.
+	IncludeTestHooks bool
+	// Concurrency is the number of resources whose live state is looked up
+	// and diffed in parallel, DefaultConcurrency if zero.
+	Concurrency int
+	// ShowManagedFields keeps the fields the API server maintains, such as
+	// metadata.managedFields, metadata.resourceVersion and status, in the
+	// configurations that are diffed.
+	ShowManagedFields bool
+	// PostRenderer, when set, rewrites the rendered manifest before it is
+	// diffed, as helm upgrade --post-renderer does.
+	PostRenderer postrender.PostRenderer
+	// Include, when set, limits the diff to resources matching one of these
+	// Kind or Kind/name selectors.
+	Include []string
+	// Exclude leaves out resources matching one of these Kind or Kind/name
+	// selectors, even when they match Include.
+	Exclude []string
+	// Revision, when positive, is the revision of the release whose manifest
+	// is diffed against, instead of the deployed one.
+	Revision int
+	// Offline diffs without contacting the cluster, against the capabilities
+	// already set on the action configuration. Live objects cannot be read, so
+	// patches are two-way merge patches between the original and target
+	// manifests.
+	Offline bool
+	// PatchType selects the patches of the patchset: "strategic", the
+	// default, uses strategic merge patches, or JSON merge patches where
+	// those do not apply, and "json" RFC 6902 JSON Patches.
+	PatchType string
+	// WithTests guards each replace and remove of JSON Patches with a test
+	// operation asserting the live value, so that a patch no longer applies
+	// once the object changed since the preview.
+	WithTests bool
+	// WithHashes adds to each entry of json output the sha256 of its patch
+	// and of its target object, so identical previews can be told apart from
+	// new ones.
+	WithHashes bool
+	// Envelope prints json output as an object holding the patch entries
+	// along with the warnings of the run, instead of the bare entries.
+	Envelope bool
+	// Summary prints to stderr how many resources of each kind are
+	// modified, created and deleted.
+	Summary bool
+	// ChartDigest is the digest of the chart archive, as sha256:<hex>,
+	// recorded in the metadata of patchbundle output.
+	ChartDigest string
+	// Install previews helm upgrade --install: when the release does not
+	// exist, the chart is rendered for installing it and every resource is
+	// created, with its whole body in the patchset.
+	Install bool
+}
+
+// Validate checks that the options can be combined.
+func (o *Options) Validate() error {
+	switch o.Output {
+	case "", "json", "raw", "target-yaml", "junit", "argocd", "patchbundle", "delta", "diff", "csv", "fleet-summary", "html":
+	case "snapshots":
+		if o.SnapshotDir == "" {
+			return errors.New("--output snapshots requires --snapshot-dir")
+		}
+	default:
+		return errors.Errorf("invalid output %q: must be one of json, raw, target-yaml, snapshots, junit, argocd, patchbundle, delta, diff, csv, fleet-summary, html", o.Output)
+	}
+	if o.CountOnly && o.Output != "" && o.Output != "json" && o.Output != "raw" {
+		return errors.Errorf("--count-only cannot be combined with --output %s", o.Output)
+	}
+	if o.OutputDir != "" && (o.CountOnly || o.DiffFormat == "semantic" || (o.Output != "" && o.Output != "json" && o.Output != "raw" && o.Output != "html")) {
+		return errors.New("--output-dir writes patches, or the report of --output html, so it cannot be combined with --count-only, --diff-format semantic or an --output other than json, raw and html")
+	}
+	if o.WithRollback && o.Output != "patchbundle" {
+		return errors.New("--with-rollback requires --output patchbundle")
+	}
+	if o.FreshnessWindow < 0 {
+		return errors.Errorf("invalid --freshness-window %s: must not be negative", o.FreshnessWindow)
+	}
+	if o.MaxValueWidth < 0 {
+		return errors.Errorf("invalid --max-value-width %d: must not be negative", o.MaxValueWidth)
+	}
+	if o.MaxDepth < 0 {
+		return errors.Errorf("invalid --max-depth %d: must not be negative", o.MaxDepth)
+	}
+	if o.MaxDepth > 0 && o.Output != "diff" && o.Output != "argocd" && o.Output != "delta" && o.Output != "target-yaml" && o.Output != "html" {
+		return errors.New("--max-depth only applies to --output diff, argocd, delta, target-yaml and html; json output keeps patches whole")
+	}
+
+	switch o.DiffFormat {
+	case "", "patch", "semantic":
+	default:
+		return errors.Errorf("invalid diff format %q: must be one of patch, semantic", o.DiffFormat)
+	}
+
+	if o.WithContextResources && o.DiffFormat != "semantic" {
+		return errors.New("--with-context-resources requires --diff-format semantic")
+	}
+	switch o.PatchType {
+	case "", "strategic", "json":
+	default:
+		return errors.Errorf("invalid patch type %q: must be one of strategic, json", o.PatchType)
+	}
+
+	if o.WithHashes && (o.CountOnly || o.OutputDir != "" || o.DiffFormat == "semantic" || (o.Output != "" && o.Output != "json")) {
+		return errors.New("--with-hashes requires --output json")
+	}
+	if o.WithTests && o.PatchType != "json" {
+		return errors.New("--with-tests requires --patch-type json")
+	}
+	if o.IncludeTestHooks && (o.CountOnly || o.DiffFormat == "semantic" || (o.Output != "" && o.Output != "json" && o.Output != "raw")) {
+		return errors.New("--include-test-hooks requires --output json or raw")
+	}
+	if o.Envelope && (o.CountOnly || o.OutputDir != "" || o.DiffFormat == "semantic" || (o.Output != "" && o.Output != "json")) {
+		return errors.New("--envelope requires --output json")
+	}
+
+	if o.Install && o.KustomizeDir != "" {
+		return errors.New("--install cannot be combined with --kustomize, which builds the target of an existing release")
+	}
+
+	switch o.Engine {
+	case "", "builtin":
+	case "helm":
+		if o.KustomizeDir != "" {
+			return errors.New("--kustomize cannot be combined with --engine=helm")
+		}
+		if o.BaseReleaseName != "" {
+			return errors.New("--base-release-name cannot be combined with --engine=helm")
+		}
+	default:
+		return errors.Errorf("invalid engine %q: must be one of builtin, helm", o.Engine)
+	}
+	if o.Strict && (o.Engine == "helm" || o.KustomizeDir != "") {
+		return errors.New("--strict requires the builtin engine")
+	}
+
+	if o.PostRenderer != nil && o.KustomizeDir != "" {
+		return errors.New("--post-renderer cannot be combined with --kustomize")
+	}
+	if o.DumpValues != nil {
+		switch {
+		case o.Engine == "helm":
+			return errors.New("--dump-values requires the builtin engine, since helm does not expose the values it renders with")
+		case o.KustomizeDir != "":
+			return errors.New("--dump-values cannot be combined with --kustomize, which renders no values")
+		}
+	}
+
+	for _, sel := range append(append([]string{}, o.Include...), o.Exclude...) {
+		if err := validateSelector(sel); err != nil {
+			return err
+		}
+	}
+
+	if o.Concurrency < 0 {
+		return errors.Errorf("invalid concurrency %d: must not be negative", o.Concurrency)
+	}
+
+	if o.Revision < 0 {
+		return errors.Errorf("invalid --revision %d: must not be negative", o.Revision)
+	}
+	if o.Revision > 0 && (o.Engine == "helm" || o.KustomizeDir != "") {
+		return errors.New("--revision requires the builtin engine")
+	}
+
+	if o.Offline {
+		switch {
+		case o.Output != "" && o.Output != "json" && o.Output != "raw":
+			return errors.Errorf("--output %s needs the cluster and cannot be used offline", o.Output)
+		case o.DiffFormat == "semantic":
+			return errors.New("--diff-format semantic needs the cluster and cannot be used offline")
+		case o.Engine == "helm":
+			return errors.New("--engine=helm needs the cluster and cannot be used offline")
+		case o.ValidateRender:
+			return errors.New("--validate-render needs the cluster and cannot be used offline")
+		case o.CheckFieldOwnership:
+			return errors.New("--check-field-ownership needs the live objects and cannot be used offline")
+		case o.FreshnessWindow > 0:
+			return errors.New("--freshness-window needs the live objects and cannot be used offline")
+		case o.SkipForbidden:
+			return errors.New("--skip-forbidden needs the cluster and cannot be used offline")
+		case o.BatchFetch:
+			return errors.New("--batch-fetch needs the cluster and cannot be used offline")
+		case o.WithTests:
+			return errors.New("--with-tests needs the live objects and cannot be used offline")
+		}
+	}
+	return nil
+}
+
+// Counts classifies the resources of a release by what an upgrade would do
+// to them.
+type Counts struct {
+	Created   int
+	Patched   int
+	Deleted   int
+	Unchanged int
+}
+
+// patchset is the outcome of diffing the objects of two manifests.
+type patchset struct {
+	// output is formatted as selected by Options.Output.
+	output  string
+	entries []PatchEntry
+	counts  Counts
+	// kinds holds the counts of each kind.
+	kinds kindCounts
+	// warnings are the problems noted while diffing, as logged.
+	warnings []Warning
+	// sections are the changed resources shown by html output.
+	sections []htmlSection
+	// patchTypes counts the patched resources per patch type and reason,
+	// with Options.ExplainPatchType.
+	patchTypes map[string]int
+}
+
+// Diff returns the patch entries of an upgrade of the named release to the
+// chart rendered with vals, using the default options. Requests to the
+// cluster are cancelled along with ctx.
+func Diff(ctx context.Context, cfg *action.Configuration, name string, ch *chart.Chart, vals map[string]interface{}) ([]PatchEntry, error) {
+	opts := &Options{}
+	originalManifest, targetManifest, opts, err := prepareManifests(ctx, cfg, name, ch, vals, opts)
+	if err != nil {
+		return nil, err
+	}
+	ps, err := createPatchset(ctx, cfg, name, originalManifest, targetManifest, opts)
+	if ps == nil {
+		return nil, err
+	}
+	return ps.entries, err
+}
+
+// DiffRelease previews an upgrade of the named release to the chart rendered
+// with vals, formatted as selected by opts.Output, and counts the resources it
+// changes. Output is still returned when policy checks fail, along with the
+// error; it is empty, as are the counts, when the diff itself fails. Requests
+// to the cluster are cancelled along with ctx.
+func DiffRelease(ctx context.Context, c *action.Configuration, name string, ch *chart.Chart, vals map[string]interface{}, opts *Options) (string, Counts, error) {
+	// the cluster is discovered up front so that the envelope holds the
+	// warnings of discovery too
+	var warnings []Warning
+	if opts.Envelope && !opts.Offline && c.Capabilities == nil {
+		caps, discoveryWarnings, err := discoverCapabilities(ctx, c)
+		if err != nil {
+			return "", Counts{}, contextError(ctx, err)
+		}
+		c.Capabilities, warnings = caps, discoveryWarnings
+	}
+	originalManifest, targetManifest, opts, err := prepareManifests(ctx, c, name, ch, vals, opts)
+	if err != nil {
+		return "", Counts{}, contextError(ctx, err)
+	}
+
+	switch opts.Output {
+	case "target-yaml":
+		limit := newDepthLimit(opts.MaxDepth)
+		out, err := createTargetYAML(c, targetManifest, opts.SourceComments, limit)
+		limit.note(c)
+		return out, Counts{}, err
+	}
+
+	// test hooks are listed on their own, after the entries of the upgrade
+	var tests []PatchEntry
+	if opts.IncludeTestHooks {
+		if targetManifest, tests, err = testHookEntries(c, targetManifest); err != nil {
+			return "", Counts{}, err
+		}
+	}
+
+	ps, err := createPatchset(ctx, c, name, originalManifest, targetManifest, opts)
+	if ps == nil {
+		return "", Counts{}, contextError(ctx, err)
+	}
+	ps.warnings = append(warnings, ps.warnings...)
+	if len(tests) > 0 {
+		ps.entries = append(ps.entries, tests...)
+		output, formatErr := formatEntries(ps.entries, opts)
+		if formatErr != nil {
+			return "", Counts{}, formatErr
+		}
+		ps.output = output
+	}
+	return writePatchset(c, name, ps, opts, err)
+}
+
+// writePatchset returns the output of ps, or writes it where opts tells to
+// and returns a note saying so, along with its counts. err is the outcome of
+// the policy checks, returned along with the output.
+func writePatchset(c *action.Configuration, name string, ps *patchset, opts *Options, err error) (string, Counts, error) {
+	if opts.Summary {
+		if lines := ps.kinds.summary(); len(lines) > 0 {
+			c.Log("changes to release %q:\n  %s", name, strings.Join(lines, "\n  "))
+		} else {
+			c.Log("no changes to release %q", name)
+		}
+	}
+	if opts.Output == "snapshots" {
+		return fmt.Sprintf("Wrote snapshots of changed resources to %s", opts.SnapshotDir), ps.counts, err
+	}
+	if opts.Output == "html" {
+		report := &htmlReport{Release: name, Revision: releaseRevision(c, name, opts), Counts: ps.counts, Sections: ps.sections}
+		output, renderErr := report.render()
+		if renderErr != nil {
+			return "", Counts{}, errors.Wrap(renderErr, "unable to render html report")
+		}
+		if opts.OutputDir == "" {
+			return output, ps.counts, err
+		}
+		path, writeErr := writeReport(opts.OutputDir, name, output, opts.Gzip)
+		if writeErr != nil {
+			return "", Counts{}, writeErr
+		}
+		return fmt.Sprintf("Wrote report to %s", path), ps.counts, err
+	}
+	if opts.OutputDir != "" {
+		n, writeErr := writePatchFiles(opts.OutputDir, ps.entries, opts.Gzip)
+		if writeErr != nil {
+			return "", Counts{}, writeErr
+		}
+		return fmt.Sprintf("Wrote %d patch file(s) to %s", n, opts.OutputDir), ps.counts, err
+	}
+	if opts.Envelope {
+		output, envelopeErr := envelopeOutput(ps)
+		if envelopeErr != nil {
+			return "", Counts{}, envelopeErr
+		}
+		return output, ps.counts, err
+	}
+	return ps.output, ps.counts, err
+}
+
+// prepareManifests returns the manifest of the named release and the manifest
+// it would be upgraded to, along with opts completed by the policy of the
+// chart.
+func prepareManifests(ctx context.Context, c *action.Configuration, name string, ch *chart.Chart, vals map[string]interface{}, opts *Options) (string, string, *Options, error) {
+	if len(opts.PatchOnlyKinds) == 0 && ch != nil && ch.Metadata.Annotations[PatchOnlyKindsAnnotation] != "" {
+		// copy so the chart's policy does not leak into other releases
+		withPolicy := *opts
+		withPolicy.PatchOnlyKinds = strings.Split(ch.Metadata.Annotations[PatchOnlyKindsAnnotation], ",")
+		opts = &withPolicy
+	}
+
+	var originalManifest, targetManifest string
+	var err error
+	missing := false
+	if opts.Install && opts.KustomizeDir == "" {
+		if missing, err = releaseMissing(c, baseRelease(name, opts)); err != nil {
+			return "", "", nil, err
+		}
+	}
+	switch {
+	case missing && opts.Engine == "helm":
+		originalManifest, targetManifest, err = prepareHelmInstall(ctx, c, name, ch, vals, opts)
+	case missing:
+		originalManifest, targetManifest, err = prepareInstall(ctx, c, name, ch, vals, opts)
+	case opts.KustomizeDir != "":
+		originalManifest, targetManifest, err = prepareKustomize(c, baseRelease(name, opts), opts.KustomizeDir)
+	case opts.Engine == "helm":
+		originalManifest, targetManifest, err = prepareHelmUpgrade(ctx, c, name, ch, vals, opts)
+	default:
+		originalManifest, targetManifest, err = PrepareUpgrade(ctx, c, name, ch, vals, opts)
+	}
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	if opts.ValidateRender {
+		if err := validateRender(c, targetManifest); err != nil {
+			return "", "", nil, err
+		}
+	}
+	return originalManifest, targetManifest, opts, nil
+}
+
+// validateRender builds each document of the target manifest on its own and
+// reports every document that fails, along with the template it came from.
+func validateRender(c *action.Configuration, targetManifest string) error {
+	// custom resources of pending kinds cannot be built until their CRD is
+	// established
+	targetManifest, _, err := pendingCustomResources(c, targetManifest)
+	if err != nil {
+		return err
+	}
+
+	var failures []string
+	for _, doc := range splitManifests(targetManifest) {
+		if _, err := c.KubeClient.Build(bytes.NewBufferString(doc), false); err != nil {
+			source := manifestSource(doc)
+			if source == "" {
+				source = "<unknown source>"
+			}
+			failures = append(failures, fmt.Sprintf("%s: %s", source, err))
+		}
+	}
+	if len(failures) > 0 {
+		return errors.Errorf("rendered manifests failed to build:\n  %s", strings.Join(failures, "\n  "))
+	}
+	return nil
+}
+
+// createPatchset computes the patch of every object of the target manifest,
+// and finds the objects of the original manifest an upgrade would delete.
+func createPatchset(ctx context.Context, c *action.Configuration, name, originalManifest, targetManifest string, opts *Options) (*patchset, error) {
+	if opts.Offline {
+		return createOfflinePatchset(c, originalManifest, targetManifest, opts)
+	}
+
+	entries := []PatchEntry{}
+	violations := []string{}
+	descriptions := []string{}
+	// peerKeys holds the kind and namespace of each description, and
+	// unchanged the names of the unchanged resources for each of them
+	peerKeys := []string{}
+	unchanged := map[string][]string{}
+	var counts Counts
+	kinds := kindCounts{}
+	changed := namespaceKinds{}
+	limit := newDepthLimit(opts.MaxDepth)
+	report := &junitTestSuite{Name: "patchdiff"}
+	blocks := []string{}
+	unified := []string{}
+	sections := []htmlSection{}
+	deltas := []string{}
+	records := [][]string{}
+	bundle := &patchBundle{APIVersion: patchBundleAPIVersion, Kind: "PatchBundle", Patches: []patchBundleEntry{}}
+	// patchTypes counts the patched resources per patch type and reason
+	patchTypes := map[string]int{}
+	warnings := []Warning{}
+
+	original, err := c.KubeClient.Build(bytes.NewBufferString(originalManifest), false)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to build kubernetes objects from original release manifest")
+	}
+	if err := clearClusterScopedNamespaces(original); err != nil {
+		return nil, err
+	}
+	targetManifest, pending, err := pendingCustomResources(c, targetManifest)
+	if err != nil {
+		return nil, err
+	}
+	target, err := c.KubeClient.Build(bytes.NewBufferString(targetManifest), false)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to build kubernetes objects from new release manifest")
+	}
+	if err := clearClusterScopedNamespaces(target); err != nil {
+		return nil, err
+	}
+	target = append(target, pending...)
+	// annotated up front, so that created objects carry them as well
+	for _, info := range target {
+		if err := addAnnotations(info.Object, opts.PatchAnnotations); err != nil {
+			return nil, errors.Wrapf(err, "unable to add patch annotations to %s %q", info.Mapping.GroupVersionKind.Kind, info.Name)
+		}
+	}
+
+	live := newLiveFetcher(target, opts.BatchFetch)
+	for _, info := range pending {
+		live.pending[info] = true
+	}
+	diffs, err := diffTargets(ctx, c, target, original, live, opts)
+	if err != nil {
+		return nil, err
+	}
+	ignored := 0
+	var forbidden []string
+	// patchTarget records the changes to a resource of the target
+	patchTarget := func(info *resource.Info) error {
+		if !kindAllowed(opts.PatchOnlyKinds, info.Mapping.GroupVersionKind.Kind) {
+			ignored++
+			return nil
+		}
+		if !selected(opts.Include, opts.Exclude, info.Mapping.GroupVersionKind.Kind, info.Name) {
+			return nil
+		}
+
+		liveObj, err := diffs[info].live, diffs[info].liveErr
+		if apierrors.IsNotFound(err) {
+			// no patch to generate, the whole object is created
+			counts.Created++
+			kinds.of(info.Mapping.GroupVersionKind.Kind).Created++
+			changed.add(info.Namespace, info.Mapping.GroupVersionKind.Kind)
+			report.add(info, nil, nil)
+			desired, err := json.Marshal(info.Object)
+			if err != nil {
+				return errors.Wrap(err, "serializing target configuration")
+			}
+			if opts.Install {
+				entry := newPatchEntry(info, createPatchType, desired)
+				if opts.WithHashes {
+					if err := entry.addHashes(desired); err != nil {
+						return errors.Wrapf(err, "unable to hash the patch of %s %q", info.Mapping.GroupVersionKind.Kind, info.Name)
+					}
+				}
+				entries = append(entries, entry)
+			}
+			if opts.Output == "csv" {
+				records = append(records, csvRecord(info, "created", nil, createPatchType))
+			}
+			if opts.Output == "argocd" {
+				block, err := argocdBlock(info, nil, desired, limit)
+				if err != nil {
+					return err
+				}
+				blocks = append(blocks, block)
+			}
+			if opts.Output == "diff" {
+				block, err := unifiedBlock(info, nil, desired, limit)
+				if err != nil {
+					return err
+				}
+				unified = append(unified, block)
+			}
+			if opts.Output == "html" {
+				section, err := newHTMLSection(info, "created", nil, desired, limit)
+				if err != nil {
+					return err
+				}
+				sections = append(sections, section)
+			}
+			return nil
+		} else if opts.SkipForbidden && apierrors.IsForbidden(err) {
+			// the live state is unknown, so neither a create nor a patch
+			forbidden = append(forbidden, fmt.Sprintf("%s %s", info.Mapping.GroupVersionKind.Kind, strings.TrimPrefix(info.Namespace+"/"+info.Name, "/")))
+			return nil
+		}
+
+		originalInfo := findObject(original, info)
+		if originalInfo == nil {
+			return fmt.Errorf("could not find %q", info.Name)
+		}
+
+		patch, patchType := diffs[info].patch, diffs[info].patchType
+
+		if opts.ExplainPatchType {
+			patchType, reason := patchStrategy(kube.AsVersioned(info))
+			patchTypes[patchTypeName(patchType, reason)]++
+		}
+
+		kind := info.Mapping.GroupVersionKind.Kind
+		stripped, immutable, err := withoutImmutableChanges(kind, patch)
+		if err != nil {
+			return errors.Wrapf(err, "unable to analyze patch for %s %q", kind, info.Name)
+		}
+		// with --force the object is recreated, so every change applies
+		replaced := opts.Force && len(immutable) > 0
+		var notes []string
+		if replaced {
+			notes = append(notes, fmt.Sprintf("replaced (deleted and recreated), since %s cannot change in place", strings.Join(immutable, ", ")))
+			c.Log("%s %q: replaced (deleted and recreated), since %s cannot change in place", kind, info.Name, strings.Join(immutable, ", "))
+			warnings = append(warnings, replacedWarning(kind, info.Name, immutable))
+		} else {
+			patch = stripped
+			for _, field := range immutable {
+				notes = append(notes, fmt.Sprintf("changes to %s will not apply (immutable on %s)", field, kind))
+				c.Log("%s %q: changes to %s will not apply (immutable on %s)", kind, info.Name, field, kind)
+			}
+			warnings = append(warnings, immutableWarnings(kind, info.Name, immutable)...)
+		}
+		// the notes so far are all about immutable fields, which fail the
+		// test case of the resource in junit output
+		failures := append([]string{}, notes...)
+		if isKept(info) && (!isEmptyPatch(patch) || len(notes) > 0) {
+			// keep only protects the object from deletion, not from updates
+			notes = append(notes, fmt.Sprintf("still updated, although %s=%s keeps it on uninstall", kube.ResourcePolicyAnno, kube.KeepPolicy))
+			c.Log("%s %q: still updated, although %s=%s keeps it on uninstall", kind, info.Name, kube.ResourcePolicyAnno, kube.KeepPolicy)
+		}
+
+		if opts.FreshnessWindow > 0 {
+			modified, err := lastModified(liveObj)
+			if err != nil {
+				return errors.Wrapf(err, "unable to read managed fields of %s %q", kind, info.Name)
+			}
+			if age := time.Since(modified); age < opts.FreshnessWindow {
+				notes = append(notes, fmt.Sprintf("live state changed %s ago, so it may still be changing", age.Round(time.Second)))
+				c.Log("%s %q: live state changed %s ago, so it may still be changing", kind, info.Name, age.Round(time.Second))
+			}
+		}
+
+		problems, err := protectedChanges(kind, info.Name, patch, opts.FailOnChangeTo)
+		if err != nil {
+			return errors.Wrapf(err, "unable to analyze patch for %s %q", kind, info.Name)
+		}
+		violations = append(violations, problems...)
+		report.add(info, patch, append(failures, problems...))
+
+		if opts.CheckFieldOwnership && !isEmptyPatch(patch) {
+			paths, err := patchPaths(patch)
+			if err != nil {
+				return errors.Wrapf(err, "unable to analyze patch for %s %q", kind, info.Name)
+			}
+			conflicts, err := ownershipConflicts(liveObj, paths, opts.FieldManager)
+			if err != nil {
+				return errors.Wrapf(err, "unable to read managed fields of %s %q", kind, info.Name)
+			}
+			for _, conflict := range conflicts {
+				c.Log("%s %q: %s", kind, info.Name, conflict)
+			}
+		}
+
+		if isEmptyPatch(patch) {
+			counts.Unchanged++
+			kinds.of(info.Mapping.GroupVersionKind.Kind).Unchanged++
+		} else {
+			counts.Patched++
+			kinds.of(info.Mapping.GroupVersionKind.Kind).Patched++
+			changed.add(info.Namespace, info.Mapping.GroupVersionKind.Kind)
+		}
+
+		if opts.DiffFormat == "semantic" && (!isEmptyPatch(patch) || len(notes) > 0) {
+			var sentences []string
+			if !isEmptyPatch(patch) {
+				if sentences, err = describeChange(originalInfo.Object, info.Object, patch); err != nil {
+					return errors.Wrapf(err, "unable to describe changes to %s %q", kind, info.Name)
+				}
+			}
+			sentences = append(sentences, notes...)
+			descriptions = append(descriptions, fmt.Sprintf("%s %q:\n  - %s", kind, info.Name, strings.Join(sentences, "\n  - ")))
+			peerKeys = append(peerKeys, fetchKey(info))
+		} else if isEmptyPatch(patch) && len(notes) == 0 {
+			unchanged[fetchKey(info)] = append(unchanged[fetchKey(info)], info.Name)
+		}
+
+		if opts.Output == "patchbundle" && (replaced || !isEmptyPatch(patch)) {
+			var entry patchBundleEntry
+			if replaced {
+				desired, err := json.Marshal(info.Object)
+				if err != nil {
+					return errors.Wrap(err, "serializing target configuration")
+				}
+				entry = newPatchBundleEntry(info, replacePatchType, desired)
+			} else {
+				entry = newPatchBundleEntry(info, patchType, patch)
+			}
+			if opts.WithRollback {
+				liveData, err := json.Marshal(liveObj)
+				if err != nil {
+					return errors.Wrap(err, "serializing live configuration")
+				}
+				if replaced {
+					// replacing with the live object undoes a replace
+					entry.Rollback = json.RawMessage(liveData)
+				} else if entry.Rollback, err = rollbackPatch(info, liveData, patch, patchType); err != nil {
+					return errors.Wrapf(err, "unable to create rollback patch for %s %q", kind, info.Name)
+				}
+			}
+			bundle.Patches = append(bundle.Patches, entry)
+		}
+
+		if opts.Output == "delta" && !isEmptyPatch(patch) {
+			liveData, err := json.Marshal(liveObj)
+			if err != nil {
+				return errors.Wrap(err, "serializing live configuration")
+			}
+			lines, err := deltaLines(patch, liveData, opts.MaxValueWidth, limit)
+			if err != nil {
+				return errors.Wrapf(err, "unable to analyze patch for %s %q", kind, info.Name)
+			}
+			header := fmt.Sprintf("%s %s", kind, strings.TrimPrefix(info.Namespace+"/"+info.Name, "/"))
+			if replaced {
+				header += " (replaced)"
+			}
+			deltas = append(deltas, fmt.Sprintf("%s:\n  %s", header, strings.Join(lines, "\n  ")))
+		}
+
+		if opts.Output == "csv" && (replaced || !isEmptyPatch(patch)) {
+			paths, err := patchPaths(patch)
+			if err != nil {
+				return errors.Wrapf(err, "unable to analyze patch for %s %q", kind, info.Name)
+			}
+			switch {
+			case replaced:
+				records = append(records, csvRecord(info, "replaced", paths, replacePatchType))
+			case opts.PatchType == "json":
+				records = append(records, csvRecord(info, "modified", paths, types.JSONPatchType))
+			default:
+				records = append(records, csvRecord(info, "modified", paths, patchType))
+			}
+		}
+
+		if opts.Output == "argocd" && !isEmptyPatch(patch) {
+			liveData, err := json.Marshal(liveObj)
+			if err != nil {
+				return errors.Wrap(err, "serializing live configuration")
+			}
+			desired, err := applyPatch(info, liveData, patch, patchType)
+			if err != nil {
+				return errors.Wrapf(err, "unable to apply patch to live %s %q", kind, info.Name)
+			}
+			block, err := argocdBlock(info, liveData, desired, limit)
+			if err != nil {
+				return err
+			}
+			blocks = append(blocks, block)
+		}
+
+		if opts.Output == "diff" && !isEmptyPatch(patch) {
+			block, err := unifiedBlock(info, diffs[info].oldData, diffs[info].newData, limit)
+			if err != nil {
+				return err
+			}
+			unified = append(unified, block)
+		}
+		if opts.Output == "html" && !isEmptyPatch(patch) {
+			change := "modified"
+			if replaced {
+				change = "replaced"
+			}
+			section, err := newHTMLSection(info, change, diffs[info].oldData, diffs[info].newData, limit)
+			if err != nil {
+				return err
+			}
+			sections = append(sections, section)
+		}
+
+		if opts.Output == "snapshots" && !isEmptyPatch(patch) {
+			if err := writeSnapshot(opts.SnapshotDir, originalInfo, info, opts.Gzip); err != nil {
+				return err
+			}
+		}
+
+		// append patch to patchset, leaving out unchanged resources
+		var entry PatchEntry
+		switch {
+		case replaced:
+			// the server rejects a patch of immutable fields, so the entry
+			// is the whole object that replaces the live one
+			desired, err := json.Marshal(info.Object)
+			if err != nil {
+				return errors.Wrap(err, "serializing target configuration")
+			}
+			entry = newPatchEntry(info, replacePatchType, desired)
+		case isEmptyPatch(patch):
+			return nil
+		case opts.PatchType == "json":
+			// the operations turn the live object into what the patch
+			// makes of it, so they apply with kubectl patch --type=json
+			liveData, err := json.Marshal(liveObj)
+			if err != nil {
+				return errors.Wrap(err, "serializing live configuration")
+			}
+			desired, err := applyPatch(info, liveData, patch, patchType)
+			if err != nil {
+				return errors.Wrapf(err, "unable to apply patch to live %s %q", kind, info.Name)
+			}
+			ops, err := jsonPatchOps(liveData, desired, opts.WithTests)
+			if err != nil {
+				return errors.Wrapf(err, "unable to create JSON patch for %s %q", kind, info.Name)
+			}
+			if isEmptyPatch(ops) {
+				return nil
+			}
+			entry = newPatchEntry(info, types.JSONPatchType, ops)
+		default:
+			entry = newPatchEntry(info, patchType, patch)
+		}
+		if opts.WithHashes {
+			target, err := json.Marshal(info.Object)
+			if err != nil {
+				return errors.Wrap(err, "serializing target configuration")
+			}
+			if err := entry.addHashes(target); err != nil {
+				return errors.Wrapf(err, "unable to hash the patch of %s %q", kind, info.Name)
+			}
+		}
+		entries = append(entries, entry)
+		return nil
+	}
+
+	// deleteOriginal records the delete of a resource of the release
+	deleteOriginal := func(info *resource.Info) error {
+		if hookAnnotation(info) != "" {
+			// helm upgrade leaves the hooks of earlier releases alone
+			return nil
+		}
+
+		kind := info.Mapping.GroupVersionKind.Kind
+		if !kindAllowed(opts.PatchOnlyKinds, kind) {
+			ignored++
+			return nil
+		}
+		if !selected(opts.Include, opts.Exclude, kind, info.Name) {
+			return nil
+		}
+		if isKept(info) {
+			c.Log("%s %q: not deleted, since %s=%s keeps it", kind, info.Name, kube.ResourcePolicyAnno, kube.KeepPolicy)
+			return nil
+		}
+
+		liveObj, err := live.Get(ctx, info)
+		if apierrors.IsNotFound(err) {
+			// already gone, so there is nothing to delete
+			c.Log("%s %q: not deleted, since it is already gone from the cluster", kind, info.Name)
+			return nil
+		} else if opts.SkipForbidden && apierrors.IsForbidden(err) {
+			forbidden = append(forbidden, fmt.Sprintf("%s %s", kind, strings.TrimPrefix(info.Namespace+"/"+info.Name, "/")))
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "unable to get live state of %s %q", kind, info.Name)
+		}
+		liveData, err := json.Marshal(liveObj)
+		if err != nil {
+			return errors.Wrap(err, "serializing live configuration")
+		}
+
+		counts.Deleted++
+
+		kinds.of(info.Mapping.GroupVersionKind.Kind).Deleted++
+		changed.add(info.Namespace, info.Mapping.GroupVersionKind.Kind)
+		entries = append(entries, newPatchEntry(info, deletePatchType, nil))
+		report.addDeleted(info)
+		if opts.DiffFormat == "semantic" {
+			descriptions = append(descriptions, fmt.Sprintf("%s %q:\n  - deleted", kind, info.Name))
+			peerKeys = append(peerKeys, fetchKey(info))
+		}
+		if opts.Output == "csv" {
+			records = append(records, csvRecord(info, "deleted", nil, deletePatchType))
+		}
+		if opts.Output == "delta" {
+			deltas = append(deltas, fmt.Sprintf("%s %s (deleted)", kind, strings.TrimPrefix(info.Namespace+"/"+info.Name, "/")))
+		}
+		if opts.Output == "patchbundle" {
+			entry := newPatchBundleEntry(info, deletePatchType, nil)
+			if opts.WithRollback {
+				// recreating the live object undoes a delete
+				entry.Rollback = json.RawMessage(liveData)
+			}
+			bundle.Patches = append(bundle.Patches, entry)
+		}
+		if opts.Output == "argocd" {
+			block, err := argocdBlock(info, liveData, nil, limit)
+			if err != nil {
+				return err
+			}
+			blocks = append(blocks, block)
+		}
+		if opts.Output == "diff" {
+			current, err := json.Marshal(info.Object)
+			if err != nil {
+				return errors.Wrap(err, "serializing current configuration")
+			}
+			block, err := unifiedBlock(info, current, nil, limit)
+			if err != nil {
+				return err
+			}
+			unified = append(unified, block)
+		}
+		if opts.Output == "html" {
+			current, err := json.Marshal(info.Object)
+			if err != nil {
+				return errors.Wrap(err, "serializing current configuration")
+			}
+			section, err := newHTMLSection(info, "deleted", current, nil, limit)
+			if err != nil {
+				return err
+			}
+			sections = append(sections, section)
+		}
+		return nil
+	}
+
+	// objects of the release the target no longer renders are deleted. They
+	// are matched by group, kind, namespace and name, so moving an object to
+	// another template is not a delete.
+	resources := append(kube.ResourceList{}, target...)
+	deleted := map[*resource.Info]bool{}
+	for _, info := range original {
+		if findObject(target, info) == nil {
+			resources = append(resources, info)
+			deleted[info] = true
+		}
+	}
+	// every output lists resources in the same order, however the manifests
+	// order them
+	sortResources(resources)
+	for _, info := range resources {
+		if deleted[info] {
+			err = deleteOriginal(info)
+		} else {
+			err = patchTarget(info)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.ExplainPatchType {
+		c.Log("patch types: %s", describePatchTypes(patchTypes))
+	}
+	limit.note(c)
+	if len(forbidden) > 0 {
+		c.Log("unable to read (forbidden), skipped %d resource(s):\n  %s", len(forbidden), strings.Join(forbidden, "\n  "))
+	}
+	if ignored > 0 {
+		c.Log("%d resource(s) ignored by policy, only %s are diffed", ignored, strings.Join(opts.PatchOnlyKinds, ", "))
+	}
+
+	sortEntries(entries)
+	output, err := formatEntries(entries, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.DiffFormat == "semantic" {
+		if opts.WithContextResources {
+			for i, key := range peerKeys {
+				if peers := unchanged[key]; len(peers) > 0 {
+					sort.Strings(peers)
+					descriptions[i] += fmt.Sprintf("\n  unchanged peers: %s", strings.Join(peers, ", "))
+				}
+			}
+		}
+		output = strings.Join(descriptions, "\n")
+	}
+	if opts.CountOnly {
+		output = strconv.Itoa(counts.Created + counts.Patched + counts.Deleted)
+	}
+	if opts.Output == "patchbundle" {
+		bundle.Metadata = patchBundleMetadata{Release: name, ChartDigest: opts.ChartDigest, GeneratedAt: time.Now().UTC().Format(time.RFC3339)}
+		if c.Capabilities != nil {
+			bundle.Metadata.KubeVersion = c.Capabilities.KubeVersion.String()
+			bundle.Metadata.APIVersions = c.Capabilities.APIVersions
+		}
+		data, err := json.MarshalIndent(bundle, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		output = string(data)
+	}
+	if opts.Output == "delta" {
+		output = strings.Join(deltas, "\n")
+	}
+	if opts.Output == "fleet-summary" {
+		output = changed.fleetSummary()
+	}
+	if opts.Output == "csv" {
+		if output, err = csvOutput(records); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Output == "argocd" {
+		output = strings.TrimPrefix(strings.Join(blocks, ""), "\n")
+	}
+	if opts.Output == "diff" {
+		output = strings.TrimSuffix(strings.Join(unified, ""), "\n")
+	}
+	if opts.Output == "junit" {
+		if output, err = report.xml(); err != nil {
+			return nil, err
+		}
+	}
+	ps := &patchset{output: output, entries: entries, counts: counts, kinds: kinds, warnings: warnings, sections: sections}
+	if opts.ExplainPatchType {
+		ps.patchTypes = patchTypes
+	}
+	if len(violations) > 0 {
+		return ps, errors.Errorf("patches change protected paths:\n  %s", strings.Join(violations, "\n  "))
+	}
+	return ps, nil
+}
+
+// protectedChanges describes each change patch makes to one of the protected
+// JSON pointers.
+func protectedChanges(kind, name string, patch []byte, protected []string) ([]string, error) {
+	if len(protected) == 0 || isEmptyPatch(patch) {
+		return nil, nil
+	}
+	paths, err := patchPaths(patch)
+	if err != nil {
+		return nil, err
+	}
+	var problems []string
+	for _, path := range paths {
+		for _, p := range protected {
+			if pathTouches(path, p) {
+				problems = append(problems, fmt.Sprintf("%s %q changes %s", kind, name, path))
+			}
+		}
+	}
+	return problems, nil
+}
+
+// DefaultConcurrency is the number of resources diffed in parallel when
+// Options.Concurrency is not set.
+const DefaultConcurrency = 8
+
+// targetDiff is the live state of a target resource and its patch.
+type targetDiff struct {
+	live      runtime.Object
+	liveErr   error
+	patch     []byte
+	patchType types.PatchType
+	// oldData and newData are the release and target configurations the
+	// patch was computed from.
+	oldData []byte
+	newData []byte
+}
+
+// diffTargets looks up the live state of every diffed target resource and
+// computes its patch, with up to opts.Concurrency resources at a time. These
+// are the API round trips of a diff, and they don't depend on each other.
+// Resources that do not exist or cannot be read have no patch.
+func diffTargets(ctx context.Context, c *action.Configuration, target, original kube.ResourceList, live *liveFetcher, opts *Options) (map[*resource.Info]*targetDiff, error) {
+	concurrency := opts.Concurrency
+	if concurrency == 0 {
+		concurrency = DefaultConcurrency
+	}
+
+	diffs := make(map[*resource.Info]*targetDiff, len(target))
+	for _, info := range target {
+		if kindAllowed(opts.PatchOnlyKinds, info.Mapping.GroupVersionKind.Kind) && selected(opts.Include, opts.Exclude, info.Mapping.GroupVersionKind.Kind, info.Name) {
+			diffs[info] = &targetDiff{}
+		}
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, concurrency)
+	for info, d := range diffs {
+		info, d := info, d
+		g.Go(func() error {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			d.live, d.liveErr = live.Get(ctx, info)
+			if apierrors.IsNotFound(d.liveErr) || (opts.SkipForbidden && apierrors.IsForbidden(d.liveErr)) {
+				return nil
+			} else if d.liveErr != nil {
+				return errors.Wrapf(d.liveErr, "unable to get data for current object %s/%s", info.Namespace, info.Name)
+			}
+			originalInfo := findObject(original, info)
+			if originalInfo == nil {
+				return fmt.Errorf("could not find %q", info.Name)
+			}
+			var err error
+			d.patch, d.patchType, d.oldData, d.newData, err = createPatch(originalInfo.Object, info, d.live, opts, c.Log)
+			return err
+		})
+	}
+	return diffs, g.Wait()
+}
+
+// findObject returns the object of list with the group, kind, namespace and
+// name of info, or nil if there is none. Unlike kube.ResourceList.Get, which
+// only compares kinds, objects of the same kind in different API groups are
+// told apart, while different versions of a group are the same object.
+func findObject(list kube.ResourceList, info *resource.Info) *resource.Info {
+	gk := info.Mapping.GroupVersionKind.GroupKind()
+	for _, i := range list {
+		if i.Mapping.GroupVersionKind.GroupKind() == gk && i.Namespace == info.Namespace && i.Name == info.Name {
+			return i
+		}
+	}
+	return nil
+}
+
+// upgradeHookEvents are the hook events helm upgrade runs, in order.
+var upgradeHookEvents = []release.HookEvent{release.HookPreUpgrade, release.HookPostUpgrade}
+
+// logUpgradeHooks notes how many of hooks an upgrade runs for each event,
+// since hooks are not part of the diff unless IncludeHooks is set.
+func logUpgradeHooks(c *action.Configuration, hooks []*release.Hook) {
+	var parts []string
+	for _, event := range upgradeHookEvents {
+		n := 0
+		for _, h := range hooks {
+			for _, e := range h.Events {
+				if e == event {
+					n++
+					break
+				}
+			}
+		}
+		if n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, event))
+		}
+	}
+	if len(parts) > 0 {
+		c.Log("the upgrade would run hooks: %s", strings.Join(parts, ", "))
+	}
+}
+
+// hookManifests returns the manifests of hooks as a multi-document manifest,
+// to be diffed along with the release manifest. Test hooks are left out, since
+// an upgrade does not run them.
+func hookManifests(hooks []*release.Hook) string {
+	var b strings.Builder
+	for _, h := range hooks {
+		if !isTestHook(h) {
+			fmt.Fprintf(&b, "---\n# Source: %s\n%s\n", h.Path, h.Manifest)
+		}
+	}
+	return b.String()
+}
+
+// formatEntries formats patch entries as json or raw output.
+func formatEntries(entries []PatchEntry, opts *Options) (string, error) {
+	var data []byte
+	var err error
+	if opts.Output == "raw" {
+		// deletes have no patch to print
+		patches := []json.RawMessage{}
+		for _, e := range entries {
+			if e.PatchType != deletePatchType {
+				patches = append(patches, e.Patch)
+			}
+		}
+		data, err = json.Marshal(patches)
+	} else {
+		data, err = json.Marshal(entries)
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "unable to serialize patchset")
+	}
+	return string(data), nil
+}
+
+// splitManifests splits a multi-document manifest into its documents, in the
+// order they appear.
+func splitManifests(manifest string) []string {
+	docs := releaseutil.SplitManifests(manifest)
+	keys := make([]string, 0, len(docs))
+	for k := range docs {
+		keys = append(keys, k)
+	}
+	sort.Sort(releaseutil.BySplitManifestsOrder(keys))
+
+	ordered := make([]string, 0, len(keys))
+	for _, k := range keys {
+		ordered = append(ordered, docs[k])
+	}
+	return ordered
+}
+
+// pendingCustomResources splits from manifest the custom resources whose
+// kind is defined by a CustomResourceDefinition in the same manifest but is
+// not served by the cluster yet. Such objects cannot exist until the upgrade
+// establishes the CRD, so they are created, with no live state to look up.
+// The kube client cannot build them either, so they are returned mapped by
+// their CRD, along with the manifest of the other objects.
+func pendingCustomResources(c *action.Configuration, manifest string) (string, kube.ResourceList, error) {
+	type object struct {
+		APIVersion string `json:"apiVersion"`
+		Kind       string `json:"kind"`
+		Metadata   struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"metadata"`
+		Spec struct {
+			Group string `json:"group"`
+			Names struct {
+				Kind   string `json:"kind"`
+				Plural string `json:"plural"`
+			} `json:"names"`
+			Scope string `json:"scope"`
+		} `json:"spec"`
+	}
+
+	docs := splitManifests(manifest)
+	objects := make([]object, len(docs))
+	definitions := map[schema.GroupKind]object{}
+	for i, doc := range docs {
+		if err := yaml.Unmarshal([]byte(doc), &objects[i]); err != nil {
+			return "", nil, errors.Wrap(err, "unable to parse new release manifest")
+		}
+		if objects[i].Kind == "CustomResourceDefinition" {
+			definitions[schema.GroupKind{Group: objects[i].Spec.Group, Kind: objects[i].Spec.Names.Kind}] = objects[i]
+		}
+	}
+	if len(definitions) == 0 {
+		return manifest, nil, nil
+	}
+
+	mapper, err := c.RESTClientGetter.ToRESTMapper()
+	if err != nil {
+		return "", nil, err
+	}
+
+	b := bytes.NewBuffer(nil)
+	var pending kube.ResourceList
+	for i, doc := range docs {
+		gvk := schema.FromAPIVersionAndKind(objects[i].APIVersion, objects[i].Kind)
+		crd, defined := definitions[gvk.GroupKind()]
+		if !defined {
+			fmt.Fprintf(b, "---\n%s\n", doc)
+			continue
+		}
+		if _, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version); !meta.IsNoMatchError(err) {
+			fmt.Fprintf(b, "---\n%s\n", doc)
+			continue
+		}
+		c.Log("%s %q will be created once its CustomResourceDefinition is established, so its live state is not looked up", gvk.Kind, objects[i].Metadata.Name)
+
+		obj := &unstructured.Unstructured{}
+		if err := yaml.Unmarshal([]byte(doc), &obj.Object); err != nil {
+			return "", nil, errors.Wrap(err, "unable to parse new release manifest")
+		}
+		mapping := &meta.RESTMapping{
+			Resource:         gvk.GroupVersion().WithResource(crd.Spec.Names.Plural),
+			GroupVersionKind: gvk,
+			Scope:            meta.RESTScopeNamespace,
+		}
+		namespace := objects[i].Metadata.Namespace
+		if crd.Spec.Scope == string(apiextv1.ClusterScoped) {
+			mapping.Scope = meta.RESTScopeRoot
+			namespace = ""
+		} else if namespace == "" {
+			namespace = installNamespace(c)
+		}
+		obj.SetNamespace(namespace)
+		pending = append(pending, &resource.Info{
+			Mapping:   mapping,
+			Namespace: namespace,
+			Name:      objects[i].Metadata.Name,
+			Object:    obj,
+		})
+	}
+	return b.String(), pending, nil
+}
+
+// PrepareUpgrade returns the manifest of the named release and the manifest
+// of the chart rendered for upgrading it. Requests to the cluster are
+// cancelled along with ctx.
+func PrepareUpgrade(ctx context.Context, c *action.Configuration, name string, chart *chart.Chart, vals map[string]interface{}, opts *Options) (string, string, error) {
+	if chart == nil {
+		return "", "", errors.New("missing chart")
+	}
+
+	// the manifest comes from the base release, while templates still see
+	// the name being upgraded
+	lastRelease, currentRelease, err := FindReleases(c, baseRelease(name, opts))
+	if err != nil {
+		return "", "", err
+	}
+	originalManifest, originalHooks := currentRelease.Manifest, currentRelease.Hooks
+	if opts.Revision > 0 {
+		if opts.Revision > lastRelease.Version {
+			return "", "", errors.Errorf("release %q has no revision %d: its current revision is %d", lastRelease.Name, opts.Revision, lastRelease.Version)
+		}
+		rel, err := c.Releases.Get(lastRelease.Name, opts.Revision)
+		if err != nil {
+			return "", "", errors.Wrapf(err, "unable to get revision %d of release %q", opts.Revision, lastRelease.Name)
+		}
+		originalManifest, originalHooks = rel.Manifest, rel.Hooks
+	}
+
+	chart, vals, err = upgradeValues(chart, currentRelease, vals, opts)
+	if err != nil {
+		return "", "", err
+	}
+	if err := chartutil.ProcessDependencies(chart, vals); err != nil {
+		return "", "", err
+	}
+
+	// Increment revision count. This is passed to templates, and also stored on
+	// the release object. It follows the last release even when diffing
+	// against an older revision, as the next upgrade would.
+	revision := lastRelease.Version + 1
+
+	options := chartutil.ReleaseOptions{
+		Name:      name,
+		Namespace: currentRelease.Namespace,
+		Revision:  revision,
+		IsUpgrade: true,
+	}
+
+	if err := GetCapabilities(ctx, c); err != nil {
+		return "", "", err
+	}
+	valuesToRender, err := chartutil.ToRenderValues(chart, vals, options, c.Capabilities)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := dumpValues(valuesToRender, opts); err != nil {
+		return "", "", err
+	}
+
+	manifestDoc, hooks, err := renderResources(ctx, c, chart, valuesToRender, opts)
+	if err != nil {
+		return "", "", err
+	}
+
+	crds, err := chartCRDs(ctx, c, chart, opts)
+	if err != nil {
+		return "", "", err
+	}
+	targetManifest := crds + manifestDoc.String()
+
+	logUpgradeHooks(c, hooks)
+	if opts.IncludeTestHooks {
+		targetManifest += testHookManifests(hooks)
+	}
+	if opts.IncludeHooks {
+		return originalManifest + hookManifests(originalHooks), targetManifest + hookManifests(hooks), nil
+	}
+	return originalManifest, targetManifest, nil
+}
+
+// baseRelease returns the name of the release whose manifest the release
+// name is diffed against.
+func baseRelease(name string, opts *Options) string {
+	if opts.BaseReleaseName != "" {
+		return opts.BaseReleaseName
+	}
+	return name
+}
+
+// upgradeValues returns the chart and values an upgrade of current renders
+// with, decided as helm upgrade decides them. ResetValues uses only vals.
+// ReuseValues merges vals over the values of current, with the chart defaults
+// current was rendered with. Otherwise the values of current are reused only
+// when vals is empty.
+func upgradeValues(ch *chart.Chart, current *release.Release, vals map[string]interface{}, opts *Options) (*chart.Chart, map[string]interface{}, error) {
+	switch {
+	case opts.ResetValues:
+		return ch, vals, nil
+	case opts.ReuseValues:
+		if current.Chart == nil {
+			return nil, nil, errors.Errorf("release %q has no chart to reuse values from", current.Name)
+		}
+		oldVals, err := chartutil.CoalesceValues(current.Chart, current.Config)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to rebuild old values")
+		}
+		// coalescing changes the values it merges into, and vals may be
+		// shared with other releases
+		copied, err := copystructure.Copy(vals)
+		if err != nil {
+			return nil, nil, err
+		}
+		merged := chartutil.CoalesceTables(copied.(map[string]interface{}), current.Config)
+		withOldDefaults := *ch
+		withOldDefaults.Values = oldVals
+		return &withOldDefaults, merged, nil
+	case len(vals) == 0 && len(current.Config) > 0:
+		return ch, current.Config, nil
+	}
+	return ch, vals, nil
+}
+
+// prepareHelmUpgrade returns the manifest of the current release and the
+// manifest produced by a dry-run of Helm's own upgrade action.
+func prepareHelmUpgrade(ctx context.Context, c *action.Configuration, name string, ch *chart.Chart, vals map[string]interface{}, opts *Options) (string, string, error) {
+	_, currentRelease, err := FindReleases(c, name)
+	if err != nil {
+		return "", "", err
+	}
+
+	upgrade := action.NewUpgrade(c)
+	upgrade.DryRun = true
+	upgrade.Namespace = currentRelease.Namespace
+	upgrade.PostRenderer = opts.PostRenderer
+	upgrade.ReuseValues = opts.ReuseValues
+	upgrade.ResetValues = opts.ResetValues
+	var upgradedRelease *release.Release
+	err = withContext(ctx, func() error {
+		var err error
+		upgradedRelease, err = upgrade.Run(name, ch, vals)
+		return err
+	})
+	if err != nil {
+		return "", "", errors.Wrap(err, "helm upgrade dry-run failed")
+	}
+	crds, err := chartCRDs(ctx, c, ch, opts)
+	if err != nil {
+		return "", "", err
+	}
+	targetManifest := crds + upgradedRelease.Manifest
+
+	logUpgradeHooks(c, upgradedRelease.Hooks)
+	if opts.IncludeTestHooks {
+		targetManifest += testHookManifests(upgradedRelease.Hooks)
+	}
+	if opts.IncludeHooks {
+		return currentRelease.Manifest + hookManifests(currentRelease.Hooks), targetManifest + hookManifests(upgradedRelease.Hooks), nil
+	}
+	return currentRelease.Manifest, targetManifest, nil
+}
+
+// prepareKustomize returns the manifest of the current release and the output
+// of building the kustomization in dir.
+func prepareKustomize(c *action.Configuration, name string, dir string) (string, string, error) {
+	_, currentRelease, err := FindReleases(c, name)
+	if err != nil {
+		return "", "", err
+	}
+
+	b := bytes.NewBuffer(nil)
+	if err := kustomize.RunKustomizeBuild(b, fs.MakeRealFS(), dir); err != nil {
+		return "", "", errors.Wrapf(err, "unable to build kustomization %s", dir)
+	}
+	return currentRelease.Manifest, b.String(), nil
+}
+
+// FindReleases returns the last non-deleted release with the given name along
+// with the release a new upgrade would be applied against.
+func FindReleases(c *action.Configuration, name string) (*release.Release, *release.Release, error) {
+	// finds the last non-deleted release with the given name
+	lastRelease, err := c.Releases.Last(name)
+	if err != nil {
+		// to keep existing behavior of returning the "%q has no deployed releases" error when an existing release does not exist
+		if errors.Is(err, driver.ErrReleaseNotFound) {
+			return nil, nil, driver.NewErrNoDeployedReleases(name)
+		}
+		return nil, nil, err
+	}
+
+	var currentRelease *release.Release
+	if lastRelease.Info.Status == release.StatusDeployed {
+		// no need to retrieve the last deployed release from storage as the last release is deployed
+		currentRelease = lastRelease
+	} else {
+		// finds the deployed release with the given name
+		currentRelease, err = c.Releases.Deployed(name)
+		if err != nil {
+			if errors.Is(err, driver.ErrNoDeployedReleases) &&
+				(lastRelease.Info.Status == release.StatusFailed || lastRelease.Info.Status == release.StatusSuperseded) {
+				currentRelease = lastRelease
+			} else {
+				return nil, nil, err
+			}
+		}
+	}
+
+	return lastRelease, currentRelease, nil
+}
+
+// GetCapabilities fills in c.Capabilities from discovery information, unless
+// it is already set. The server version is requested with ctx, and the
+// discovery of API versions, which takes no context, is abandoned once ctx is
+// done.
+func GetCapabilities(ctx context.Context, c *action.Configuration) error {
+	if c.Capabilities != nil {
+		return nil
+	}
+	caps, _, err := discoverCapabilities(ctx, c)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	c.Capabilities = caps
+	return nil
+}
+
+// discoverCapabilities returns the capabilities of the cluster of c, along
+// with the warnings it logged.
+func discoverCapabilities(ctx context.Context, c *action.Configuration) (*chartutil.Capabilities, []Warning, error) {
+	dc, err := c.RESTClientGetter.ToDiscoveryClient()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not get Kubernetes discovery client")
+	}
+	// force a discovery cache invalidation to always fetch the latest server version/capabilities.
+	dc.Invalidate()
+	kubeVersion, err := serverVersion(ctx, dc)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not get server version from Kubernetes")
+	}
+	// Issue #6361:
+	// Client-Go emits an error when an API service is registered but unimplemented.
+	// We trap that error here and print a warning. But since the discovery client continues
+	// building the API object, it is correctly populated with all valid APIs.
+	// See https://github.com/kubernetes/kubernetes/issues/72051#issuecomment-521157642
+	var apiVersions chartutil.VersionSet
+	var warnings []Warning
+	err = withContext(ctx, func() error {
+		var err error
+		apiVersions, err = action.GetVersionSet(dc)
+		return err
+	})
+	switch {
+	case err == nil:
+	case ctx.Err() != nil:
+		// abandoned, so apiVersions may still be written to
+		return nil, nil, err
+	case discovery.IsGroupDiscoveryFailedError(err):
+		c.Log("WARNING: The Kubernetes server has an orphaned API service. Server reports: %s", err)
+		c.Log("WARNING: To fix this, kubectl delete apiservice <service-name>")
+		warnings = append(warnings, Warning{Code: OrphanedAPIServiceWarning, Message: fmt.Sprintf("the Kubernetes server has an orphaned API service: %s", err)})
+	default:
+		return nil, nil, errors.Wrap(err, "could not get apiVersions from Kubernetes")
+	}
+
+	return &chartutil.Capabilities{
+		APIVersions: apiVersions,
+		KubeVersion: chartutil.KubeVersion{
+			Version: kubeVersion.GitVersion,
+			Major:   kubeVersion.Major,
+			Minor:   kubeVersion.Minor,
+		},
+	}, warnings, nil
+}
+
+// dumpValues writes the coalesced values to opts.DumpValues, if set, exactly
+// as the template engine sees them.
+func dumpValues(valuesToRender chartutil.Values, opts *Options) error {
+	if opts.DumpValues == nil {
+		return nil
+	}
+	data, err := valuesToRender.YAML()
+	if err != nil {
+		return errors.Wrap(err, "unable to serialize values")
+	}
+	fmt.Fprintf(opts.DumpValues, "---\n# Computed values\n%s", data)
+	return nil
+}
+
+func renderResources(ctx context.Context, c *action.Configuration, ch *chart.Chart, values chartutil.Values, opts *Options) (*bytes.Buffer, []*release.Hook, error) {
+	b := bytes.NewBuffer(nil)
+
+	err := GetCapabilities(ctx, c)
+	if err != nil {
+		return b, nil, err
+	}
+
+	if ch.Metadata.KubeVersion != "" {
+		if !chartutil.IsCompatibleRange(ch.Metadata.KubeVersion, c.Capabilities.KubeVersion.String()) {
+			return b, nil, errors.Errorf("chart requires kubeVersion: %s which is incompatible with Kubernetes %s", ch.Metadata.KubeVersion, c.Capabilities.KubeVersion.String())
+		}
+	}
+
+	var files map[string]string
+	switch {
+	case opts.Strict:
+		// the engine's client config cannot be set from outside the package,
+		// so lookup finds nothing in strict mode
+		files, err = engine.Engine{Strict: true}.Render(ch, values)
+	case opts.Offline:
+		// there is no cluster for lookup to query, as with helm template
+		files, err = engine.Render(ch, values)
+	default:
+		var config *rest.Config
+		if config, err = c.RESTClientGetter.ToRESTConfig(); err != nil {
+			return b, nil, err
+		}
+		files, err = engine.RenderWithClient(ch, values, config)
+	}
+	if err != nil {
+		return b, nil, err
+	}
+
+	hooks, err := writeManifests(b, files, c.Capabilities.APIVersions)
+	if err != nil {
+		return b, nil, err
+	}
+	if opts.PostRenderer != nil {
+		// like helm, post-render the sorted manifest, without hooks
+		if b, err = opts.PostRenderer.Run(b); err != nil {
+			return b, nil, errors.Wrap(err, "error while running post render on files")
+		}
+	}
+	return b, hooks, nil
+}
+
+// writeManifests writes the rendered manifests of files to b in install
+// order, and returns the hooks among them.
+func writeManifests(b *bytes.Buffer, files map[string]string, apiVersions chartutil.VersionSet) ([]*release.Hook, error) {
+	// Sort hooks, manifests, and partials. Only hooks and manifests are returned,
+	// as partials are not used after renderer.Render. Empty manifests are also
+	// removed here. Files are read in order of their path before being sorted
+	// by kind, so the order of the files map does not matter.
+	hooks, manifests, err := releaseutil.SortManifests(files, apiVersions, releaseutil.InstallOrder)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range manifests {
+		// skip notes
+		if !strings.Contains(m.Name, "NOTES.txt") {
+			fmt.Fprintf(b, "---\n# Source: %s\n%s\n", m.Name, m.Content)
+		}
+	}
+	return hooks, nil
+}
+
+// createPatch returns the patch that upgrades liveObj, the live object of
+// target, along with the release and target configurations it was computed
+// from. liveObj is nil when the object does not exist. Warnings about patches
+// that fail verification go to logf.
+func createPatch(current runtime.Object, target *resource.Info, liveObj runtime.Object, opts *Options, logf action.DebugLog) ([]byte, types.PatchType, []byte, []byte, error) {
+	oldData, err := json.Marshal(current)
+	if err != nil {
+		return nil, types.StrategicMergePatchType, nil, nil, errors.Wrap(err, "serializing current configuration")
+	}
+	newData, err := json.Marshal(target.Object)
+	if err != nil {
+		return nil, types.StrategicMergePatchType, nil, nil, errors.Wrap(err, "serializing target configuration")
+	}
+
+	// Even if liveObj is nil (because it was not found), it will marshal just fine
+	currentData, err := json.Marshal(liveObj)
+	if err != nil {
+		return nil, types.StrategicMergePatchType, nil, nil, errors.Wrap(err, "serializing live configuration")
+	}
+
+	if !opts.ShowManagedFields {
+		// every side loses them, so the patch never touches them
+		for _, data := range []*[]byte{&oldData, &newData, &currentData} {
+			if *data, err = withoutServerFields(*data); err != nil {
+				return nil, types.StrategicMergePatchType, nil, nil, errors.Wrap(err, "removing server-managed fields")
+			}
+		}
+	}
+
+	if opts.Normalizer != nil {
+		kind := target.Mapping.GroupVersionKind.Kind
+		if oldData, err = opts.Normalizer.normalize(kind, oldData); err != nil {
+			return nil, types.StrategicMergePatchType, nil, nil, errors.Wrap(err, "normalizing current configuration")
+		}
+		if newData, err = opts.Normalizer.normalize(kind, newData); err != nil {
+			return nil, types.StrategicMergePatchType, nil, nil, errors.Wrap(err, "normalizing target configuration")
+		}
+		if currentData, err = opts.Normalizer.normalize(kind, currentData); err != nil {
+			return nil, types.StrategicMergePatchType, nil, nil, errors.Wrap(err, "normalizing live configuration")
+		}
+	}
+
+	if opts.SpecOnly {
+		kind := target.Mapping.GroupVersionKind.Kind
+		for _, data := range []*[]byte{&oldData, &newData, &currentData} {
+			if *data, err = onlySpec(kind, *data); err != nil {
+				return nil, types.StrategicMergePatchType, nil, nil, errors.Wrap(err, "removing fields outside spec")
+			}
+		}
+	}
+
+	// Get a versioned object
+	versionedObject := kube.AsVersioned(target)
+
+	if patchType, _ := patchStrategy(versionedObject); patchType == types.MergePatchType {
+		// fall back to generic JSON merge patch
+		patch, err := jsonpatch.CreateMergePatch(oldData, newData)
+		if err == nil && opts.VerifyPatches {
+			warnUnverifiedPatch(logf, target.Mapping.GroupVersionKind.Kind, target.Name, oldData, patch, newData, types.MergePatchType, versionedObject)
+		}
+		return patch, types.MergePatchType, oldData, newData, err
+	}
+
+	patchMeta, err := strategicpatch.NewPatchMetaFromStruct(versionedObject)
+	if err != nil {
+		return nil, types.StrategicMergePatchType, nil, nil, errors.Wrap(err, "unable to create patch metadata from object")
+	}
+
+	if opts.IgnoreListOrder {
+		// sort every side the same way so that reordering alone is no change.
+		// The sorted sides only tell whether there is a change: the patch
+		// itself is computed from the real order, which helm would keep.
+		sorted := [][]byte{oldData, newData, currentData}
+		for i := range sorted {
+			if sorted[i], err = sortLists(sorted[i], patchMeta); err != nil {
+				return nil, types.StrategicMergePatchType, nil, nil, errors.Wrap(err, "sorting lists")
+			}
+		}
+		patch, err := strategicpatch.CreateThreeWayMergePatch(sorted[0], sorted[1], sorted[2], patchMeta, true)
+		if err != nil || isEmptyPatch(patch) {
+			return patch, types.StrategicMergePatchType, oldData, newData, err
+		}
+	}
+
+	patch, err := strategicpatch.CreateThreeWayMergePatch(oldData, newData, currentData, patchMeta, true)
+	if err == nil && opts.VerifyPatches {
+		warnUnverifiedPatch(logf, target.Mapping.GroupVersionKind.Kind, target.Name, currentData, patch, newData, types.StrategicMergePatchType, versionedObject)
+	}
+	return patch, types.StrategicMergePatchType, oldData, newData, err
+}
+
+// warnUnverifiedPatch logs a warning when applying patch to base does not
+// produce the target configuration, which points at a merge key or patch type
+// problem rather than at a real change.
+func warnUnverifiedPatch(logf action.DebugLog, kind, name string, base, patch, newData []byte, patchType types.PatchType, versionedObject runtime.Object) {
+	mismatch, err := verifyPatch(base, patch, newData, patchType, versionedObject)
+	switch {
+	case err != nil:
+		logf("WARNING: unable to verify patch for %s %q: %s", kind, name, err)
+	case mismatch != "":
+		logf("WARNING: patch for %s %q does not produce the target configuration at %s", kind, name, mismatch)
+	}
+}
+
+// kindAllowed reports whether kind is in the allowlist. An empty allowlist
+// allows every kind.
+func kindAllowed(allowlist []string, kind string) bool {
+	if len(allowlist) == 0 {
+		return true
+	}
+	for _, k := range allowlist {
+		if strings.EqualFold(strings.TrimSpace(k), kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// selected reports whether the resource matches one of the include
+// selectors, or there are none, and none of the exclude selectors.
+func selected(include, exclude []string, kind, name string) bool {
+	for _, sel := range exclude {
+		if selectorMatches(sel, kind, name) {
+			return false
+		}
+	}
+	if len(include) == 0 {
+		return true
+	}
+	for _, sel := range include {
+		if selectorMatches(sel, kind, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectorMatches reports whether a Kind or Kind/name selector matches the
+// resource. Kinds match regardless of case.
+func selectorMatches(selector, kind, name string) bool {
+	parts := strings.SplitN(strings.TrimSpace(selector), "/", 2)
+	if !strings.EqualFold(parts[0], kind) {
+		return false
+	}
+	return len(parts) == 1 || parts[1] == name
+}
+
+// validateSelector checks that selector is a Kind or Kind/name.
+func validateSelector(selector string) error {
+	parts := strings.SplitN(strings.TrimSpace(selector), "/", 2)
+	for _, p := range parts {
+		if p == "" {
+			return errors.Errorf("invalid selector %q: must be Kind or Kind/name", selector)
+		}
+	}
+	return nil
+}
+
+// patchStrategy returns the type of patch computed for a versioned object,
+// and why a merge patch is used instead of a strategic merge patch.
+func patchStrategy(versionedObject runtime.Object) (types.PatchType, string) {
+	// Unstructured objects, such as CRDs, may not have an not registered error
+	// returned from ConvertToVersion. Anything that's unstructured should
+	// use the jsonpatch.CreateMergePatch. Strategic Merge Patch is not supported
+	// on objects like CRDs.
+	if _, isUnstructured := versionedObject.(runtime.Unstructured); isUnstructured {
+		return types.MergePatchType, "unstructured"
+	}
+
+	// On newer K8s versions, CRDs aren't unstructured but has this dedicated type
+	if _, isCRD := versionedObject.(*apiextv1.CustomResourceDefinition); isCRD {
+		return types.MergePatchType, "CRD"
+	}
+	return types.StrategicMergePatchType, ""
+}
+
+// applyPatch applies a patch created by createPatch to the live data of info,
+// returning the state the object would have after the upgrade.
+func applyPatch(info *resource.Info, liveData, patch []byte, patchType types.PatchType) ([]byte, error) {
+	if patchType == types.MergePatchType {
+		return jsonpatch.MergePatch(liveData, patch)
+	}
+	return strategicpatch.StrategicMergePatch(liveData, patch, kube.AsVersioned(info))
+}
+
+// rollbackPatch returns the patch, of the same type as patch, that restores
+// liveData once patch has been applied to it. The rollback is computed from
+// the upgraded object rather than from the manifests, and fails unless
+// applying it restores every field of liveData.
+func rollbackPatch(info *resource.Info, liveData, patch []byte, patchType types.PatchType) ([]byte, error) {
+	upgraded, err := applyPatch(info, liveData, patch, patchType)
+	if err != nil {
+		return nil, err
+	}
+	var rollback []byte
+	if patchType == types.MergePatchType {
+		rollback, err = jsonpatch.CreateMergePatch(upgraded, liveData)
+	} else {
+		rollback, err = strategicpatch.CreateTwoWayMergePatch(upgraded, liveData, kube.AsVersioned(info))
+	}
+	if err != nil {
+		return nil, err
+	}
+	mismatch, err := verifyPatch(upgraded, rollback, liveData, patchType, kube.AsVersioned(info))
+	if err != nil {
+		return nil, err
+	}
+	if mismatch != "" {
+		return nil, errors.Errorf("rollback does not restore the live configuration at %s", mismatch)
+	}
+	return rollback, nil
+}
+
+func patchTypeName(patchType types.PatchType, reason string) string {
+	name := "strategic"
+	if patchType == types.MergePatchType {
+		name = "merge"
+	}
+	if reason != "" {
+		name += " (" + reason + ")"
+	}
+	return name
+}
+
+// describePatchTypes summarizes patch type counts, e.g. "12 strategic,
+// 3 merge (CRD)".
+func describePatchTypes(counts map[string]int) string {
+	if len(counts) == 0 {
+		return "none, no resources were patched"
+	}
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%d %s", counts[name], name)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// isEmptyPatch reports whether patch makes no changes.
+func isEmptyPatch(patch []byte) bool {
+	p := strings.TrimSpace(string(patch))
+	return p == "" || p == "{}" || p == "[]" || p == "null"
+}
+
+// addAnnotations merges annotations into the object's metadata, overwriting
+// any existing keys.
+func addAnnotations(obj runtime.Object, annotations map[string]string) error {
+	if len(annotations) == 0 {
+		return nil
+	}
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return err
+	}
+	merged := accessor.GetAnnotations()
+	if merged == nil {
+		merged = map[string]string{}
+	}
+	for k, v := range annotations {
+		merged[k] = v
+	}
+	accessor.SetAnnotations(merged)
+	return nil
+}
@@ -0,0 +1,402 @@
+package patchdiff
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/release"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// releaseDocs are the objects of a release, live as they are stored.
+var releaseDocs = []string{`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: b
+  namespace: web
+data:
+  key: old`, `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: a
+  namespace: web
+spec:
+  replicas: 1`, `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: a
+  namespace: api
+data:
+  key: old`, `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: gone
+  namespace: api
+data:
+  key: old`}
+
+// targetDocs upgrade releaseDocs, changing every object but gone, which is
+// deleted, and adding new.
+var targetDocs = []string{`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: new
+  namespace: web
+data:
+  key: new`, `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: b
+  namespace: web
+data:
+  key: new`, `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: a
+  namespace: web
+spec:
+  replicas: 3`, `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: a
+  namespace: api
+data:
+  key: new`}
+
+func manifest(docs []string) string {
+	return "---\n" + strings.Join(docs, "\n---\n") + "\n"
+}
+
+func reversed(docs []string) []string {
+	r := make([]string, len(docs))
+	for i, doc := range docs {
+		r[len(docs)-1-i] = doc
+	}
+	return r
+}
+
+var generatedAt = regexp.MustCompile(`"generatedAt": "[^"]*"`)
+
+func TestCreatePatchsetOrderIsDeterministic(t *testing.T) {
+	cluster := newTestCluster(t, manifest(releaseDocs))
+	for _, tt := range []struct {
+		name string
+		opts *Options
+	}{
+		{"json", &Options{Output: "json"}},
+		{"json with creates", &Options{Output: "json", Install: true}},
+		{"raw", &Options{Output: "raw"}},
+		{"semantic", &Options{Output: "json", DiffFormat: "semantic", WithContextResources: true}},
+		{"delta", &Options{Output: "delta"}},
+		{"argocd", &Options{Output: "argocd"}},
+		{"diff", &Options{Output: "diff"}},
+		{"junit", &Options{Output: "junit"}},
+		{"patchbundle", &Options{Output: "patchbundle"}},
+		{"csv", &Options{Output: "csv"}},
+		{"fleet-summary", &Options{Output: "fleet-summary"}},
+	} {
+		var outputs []string
+		for _, order := range []func([]string) []string{
+			func(docs []string) []string { return docs },
+			reversed,
+		} {
+			ps, err := createPatchset(context.Background(), cluster.actionConfig(t), "r", manifest(order(releaseDocs)), manifest(order(targetDocs)), tt.opts)
+			if err != nil {
+				t.Fatalf("%s: %s", tt.name, err)
+			}
+			// the time of generation is the one thing meant to change
+			outputs = append(outputs, generatedAt.ReplaceAllString(ps.output, ""))
+		}
+		if outputs[0] != outputs[1] {
+			t.Errorf("%s: output depends on the order of the manifests:\n%s\n\nversus\n\n%s", tt.name, outputs[0], outputs[1])
+		}
+	}
+}
+
+func TestCreatePatchsetSortsEntries(t *testing.T) {
+	cluster := newTestCluster(t, manifest(releaseDocs))
+	ps, err := createPatchset(context.Background(), cluster.actionConfig(t), "r", manifest(releaseDocs), manifest(targetDocs), &Options{Install: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, e := range ps.entries {
+		got = append(got, strings.Join([]string{e.Namespace, e.Kind, e.Name, string(e.PatchType)}, " "))
+	}
+	want := []string{
+		"api ConfigMap a application/strategic-merge-patch+json",
+		"api ConfigMap gone delete",
+		"web ConfigMap b application/strategic-merge-patch+json",
+		"web ConfigMap new create",
+		"web Deployment a application/strategic-merge-patch+json",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("entries are not sorted by namespace, kind and name:\n%s\n\nwant\n\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	data, err := json.Marshal(ps.entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps.output != string(data) {
+		t.Errorf("json output %s does not print the entries %s", ps.output, data)
+	}
+}
+
+// testChart returns a chart of the given templates and default values.
+func testChart(values map[string]interface{}, templates map[string]string) *chart.Chart {
+	ch := &chart.Chart{
+		Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: "test", Version: "0.1.0"},
+		Values:   values,
+	}
+	for name, data := range templates {
+		ch.Templates = append(ch.Templates, &chart.File{Name: name, Data: []byte(data)})
+	}
+	return ch
+}
+
+// storeRelease stores revision 1 of release r, deployed from ch with config.
+func storeRelease(t *testing.T, c *action.Configuration, manifest string, ch *chart.Chart, config map[string]interface{}) {
+	t.Helper()
+	rel := &release.Release{
+		Name:      "r",
+		Namespace: "default",
+		Version:   1,
+		Info:      &release.Info{Status: release.StatusDeployed},
+		Chart:     ch,
+		Config:    config,
+		Manifest:  manifest,
+	}
+	if err := c.Releases.Create(rel); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrepareUpgradeNullDeletesDefaults(t *testing.T) {
+	ch := testChart(map[string]interface{}{"someKey": "default", "other": "default"}, map[string]string{
+		"templates/cm.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+data:
+  other: {{ .Values.other }}
+{{- if .Values.someKey }}
+  someKey: {{ .Values.someKey }}
+{{- end }}
+`,
+	})
+	for _, tt := range []struct {
+		name   string
+		config map[string]interface{}
+		vals   map[string]interface{}
+		opts   *Options
+		want   string
+	}{
+		{name: "defaults", vals: map[string]interface{}{"other": "set"}, opts: &Options{}, want: "  other: set\n  someKey: default\n"},
+		{name: "null", vals: map[string]interface{}{"someKey": nil}, opts: &Options{}, want: "  other: default\n"},
+		{name: "null with --reuse-values", config: map[string]interface{}{"other": "release"}, vals: map[string]interface{}{"someKey": nil}, opts: &Options{ReuseValues: true}, want: "  other: release\n"},
+	} {
+		c := newTestCluster(t).actionConfig(t)
+		storeRelease(t, c, "", ch, tt.config)
+		_, target, err := PrepareUpgrade(context.Background(), c, "r", ch, tt.vals, tt.opts)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !strings.HasSuffix(target, "data:\n"+tt.want) {
+			t.Errorf("%s: got manifest\n%s\nwant its data to be\n%s", tt.name, target, tt.want)
+		}
+	}
+}
+
+func TestDiffReleaseDumpValues(t *testing.T) {
+	ch := testChart(map[string]interface{}{"other": "default"}, map[string]string{
+		"templates/cm.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+data:
+  other: {{ .Values.other }}
+`,
+	})
+	for _, tt := range []struct {
+		name    string
+		install bool
+	}{
+		{name: "upgrade"},
+		{name: "install", install: true},
+	} {
+		c := newTestCluster(t).actionConfig(t)
+		if !tt.install {
+			storeRelease(t, c, "", ch, nil)
+		}
+		var dump bytes.Buffer
+		opts := &Options{Install: tt.install, DumpValues: &dump}
+		if _, _, err := DiffRelease(context.Background(), c, "r", ch, map[string]interface{}{"other": "set"}, opts); err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if got := dump.String(); !strings.HasPrefix(got, "---\n# Computed values\n") || !strings.Contains(got, "  other: set\n") {
+			t.Errorf("%s: got dumped values\n%s", tt.name, got)
+		}
+	}
+
+	// helm and kustomize do not render with values patchdiff can dump
+	for _, opts := range []*Options{
+		{Engine: "helm", DumpValues: &bytes.Buffer{}},
+		{Engine: "helm", Install: true, DumpValues: &bytes.Buffer{}},
+		{KustomizeDir: "overlay", DumpValues: &bytes.Buffer{}},
+	} {
+		if err := opts.Validate(); err == nil || !strings.Contains(err.Error(), "--dump-values") {
+			t.Errorf("%+v: expected --dump-values to be rejected, got %v", opts, err)
+		}
+	}
+}
+
+func TestCreatePatchsetKeptResources(t *testing.T) {
+	kept := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %s
+  namespace: web
+  annotations:
+    helm.sh/resource-policy: keep
+data:
+  key: %s`
+	release := manifest([]string{fmt.Sprintf(kept, "changed", "old"), fmt.Sprintf(kept, "removed", "old"), fmt.Sprintf(kept, "unchanged", "old")})
+	target := manifest([]string{fmt.Sprintf(kept, "changed", "new"), fmt.Sprintf(kept, "unchanged", "old")})
+	cluster := newTestCluster(t, release)
+	c := cluster.actionConfig(t)
+	var logged []string
+	c.Log = func(format string, v ...interface{}) { logged = append(logged, fmt.Sprintf(format, v...)) }
+
+	ps, err := createPatchset(context.Background(), c, "r", release, target, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range ps.entries {
+		got = append(got, e.Name+" "+string(e.PatchType)+" "+string(e.Patch))
+	}
+	// kept resources are still patched, but never deleted
+	if want := `changed application/strategic-merge-patch+json {"data":{"key":"new"}}`; strings.Join(got, "\n") != want {
+		t.Errorf("got entries\n%s\nwant\n%s", strings.Join(got, "\n"), want)
+	}
+	for _, want := range []string{
+		`ConfigMap "changed": still updated, although helm.sh/resource-policy=keep keeps it on uninstall`,
+		`ConfigMap "removed": not deleted, since helm.sh/resource-policy=keep keeps it`,
+	} {
+		if !contains(logged, want) {
+			t.Errorf("%q was not logged, got:\n%s", want, strings.Join(logged, "\n"))
+		}
+	}
+	for _, line := range logged {
+		if strings.Contains(line, `"unchanged"`) {
+			t.Errorf("unexpected note on an unchanged kept resource: %s", line)
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRollbackPatchRoundTrip(t *testing.T) {
+	deployment := `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"a","namespace":"web","labels":{"app":"a","tier":"web"}},"spec":{"replicas":1,"template":{"spec":{"containers":[{"name":"app","image":"app:1","env":[{"name":"A","value":"1"},{"name":"B","value":"2"}]}]}}}}`
+	gadget := `{"apiVersion":"example.com/v1","kind":"Gadget","metadata":{"name":"g","namespace":"web"},"spec":{"size":1,"colors":["red","blue"],"extra":{"a":true}}}`
+	for _, tt := range []struct {
+		name      string
+		live      string
+		patch     string
+		patchType types.PatchType
+	}{
+		{"scalar change", deployment, `{"spec":{"replicas":3}}`, types.StrategicMergePatchType},
+		{"removed label", deployment, `{"metadata":{"labels":{"tier":null}}}`, types.StrategicMergePatchType},
+		{"added env var", deployment, `{"spec":{"template":{"spec":{"containers":[{"name":"app","env":[{"name":"C","value":"3"}]}]}}}}`, types.StrategicMergePatchType},
+		{"removed env var", deployment, `{"spec":{"template":{"spec":{"containers":[{"name":"app","env":[{"$patch":"delete","name":"A"}]}]}}}}`, types.StrategicMergePatchType},
+		{"changed image", deployment, `{"spec":{"template":{"spec":{"containers":[{"name":"app","image":"app:2"}]}}}}`, types.StrategicMergePatchType},
+		{"merge patch", gadget, `{"spec":{"size":2,"colors":["green"],"extra":null,"new":"x"}}`, types.MergePatchType},
+	} {
+		cluster := newTestCluster(t)
+		infos, err := cluster.actionConfig(t).KubeClient.Build(strings.NewReader(tt.live), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info := infos[0]
+
+		rollback, err := rollbackPatch(info, []byte(tt.live), []byte(tt.patch), tt.patchType)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		upgraded, err := applyPatch(info, []byte(tt.live), []byte(tt.patch), tt.patchType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if jsonEqual(t, upgraded, []byte(tt.live)) {
+			t.Errorf("%s: the patch changes nothing", tt.name)
+		}
+		restored, err := applyPatch(info, upgraded, rollback, tt.patchType)
+		if err != nil {
+			t.Errorf("%s: applying rollback %s: %s", tt.name, rollback, err)
+			continue
+		}
+		if !jsonEqual(t, restored, []byte(tt.live)) {
+			t.Errorf("%s: rollback %s restores %s, want %s", tt.name, rollback, restored, tt.live)
+		}
+	}
+}
+
+func TestCreatePatchsetWithRollback(t *testing.T) {
+	cluster := newTestCluster(t, manifest(releaseDocs))
+	ps, err := createPatchset(context.Background(), cluster.actionConfig(t), "r", manifest(releaseDocs), manifest(targetDocs), &Options{Output: "patchbundle", WithRollback: true, ChartDigest: "sha256:cc57"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bundle patchBundle
+	if err := json.Unmarshal([]byte(ps.output), &bundle); err != nil {
+		t.Fatal(err)
+	}
+	if bundle.Metadata.ChartDigest != "sha256:cc57" {
+		t.Errorf("got chart digest %q, want the one of the options", bundle.Metadata.ChartDigest)
+	}
+
+	got := map[string]string{}
+	for _, e := range bundle.Patches {
+		var rollback bytes.Buffer
+		if len(e.Rollback) > 0 {
+			if err := json.Compact(&rollback, e.Rollback); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got[e.Resource.Namespace+"/"+e.Resource.Kind+"/"+e.Resource.Name] = string(e.PatchType) + " " + rollback.String()
+	}
+	want := map[string]string{
+		"api/ConfigMap/a":  `application/strategic-merge-patch+json {"data":{"key":"old"}}`,
+		"web/ConfigMap/b":  `application/strategic-merge-patch+json {"data":{"key":"old"}}`,
+		"web/Deployment/a": `application/strategic-merge-patch+json {"spec":{"replicas":1}}`,
+		// recreating the live object undoes a delete
+		"api/ConfigMap/gone": `delete {"apiVersion":"v1","data":{"key":"old"},"kind":"ConfigMap","metadata":{"name":"gone","namespace":"api"}}`,
+	}
+	for key, w := range want {
+		if got[key] != w {
+			t.Errorf("%s: got %q, want %q", key, got[key], w)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %d entries, want %d: %v", len(got), len(want), got)
+	}
+}
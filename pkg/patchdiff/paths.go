@@ -0,0 +1,72 @@
+package patchdiff
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// patchPaths returns the JSON pointer of every field a merge patch sets or
+// removes. Items of a list are walked without adding an index, since merge
+// patches address list items by merge key rather than position.
+func patchPaths(patch []byte) ([]string, error) {
+	var doc interface{}
+	if err := json.Unmarshal(patch, &doc); err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	walkPatch(doc, "", seen)
+
+	paths := make([]string, 0, len(seen))
+	for p := range seen {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func walkPatch(node interface{}, path string, seen map[string]bool) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if len(n) == 0 && path != "" {
+			seen[path] = true
+		}
+		for k, v := range n {
+			switch {
+			case k == "$patch":
+				// a directive such as "delete" applies to the object itself
+				seen[path] = true
+			case k == "$retainKeys" || strings.HasPrefix(k, "$setElementOrder/"):
+				// ordering and retention hints accompany real changes
+			case strings.HasPrefix(k, "$deleteFromPrimitiveList/"):
+				seen[path+"/"+escapePointer(strings.TrimPrefix(k, "$deleteFromPrimitiveList/"))] = true
+			default:
+				walkPatch(v, path+"/"+escapePointer(k), seen)
+			}
+		}
+	case []interface{}:
+		if len(n) == 0 {
+			seen[path] = true
+		}
+		for _, v := range n {
+			walkPatch(v, path, seen)
+		}
+	default:
+		seen[path] = true
+	}
+}
+
+// escapePointer escapes a key for use as a JSON pointer segment.
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// pathTouches reports whether a change at path falls under prefix, or
+// replaces a parent of it.
+func pathTouches(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return path == prefix ||
+		strings.HasPrefix(path, prefix+"/") ||
+		strings.HasPrefix(prefix, path+"/")
+}
@@ -0,0 +1,202 @@
+package patchdiff
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// containerPaths are the locations of pod containers in the workload kinds
+// whose changes are described in semantic mode.
+var containerPaths = [][]string{
+	{"spec", "containers"},
+	{"spec", "template", "spec", "containers"},
+	{"spec", "template", "spec", "initContainers"},
+	{"spec", "jobTemplate", "spec", "template", "spec", "containers"},
+}
+
+// semanticPaths are the patch paths semantic mode knows how to describe.
+var semanticPaths = []string{
+	"/spec/replicas",
+	"/*/name",
+	"/*/image",
+	"/*/resources/limits",
+	"/*/env",
+}
+
+// describeChange renders the changes between the original and target objects
+// as English sentences for well-known fields. Changes to any other field are
+// reported with the raw patch.
+func describeChange(original, target runtime.Object, patch []byte) ([]string, error) {
+	oldObj, err := toMap(original)
+	if err != nil {
+		return nil, err
+	}
+	newObj, err := toMap(target)
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err := patchPaths(patch)
+	if err != nil {
+		return nil, err
+	}
+	// only describe fields the patch actually changes
+	touches := func(prefix string) bool {
+		for _, p := range paths {
+			if pathTouches(p, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var sentences []string
+	if o, n := lookup(oldObj, "spec", "replicas"), lookup(newObj, "spec", "replicas"); touches("/spec/replicas") && !reflect.DeepEqual(o, n) {
+		sentences = append(sentences, fmt.Sprintf("scaled replicas %v→%v", orNone(o), orNone(n)))
+	}
+
+	for _, path := range containerPaths {
+		if !touches("/" + strings.Join(path, "/")) {
+			continue
+		}
+		oldContainers := byName(lookup(oldObj, path...))
+		newContainers := byName(lookup(newObj, path...))
+		for _, name := range sortedUnion(toInterfaceMap(oldContainers), toInterfaceMap(newContainers)) {
+			sentences = append(sentences, describeContainer(name, oldContainers[name], newContainers[name])...)
+		}
+	}
+
+	for _, p := range paths {
+		if !isSemanticPath(p) {
+			sentences = append(sentences, "other changes: "+string(patch))
+			break
+		}
+	}
+	return sentences, nil
+}
+
+func describeContainer(name string, oldC, newC map[string]interface{}) []string {
+	switch {
+	case oldC == nil:
+		return []string{fmt.Sprintf("container %q added with image %v", name, orNone(newC["image"]))}
+	case newC == nil:
+		return []string{fmt.Sprintf("container %q removed", name)}
+	}
+
+	var sentences []string
+	if o, n := oldC["image"], newC["image"]; !reflect.DeepEqual(o, n) {
+		sentences = append(sentences, fmt.Sprintf("image of container %q updated %v→%v", name, orNone(o), orNone(n)))
+	}
+
+	oldLimits, _ := lookup(oldC, "resources", "limits").(map[string]interface{})
+	newLimits, _ := lookup(newC, "resources", "limits").(map[string]interface{})
+	for _, k := range sortedUnion(oldLimits, newLimits) {
+		if o, n := oldLimits[k], newLimits[k]; !reflect.DeepEqual(o, n) {
+			sentences = append(sentences, fmt.Sprintf("%s limit of container %q changed %v→%v", k, name, orNone(o), orNone(n)))
+		}
+	}
+
+	oldEnv := byName(oldC["env"])
+	newEnv := byName(newC["env"])
+	for _, k := range sortedUnion(toInterfaceMap(oldEnv), toInterfaceMap(newEnv)) {
+		o, inOld := oldEnv[k]
+		n, inNew := newEnv[k]
+		switch {
+		case !inOld:
+			sentences = append(sentences, fmt.Sprintf("env var %s added to container %q", k, name))
+		case !inNew:
+			sentences = append(sentences, fmt.Sprintf("env var %s removed from container %q", k, name))
+		case !reflect.DeepEqual(o, n):
+			sentences = append(sentences, fmt.Sprintf("env var %s of container %q changed %v→%v", k, name, orNone(o["value"]), orNone(n["value"])))
+		}
+	}
+	return sentences
+}
+
+// isSemanticPath reports whether a patch path is described by semantic mode.
+func isSemanticPath(path string) bool {
+	for _, containers := range containerPaths {
+		prefix := "/" + strings.Join(containers, "/")
+		if strings.HasPrefix(path, prefix+"/") {
+			path = "/*" + strings.TrimPrefix(path, prefix)
+			break
+		}
+	}
+	for _, p := range semanticPaths {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func toMap(obj runtime.Object) (map[string]interface{}, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]interface{}{}
+	return m, json.Unmarshal(data, &m)
+}
+
+// lookup returns the value at the nested path, or nil if it does not exist.
+func lookup(obj map[string]interface{}, path ...string) interface{} {
+	var cur interface{} = obj
+	for _, k := range path {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		cur = m[k]
+	}
+	return cur
+}
+
+// byName indexes a list of objects by their name field.
+func byName(list interface{}) map[string]map[string]interface{} {
+	items, _ := list.([]interface{})
+	indexed := make(map[string]map[string]interface{}, len(items))
+	for _, item := range items {
+		if m, ok := item.(map[string]interface{}); ok {
+			if name, ok := m["name"].(string); ok {
+				indexed[name] = m
+			}
+		}
+	}
+	return indexed
+}
+
+func toInterfaceMap(m map[string]map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+func sortedUnion(a, b map[string]interface{}) []string {
+	seen := map[string]bool{}
+	var keys []string
+	for _, m := range []map[string]interface{}{a, b} {
+		for k := range m {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func orNone(v interface{}) interface{} {
+	if v == nil {
+		return "<none>"
+	}
+	return v
+}
@@ -0,0 +1,90 @@
+package patchdiff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/release"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+)
+
+// isTestHook reports whether h runs with helm test. An upgrade never runs
+// such hooks.
+func isTestHook(h *release.Hook) bool {
+	for _, e := range h.Events {
+		if e == release.HookTest {
+			return true
+		}
+	}
+	return false
+}
+
+// testHookManifests returns the manifests of the test hooks of hooks as a
+// multi-document manifest, to be split off by testHookEntries.
+func testHookManifests(hooks []*release.Hook) string {
+	var b strings.Builder
+	for _, h := range hooks {
+		if isTestHook(h) {
+			fmt.Fprintf(&b, "---\n# Source: %s\n%s\n", h.Path, h.Manifest)
+		}
+	}
+	return b.String()
+}
+
+// testHookEntries splits from manifest the resources annotated as test
+// hooks, as helm's manifest sorter recognizes them, and returns them as
+// create entries along with the manifest of the other objects. helm test
+// creates these resources anew each time, so they have no live state to
+// diff against.
+func testHookEntries(c *action.Configuration, manifest string) (string, []PatchEntry, error) {
+	b := bytes.NewBuffer(nil)
+	var entries []PatchEntry
+	for _, doc := range splitManifests(manifest) {
+		var obj struct {
+			APIVersion string `json:"apiVersion"`
+			Kind       string `json:"kind"`
+			Metadata   struct {
+				Name        string            `json:"name"`
+				Namespace   string            `json:"namespace"`
+				Annotations map[string]string `json:"annotations"`
+			} `json:"metadata"`
+		}
+		data, err := yaml.YAMLToJSON([]byte(doc))
+		if err != nil {
+			return "", nil, errors.Wrap(err, "unable to parse new release manifest")
+		}
+		if err := yaml.Unmarshal(data, &obj); err != nil {
+			return "", nil, errors.Wrap(err, "unable to parse new release manifest")
+		}
+		events := obj.Metadata.Annotations[release.HookAnnotation]
+		if !testHookEvents(events) {
+			fmt.Fprintf(b, "---\n%s\n", doc)
+			continue
+		}
+		key := objectKey{schema.FromAPIVersionAndKind(obj.APIVersion, obj.Kind), obj.Metadata.Namespace, obj.Metadata.Name}
+		if key.namespace == "" {
+			key.namespace = installNamespace(c)
+		}
+		entry := offlinePatchEntry(key, createPatchType, data)
+		entry.Hook = events
+		entries = append(entries, entry)
+	}
+	sortEntries(entries)
+	return b.String(), entries, nil
+}
+
+// testHookEvents reports whether the helm.sh/hook annotation events include
+// the test event, or test-success, its name in Helm 2.
+func testHookEvents(events string) bool {
+	for _, e := range strings.Split(events, ",") {
+		switch strings.TrimSpace(e) {
+		case release.HookTest.String(), "test-success":
+			return true
+		}
+	}
+	return false
+}
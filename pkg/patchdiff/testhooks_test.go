@@ -0,0 +1,77 @@
+package patchdiff
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDiffReleaseIncludeTestHooks(t *testing.T) {
+	ch := testChart(map[string]interface{}{}, map[string]string{
+		"templates/cm.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+data:
+  a: "1"
+`,
+		"templates/tests/connection.yaml": `apiVersion: v1
+kind: Pod
+metadata:
+  name: test-connection
+  annotations:
+    helm.sh/hook: test-success
+spec:
+  containers:
+  - name: wget
+    image: busybox
+`,
+		"templates/migrate.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: migrate
+  annotations:
+    helm.sh/hook: pre-upgrade
+`,
+	})
+	for _, tt := range []struct {
+		name string
+		opts *Options
+		want []string
+	}{
+		{name: "default", opts: &Options{}},
+		{name: "hooks", opts: &Options{IncludeHooks: true}},
+		{name: "test hooks", opts: &Options{IncludeTestHooks: true}, want: []string{"Pod test-connection create test-success"}},
+		{name: "hooks and test hooks", opts: &Options{IncludeHooks: true, IncludeTestHooks: true}, want: []string{"Pod test-connection create test-success"}},
+	} {
+		c := newTestCluster(t).actionConfig(t)
+		storeRelease(t, c, "", ch, nil)
+		out, counts, err := DiffRelease(context.Background(), c, "r", ch, nil, tt.opts)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		var entries []PatchEntry
+		if err := json.Unmarshal([]byte(out), &entries); err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, strings.Join([]string{e.Kind, e.Name, string(e.PatchType), e.Hook}, " "))
+		}
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s: got entries\n%s\nwant\n%s", tt.name, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+		}
+		// only the hooks of the upgrade count, as created since the test
+		// cluster has none of them
+		want := 1
+		if tt.opts.IncludeHooks {
+			want = 2
+		}
+		if counts.Created != want {
+			t.Errorf("%s: got %d created, want %d", tt.name, counts.Created, want)
+		}
+	}
+}
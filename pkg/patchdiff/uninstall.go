@@ -0,0 +1,36 @@
+package patchdiff
+
+import (
+	"context"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/kube"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/cli-runtime/pkg/resource"
+)
+
+// PreviewUninstall previews uninstalling the named release with the given
+// manifest, formatted as selected by opts.Output, and counts the resources it
+// deletes. Uninstalling is upgrading to an empty manifest, so every resource
+// of the manifest that is live is a delete entry, except those their resource
+// policy keeps and those already gone, which are noted. Requests to the
+// cluster are cancelled along with ctx.
+func PreviewUninstall(ctx context.Context, c *action.Configuration, name, manifest string, opts *Options) (string, Counts, error) {
+	ps, err := createPatchset(ctx, c, name, manifest, "", opts)
+	if ps == nil {
+		return "", Counts{}, contextError(ctx, err)
+	}
+	return writePatchset(c, name, ps, opts, err)
+}
+
+// isKept reports whether the resource policy annotation of the object tells
+// helm to leave it behind on uninstall.
+func isKept(info *resource.Info) bool {
+	accessor, err := meta.Accessor(info.Object)
+	if err != nil {
+		return false
+	}
+	policy := accessor.GetAnnotations()[kube.ResourcePolicyAnno]
+	return strings.ToLower(strings.TrimSpace(policy)) == kube.KeepPolicy
+}
@@ -0,0 +1,53 @@
+package patchdiff
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestPreviewUninstall(t *testing.T) {
+	kept := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: kept
+  namespace: web
+  annotations:
+    helm.sh/resource-policy: keep`
+	// gone is not live, and kept is protected by its resource policy
+	cluster := newTestCluster(t, releaseDocs[0], releaseDocs[1], releaseDocs[2], kept)
+	for _, tt := range []struct {
+		output string
+		want   string
+	}{
+		{
+			output: "json",
+			want:   `[{"apiVersion":"v1","kind":"ConfigMap","namespace":"api","name":"a","patchType":"delete","patch":null},{"apiVersion":"v1","kind":"ConfigMap","namespace":"web","name":"b","patchType":"delete","patch":null},{"apiVersion":"apps/v1","kind":"Deployment","namespace":"web","name":"a","patchType":"delete","patch":null}]`,
+		},
+		{
+			output: "delta",
+			want:   "ConfigMap api/a (deleted)\nConfigMap web/b (deleted)\nDeployment web/a (deleted)",
+		},
+	} {
+		out, counts, err := PreviewUninstall(context.Background(), cluster.actionConfig(t), "r", manifest(append(append([]string{}, releaseDocs...), kept)), &Options{Output: tt.output})
+		if err != nil {
+			t.Errorf("%s: %s", tt.output, err)
+			continue
+		}
+		if out != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.output, out, tt.want)
+		}
+		if counts != (Counts{Deleted: 3}) {
+			t.Errorf("%s: got counts %+v, want 3 deleted", tt.output, counts)
+		}
+	}
+
+	// the live objects recreate what a patch bundle deletes
+	out, _, err := PreviewUninstall(context.Background(), cluster.actionConfig(t), "r", manifest(releaseDocs[:1]), &Options{Output: "patchbundle", WithRollback: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, `"patchType": "delete"`) || !strings.Contains(out, `"rollback": {`) {
+		t.Errorf("got patch bundle\n%s\nwant a delete entry with the live object as its rollback", out)
+	}
+}
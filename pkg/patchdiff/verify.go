@@ -0,0 +1,92 @@
+package patchdiff
+
+import (
+	"encoding/json"
+	"reflect"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+)
+
+// verifyPatch applies patch to base and returns the JSON pointer of the first
+// field of target the result does not match, or "" if it matches. The result
+// may hold more than target, since a three-way patch keeps fields of the live
+// object that the chart does not manage.
+func verifyPatch(base, patch, target []byte, patchType types.PatchType, versionedObject runtime.Object) (string, error) {
+	var patched []byte
+	var err error
+	if patchType == types.MergePatchType {
+		patched, err = jsonpatch.MergePatch(base, patch)
+	} else {
+		patched, err = strategicpatch.StrategicMergePatch(base, patch, versionedObject)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var want, got interface{}
+	if err := json.Unmarshal(target, &want); err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(patched, &got); err != nil {
+		return "", err
+	}
+	return firstMismatch(want, got, ""), nil
+}
+
+// firstMismatch returns the path of the first value in want that got does not
+// contain. Lists of objects match when every wanted item is contained in some
+// item of got, in any order.
+func firstMismatch(want, got interface{}, path string) string {
+	switch w := want.(type) {
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			return orRoot(path)
+		}
+		for k, v := range w {
+			if mismatch := firstMismatch(v, g[k], path+"/"+escapePointer(k)); mismatch != "" {
+				return mismatch
+			}
+		}
+		return ""
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok {
+			return orRoot(path)
+		}
+		for _, item := range w {
+			if _, isObject := item.(map[string]interface{}); !isObject {
+				if !reflect.DeepEqual(w, g) {
+					return orRoot(path)
+				}
+				return ""
+			}
+			found := false
+			for _, candidate := range g {
+				if firstMismatch(item, candidate, path) == "" {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return orRoot(path)
+			}
+		}
+		return ""
+	default:
+		if !reflect.DeepEqual(want, got) {
+			return orRoot(path)
+		}
+		return ""
+	}
+}
+
+func orRoot(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/postrender"
+)
+
+// execPostRenderer runs an executable as a post-renderer. It behaves like the
+// post-renderer of helm's postrender package, which cannot pass arguments.
+type execPostRenderer struct {
+	binaryPath string
+	args       []string
+}
+
+// newPostRenderer returns a post-renderer that runs binaryPath with args.
+// Like helm, a path without separators is searched for in $PATH, and other
+// paths are resolved to an absolute path.
+func newPostRenderer(binaryPath string, args []string) (postrender.PostRenderer, error) {
+	checkedPath, err := exec.LookPath(binaryPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to find binary at %s", binaryPath)
+	}
+	fullPath, err := filepath.Abs(checkedPath)
+	if err != nil {
+		return nil, err
+	}
+	return &execPostRenderer{binaryPath: fullPath, args: args}, nil
+}
+
+// Run pipes the rendered manifests through the executable and returns its
+// output.
+func (p *execPostRenderer) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	cmd := exec.Command(p.binaryPath, p.args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	postRendered := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd.Stdout = postRendered
+	cmd.Stderr = stderr
+
+	go func() {
+		defer stdin.Close()
+		io.Copy(stdin, renderedManifests)
+	}()
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "error while running command %s. error output:\n%s", p.binaryPath, stderr.String())
+	}
+	return postRendered, nil
+}
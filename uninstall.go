@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/bacongobbler/helm-patchdiff/pkg/patchdiff"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage/driver"
+)
+
+func newUninstallCmd() *cobra.Command {
+	opts := &options{}
+
+	cmd := &cobra.Command{
+		Use:   "uninstall <NAME> [options]",
+		Short: "Preview which resources helm uninstall would delete",
+		Long:  "Preview which live resources helm uninstall would delete, and which it would keep because of their resource policy",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			if err := validateReleaseName(name); err != nil {
+				log.Fatal(err)
+			}
+			switch opts.Output {
+			case "json", "raw", "patchbundle", "junit", "delta", "argocd", "diff":
+			default:
+				log.Fatalf("invalid output %q: must be one of json, raw, patchbundle, junit, delta, argocd, diff", opts.Output)
+			}
+			if err := opts.Validate(); err != nil {
+				log.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+			defer cancel()
+			actionConfig, err := newActionConfig(ctx, opts)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			// like helm uninstall, act on the latest revision whatever its status
+			lastRelease, err := actionConfig.Releases.Last(name)
+			if err != nil {
+				if errors.Is(err, driver.ErrReleaseNotFound) {
+					log.Fatalf("release: %q not found", name)
+				}
+				log.Fatal(err)
+			}
+			if lastRelease.Info.Status == release.StatusUninstalled {
+				log.Fatalf("release %q is already uninstalled", name)
+			}
+
+			stdout := newOutputWriter(opts.Gzip)
+			out, _, err := patchdiff.PreviewUninstall(ctx, actionConfig, name, lastRelease.Manifest, &opts.Options)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Fprintln(stdout, out)
+			if err := stdout.Close(); err != nil {
+				log.Fatal(err)
+			}
+			return nil
+		},
+	}
+
+	f := cmd.Flags()
+	addTimeoutFlag(f, opts)
+	f.StringVarP(&opts.Output, "output", "o", "json", "output format, as for a diff: json, raw, patchbundle, junit, delta, argocd or diff")
+	f.BoolVar(&opts.WithRollback, "with-rollback", false, "add to each patchbundle entry the live object, which recreates the resource")
+	f.BoolVar(&opts.Gzip, "gzip", false, "gzip-compress the output, for archiving")
+	f.BoolVar(&opts.BatchFetch, "batch-fetch", false, "fetch live objects with one list call per kind and namespace when a release has several resources of that kind")
+
+	return cmd
+}
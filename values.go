@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Masterminds/sprig/v3"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/cli/values"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/strvals"
+	"sigs.k8s.io/yaml"
+)
+
+// valueOptions are the value flags of helm upgrade. The values.Options of the
+// helm version patchdiff is built with has no --set-json or --set-literal
+// values, so they are kept next to it. timeout bounds each download of a
+// remote file, without a bound when zero.
+type valueOptions struct {
+	values.Options
+	JSONValues    []string
+	LiteralValues []string
+	timeout       time.Duration
+}
+
+// MergeValues merges the values in helm's order of precedence, lowest first:
+// values files, --set-json, --set, --set-string, --set-file and --set-literal.
+// Each values file is named in the errors it causes.
+func (v *valueOptions) MergeValues(p getter.Providers) (map[string]interface{}, error) {
+	// a missing local file fails fast, before any remote file is fetched
+	for _, filePath := range v.ValueFiles {
+		if isLocalValuesFile(filePath, p) {
+			if _, err := os.Stat(filePath); err != nil {
+				return nil, errors.Wrapf(err, "invalid values file %s", filePath)
+			}
+		}
+	}
+
+	base := map[string]interface{}{}
+	for _, filePath := range v.ValueFiles {
+		data, err := readValuesFile(filePath, p, v.timeout)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read values file %s", filePath)
+		}
+		current := map[string]interface{}{}
+		if err := yaml.Unmarshal(data, &current); err != nil {
+			return nil, errors.Wrapf(err, "unable to parse values file %s", filePath)
+		}
+		base = mergeMaps(base, current)
+	}
+
+	if err := mergeJSONValues(base, v.JSONValues); err != nil {
+		return nil, err
+	}
+
+	// the same as values.Options, which cannot merge into existing values
+	for _, value := range v.Values {
+		if err := strvals.ParseInto(value, base); err != nil {
+			return nil, errors.Wrap(err, "failed parsing --set data")
+		}
+	}
+	for _, value := range v.StringValues {
+		if err := strvals.ParseIntoString(value, base); err != nil {
+			return nil, errors.Wrap(err, "failed parsing --set-string data")
+		}
+	}
+	for _, value := range v.FileValues {
+		reader := func(rs []rune) (interface{}, error) {
+			bytes, err := readValuesFile(string(rs), p, v.timeout)
+			if err != nil {
+				return nil, errors.Wrapf(err, "unable to read %s", string(rs))
+			}
+			return string(bytes), nil
+		}
+		if err := strvals.ParseIntoFile(value, base, reader); err != nil {
+			return nil, errors.Wrap(err, "failed parsing --set-file data")
+		}
+	}
+
+	for _, s := range v.LiteralValues {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.Errorf("invalid --set-literal %q: must be of the form key=value", s)
+		}
+		if err := setValue(base, splitKey(kv[0]), kv[1]); err != nil {
+			return nil, errors.Wrapf(err, "invalid --set-literal %q", s)
+		}
+	}
+	return base, nil
+}
+
+// readValuesFile reads a values or --set-file file as helm does: from stdin
+// for "-", with the getter for its URL scheme, or else from the local
+// filesystem. Downloads give up after timeout, unless it is zero.
+func readValuesFile(filePath string, p getter.Providers, timeout time.Duration) ([]byte, error) {
+	if strings.TrimSpace(filePath) == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	u, _ := url.Parse(filePath)
+	g, err := p.ByScheme(u.Scheme)
+	if err != nil {
+		return ioutil.ReadFile(filePath)
+	}
+	// errors of the http getter already hold the status of the response
+	data, err := g.Get(filePath, getter.WithURL(filePath), getter.WithTimeout(timeout))
+	if err != nil {
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
+
+// isLocalValuesFile reports whether readValuesFile reads filePath from the
+// local filesystem.
+func isLocalValuesFile(filePath string, p getter.Providers) bool {
+	if strings.TrimSpace(filePath) == "-" {
+		return false
+	}
+	u, err := url.Parse(filePath)
+	if err != nil {
+		return true
+	}
+	_, err = p.ByScheme(u.Scheme)
+	return err != nil
+}
+
+// mergeMaps merges b into a copy of a, as helm merges values files: maps are
+// merged key by key, and any other value of b replaces that of a.
+func mergeMaps(a, b map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(a))
+	for k, v := range a {
+		out[k] = v
+	}
+	for k, v := range b {
+		if v, ok := v.(map[string]interface{}); ok {
+			if av, ok := out[k].(map[string]interface{}); ok {
+				out[k] = mergeMaps(av, v)
+				continue
+			}
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// mergeJSONValues merges values given as key=json into vals. Several values
+// can be separated by commas, as in key1=[1,2],key2={"a":true}.
+func mergeJSONValues(vals map[string]interface{}, jsonValues []string) error {
+	for _, s := range jsonValues {
+		rest := s
+		for rest != "" {
+			kv := strings.SplitN(rest, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return errors.Errorf("invalid --set-json %q: must be of the form key=json", s)
+			}
+			var value interface{}
+			dec := json.NewDecoder(strings.NewReader(kv[1]))
+			if err := dec.Decode(&value); err != nil {
+				return errors.Wrapf(err, "invalid --set-json %q", s)
+			}
+			if err := setValue(vals, splitKey(kv[0]), value); err != nil {
+				return errors.Wrapf(err, "invalid --set-json %q", s)
+			}
+
+			rest = strings.TrimSpace(kv[1][dec.InputOffset():])
+			if rest != "" {
+				if rest[0] != ',' {
+					return errors.Errorf("invalid --set-json %q: values must be separated by commas", s)
+				}
+				rest = rest[1:]
+			}
+		}
+	}
+	return nil
+}
+
+// validateEnvValuesPattern checks that pattern expands an environment name
+// exactly once, with a single %s and no other verbs. A literal percent sign
+// is written %%.
+func validateEnvValuesPattern(pattern string) error {
+	verbs := strings.Split(strings.Replace(pattern, "%%", "", -1), "%")[1:]
+	if len(verbs) != 1 || !strings.HasPrefix(verbs[0], "s") {
+		return errors.Errorf("invalid --env-values-pattern %q: must contain exactly one %%s, for the environment name", pattern)
+	}
+	return nil
+}
+
+// envValuesFile finds the values file for env by expanding pattern, looking
+// inside the chart directory first and next to the chart second.
+func envValuesFile(chartPath, env, pattern string) (string, error) {
+	name := fmt.Sprintf(pattern, env)
+	candidates := []string{
+		filepath.Join(chartPath, name),
+		filepath.Join(filepath.Dir(filepath.Clean(chartPath)), name),
+	}
+	for _, c := range candidates {
+		if fi, err := os.Stat(c); err == nil && !fi.IsDir() {
+			return c, nil
+		}
+	}
+	return "", errors.Errorf("values file for environment %q not found, looked for %s", env, strings.Join(candidates, " and "))
+}
+
+// valuesDirFiles returns the *.yaml and *.yml files in dir in lexical order.
+// With recursive set, files in subdirectories are included, ordered by their
+// path relative to dir.
+func valuesDirFiles(dir string, recursive bool) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if path != dir && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ext := filepath.Ext(path); ext == ".yaml" || ext == ".yml" {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read values directory %s", dir)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// renderValuesFiles renders each local values file as a template with the
+// sprig functions into dir, and returns the paths of the rendered files in
+// place of the originals. Templates see the chart's default values as .Values
+// and the environment as .Env. Remote files are passed through unchanged.
+func renderValuesFiles(files []string, chartValues map[string]interface{}, dir string) ([]string, error) {
+	env := map[string]string{}
+	for _, kv := range os.Environ() {
+		if parts := strings.SplitN(kv, "=", 2); len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+	data := map[string]interface{}{"Values": chartValues, "Env": env}
+
+	rendered := make([]string, len(files))
+	for i, file := range files {
+		if strings.Contains(file, "://") {
+			rendered[i] = file
+			continue
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		// the template is named after the file so errors point at file:line
+		tpl, err := template.New(file).Funcs(sprig.TxtFuncMap()).Parse(string(content))
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to parse values template")
+		}
+		b := bytes.NewBuffer(nil)
+		if err := tpl.Execute(b, data); err != nil {
+			return nil, errors.Wrap(err, "unable to render values template")
+		}
+		rendered[i] = filepath.Join(dir, fmt.Sprintf("%d-%s", i, filepath.Base(file)))
+		if err := ioutil.WriteFile(rendered[i], b.Bytes(), 0600); err != nil {
+			return nil, err
+		}
+	}
+	return rendered, nil
+}
+
+// checkJSONValues fails unless the file at path holds a JSON object.
+func checkJSONValues(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return errors.Wrapf(err, "unable to parse JSON values file %s", path)
+	}
+	return nil
+}
+
+// mergeTypedValues merges values given as key:type=value into vals, coercing
+// each value to the named type. Nested keys are separated by dots; a literal
+// dot can be escaped with a backslash.
+func mergeTypedValues(vals map[string]interface{}, typedValues []string) error {
+	for _, s := range typedValues {
+		kv := strings.SplitN(s, "=", 2)
+		sep := strings.LastIndex(kv[0], ":")
+		if len(kv) != 2 || sep <= 0 {
+			return errors.Errorf("invalid --set-type %q: must be of the form key:type=value", s)
+		}
+		key, typ, raw := kv[0][:sep], kv[0][sep+1:], kv[1]
+
+		var value interface{}
+		var err error
+		switch typ {
+		case "string":
+			value = raw
+		case "int":
+			value, err = strconv.ParseInt(raw, 10, 64)
+		case "float":
+			value, err = strconv.ParseFloat(raw, 64)
+		case "bool":
+			value, err = strconv.ParseBool(raw)
+		default:
+			return errors.Errorf("invalid --set-type %q: type must be one of string, int, float, bool", s)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "invalid --set-type %q", s)
+		}
+
+		if err := setValue(vals, splitKey(key), value); err != nil {
+			return errors.Wrapf(err, "invalid --set-type %q", s)
+		}
+	}
+	return nil
+}
+
+// mergeStringFileValues merges values given as key=path into vals, using the
+// content of each file as a literal string.
+func mergeStringFileValues(vals map[string]interface{}, fileValues []string) error {
+	for _, s := range fileValues {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return errors.Errorf("invalid --set-string-file %q: must be of the form key=path", s)
+		}
+		data, err := ioutil.ReadFile(kv[1])
+		if err != nil {
+			return errors.Wrapf(err, "invalid --set-string-file %q", s)
+		}
+		if err := setValue(vals, splitKey(kv[0]), string(data)); err != nil {
+			return errors.Wrapf(err, "invalid --set-string-file %q", s)
+		}
+	}
+	return nil
+}
+
+// setValue sets value at the nested path in vals, creating intermediate maps
+// as needed.
+func setValue(vals map[string]interface{}, path []string, value interface{}) error {
+	for i, k := range path[:len(path)-1] {
+		next, ok := vals[k]
+		if !ok || next == nil {
+			next = map[string]interface{}{}
+			vals[k] = next
+		}
+		m, ok := next.(map[string]interface{})
+		if !ok {
+			return errors.Errorf("%s is not a map", strings.Join(path[:i+1], "."))
+		}
+		vals = m
+	}
+	vals[path[len(path)-1]] = value
+	return nil
+}
+
+// splitKey splits a dotted key, honoring backslash-escaped dots.
+func splitKey(key string) []string {
+	var parts []string
+	var current strings.Builder
+	for i := 0; i < len(key); i++ {
+		switch {
+		case key[i] == '\\' && i+1 < len(key) && key[i+1] == '.':
+			current.WriteByte('.')
+			i++
+		case key[i] == '.':
+			parts = append(parts, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(key[i])
+		}
+	}
+	return append(parts, current.String())
+}
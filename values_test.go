@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/cli/values"
+	"helm.sh/helm/v3/pkg/getter"
+)
+
+// writeFile writes data to name in dir and returns its path.
+func writeFile(t *testing.T, dir, name, data string) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestMergeValuesPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	first := writeFile(t, dir, "first.yaml", "a: file1\nb: file1\nnested:\n  x: file1\n  w: file1\n")
+	second := writeFile(t, dir, "second.yaml", "a: file2\nnested:\n  x: file2\n")
+	content := writeFile(t, dir, "content.txt", "from-file")
+
+	for _, tt := range []struct {
+		name string
+		opts valueOptions
+		want string
+	}{
+		{
+			name: "later files win",
+			opts: valueOptions{Options: values.Options{ValueFiles: []string{first, second}}},
+			want: `{"a":"file2","b":"file1","nested":{"w":"file1","x":"file2"}}`,
+		},
+		{
+			name: "repeated --set",
+			opts: valueOptions{Options: values.Options{Values: []string{"a=1", "a=2", "b=x,b=y"}}},
+			want: `{"a":2,"b":"y"}`,
+		},
+		{
+			name: "--set over files",
+			opts: valueOptions{Options: values.Options{ValueFiles: []string{first, second}, Values: []string{"nested.w=set"}}},
+			want: `{"a":"file2","b":"file1","nested":{"w":"set","x":"file2"}}`,
+		},
+		{
+			name: "--set over --set-json",
+			opts: valueOptions{Options: values.Options{Values: []string{"a=set"}}, JSONValues: []string{`a="json"`, `b={"c":1}`}},
+			want: `{"a":"set","b":{"c":1}}`,
+		},
+		{
+			name: "repeated --set-json",
+			opts: valueOptions{JSONValues: []string{`a=[1]`, `a=[2,3]`}},
+			want: `{"a":[2,3]}`,
+		},
+		{
+			name: "--set-string over --set",
+			opts: valueOptions{Options: values.Options{Values: []string{"a=1"}, StringValues: []string{"a=2"}}},
+			want: `{"a":"2"}`,
+		},
+		{
+			name: "--set-file over --set-string",
+			opts: valueOptions{Options: values.Options{StringValues: []string{"a=string"}, FileValues: []string{"a=" + content}}},
+			want: `{"a":"from-file"}`,
+		},
+		{
+			name: "--set-literal over everything",
+			opts: valueOptions{
+				Options: values.Options{
+					ValueFiles:   []string{first},
+					Values:       []string{"a=set"},
+					StringValues: []string{"a=string"},
+					FileValues:   []string{"a=" + content},
+				},
+				JSONValues:    []string{`a="json"`},
+				LiteralValues: []string{"a=x,y={z}"},
+			},
+			want: `{"a":"x,y={z}","b":"file1","nested":{"w":"file1","x":"file1"}}`,
+		},
+		{
+			// --set-json replaces the map of the file, as in helm, and
+			// --set then sets a key of it
+			name: "each kind wins on its own key",
+			opts: valueOptions{
+				Options: values.Options{
+					ValueFiles:   []string{first},
+					Values:       []string{"nested.x=set", "s=1"},
+					StringValues: []string{"s=1"},
+				},
+				JSONValues:    []string{`nested={"x":"json","z":true}`},
+				LiteralValues: []string{"b=literal"},
+			},
+			want: `{"a":"file1","b":"literal","nested":{"x":"set","z":true},"s":"1"}`,
+		},
+	} {
+		vals, err := tt.opts.MergeValues(getter.Providers{})
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		got, err := json.Marshal(vals)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMergeTypedValues(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		// vals are the values merged into, as JSON
+		vals    string
+		values  []string
+		want    string
+		wantErr string
+	}{
+		{name: "string", values: []string{"image.tag:string=1.10"}, want: `{"image":{"tag":"1.10"}}`},
+		{name: "int", values: []string{"replicas:int=3"}, want: `{"replicas":3}`},
+		{name: "float", values: []string{"ratio:float=0.5"}, want: `{"ratio":0.5}`},
+		{name: "bool", values: []string{"enabled:bool=false"}, want: `{"enabled":false}`},
+		{name: "string that looks like a bool", values: []string{"flag:string=true"}, want: `{"flag":"true"}`},
+		{name: "escaped dot", values: []string{`annotations.example\.com/a:string=x`}, want: `{"annotations":{"example.com/a":"x"}}`},
+		{name: "colon in the key", values: []string{"a:b:string=c"}, want: `{"a:b":"c"}`},
+		{name: "equals in the value", values: []string{"args:string=--a=b"}, want: `{"args":"--a=b"}`},
+		{name: "last wins", values: []string{"a:int=1", "a:string=2"}, want: `{"a":"2"}`},
+		{name: "overrides existing values", vals: `{"existing":{"a":1}}`, values: []string{"existing.b:int=2"}, want: `{"existing":{"a":1,"b":2}}`},
+		{name: "no type", values: []string{"a=1"}, wantErr: `invalid --set-type "a=1": must be of the form key:type=value`},
+		{name: "no value", values: []string{"a:int"}, wantErr: `invalid --set-type "a:int": must be of the form key:type=value`},
+		{name: "unknown type", values: []string{"a:list=1"}, wantErr: `invalid --set-type "a:list=1": type must be one of string, int, float, bool`},
+		{name: "bad int", values: []string{"a:int=x"}, wantErr: `invalid --set-type "a:int=x": strconv.ParseInt: parsing "x": invalid syntax`},
+		{name: "bad bool", values: []string{"a:bool=yes"}, wantErr: `invalid --set-type "a:bool=yes": strconv.ParseBool: parsing "yes": invalid syntax`},
+		{name: "not a map", vals: `{"existing":{"a":1}}`, values: []string{"existing.a.b:int=1"}, wantErr: `invalid --set-type "existing.a.b:int=1": existing.a is not a map`},
+	} {
+		vals := map[string]interface{}{}
+		if tt.vals != "" {
+			if err := json.Unmarshal([]byte(tt.vals), &vals); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := mergeTypedValues(vals, tt.values)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%s: got error %v, want %s", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		got, err := json.Marshal(vals)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMergeStringFileValues(t *testing.T) {
+	dir := t.TempDir()
+	yamlLike := writeFile(t, dir, "config.yaml", "a: 1\nb: [true]\n")
+	number := writeFile(t, dir, "number.txt", "0123")
+
+	for _, tt := range []struct {
+		name    string
+		values  []string
+		want    string
+		wantErr string
+	}{
+		{name: "YAML stays a string", values: []string{"config=" + yamlLike}, want: `{"config":"a: 1\nb: [true]\n"}`},
+		{name: "numbers stay strings", values: []string{"nested.id=" + number}, want: `{"nested":{"id":"0123"}}`},
+		{name: "last wins", values: []string{"a=" + yamlLike, "a=" + number}, want: `{"a":"0123"}`},
+		{name: "no path", values: []string{"a="}, wantErr: `invalid --set-string-file "a=": must be of the form key=path`},
+		{name: "no key", values: []string{"=" + number}, wantErr: `invalid --set-string-file "=` + number + `": must be of the form key=path`},
+		{name: "missing file", values: []string{"a=" + filepath.Join(dir, "missing")}, wantErr: `invalid --set-string-file "a=` + filepath.Join(dir, "missing") + `": open ` + filepath.Join(dir, "missing") + `: no such file or directory`},
+	} {
+		vals := map[string]interface{}{}
+		err := mergeStringFileValues(vals, tt.values)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%s: got error %v, want %s", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		got, err := json.Marshal(vals)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadChartValuesJSON(t *testing.T) {
+	dir := t.TempDir()
+	chartDir := filepath.Join(dir, "chart")
+	if err := os.Mkdir(chartDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, chartDir, "Chart.yaml", "apiVersion: v2\nname: chart\nversion: 0.1.0\n")
+	valuesFile := writeFile(t, dir, "values.yaml", "a: file\nb: file\nc: file\nnested:\n  x: file\n  w: file\n")
+	valuesJSON := writeFile(t, dir, "values.json", `{"a":"json","b":"json","nested":{"x":"json"}}`)
+
+	valueOpts := &valueOptions{Options: values.Options{ValueFiles: []string{valuesFile}, Values: []string{"a=set"}}}
+	_, vals, err := loadChart(chartDir, valueOpts, &options{valuesJSON: valuesJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := json.Marshal(vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the JSON file is merged after the other files, and --set still wins
+	if want := `{"a":"set","b":"json","c":"file","nested":{"w":"file","x":"json"}}`; string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if len(valueOpts.ValueFiles) != 1 {
+		t.Errorf("the JSON file was added to the shared value options: %v", valueOpts.ValueFiles)
+	}
+
+	for _, data := range []string{"a: yaml\n", `["a"]`} {
+		notObject := writeFile(t, dir, "invalid.json", data)
+		if _, _, err := loadChart(chartDir, valueOpts, &options{valuesJSON: notObject}); err == nil || !strings.Contains(err.Error(), "unable to parse JSON values file") {
+			t.Errorf("%q: expected the JSON values file to be rejected, got %v", data, err)
+		}
+	}
+}
+
+func TestValidateEnvValuesPattern(t *testing.T) {
+	for _, tt := range []struct {
+		pattern string
+		valid   bool
+	}{
+		{"values-%s.yaml", true},
+		{"%s/values.yaml", true},
+		{"values-%s-100%%.yaml", true},
+		{"values.yaml", false},
+		{"values-%s-%s.yaml", false},
+		{"values-%d.yaml", false},
+		{"values-%s-%v.yaml", false},
+		{"values-%s%", false},
+		{"values-%%s.yaml", false},
+	} {
+		err := validateEnvValuesPattern(tt.pattern)
+		if tt.valid && err != nil {
+			t.Errorf("%q: %s", tt.pattern, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%q: expected the pattern to be rejected", tt.pattern)
+		}
+	}
+}
+
+func TestValuesDirFiles(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"b.yml", "a.yaml", "c.yaml", "notes.txt", "values.json"} {
+		writeFile(t, dir, name, "a: 1\n")
+	}
+	writeFile(t, sub, "d.yml", "a: 1\n")
+	for _, tt := range []struct {
+		recursive bool
+		want      []string
+	}{
+		{false, []string{"a.yaml", "b.yml", "c.yaml"}},
+		{true, []string{"a.yaml", "b.yml", "c.yaml", "sub/d.yml"}},
+	} {
+		files, err := valuesDirFiles(dir, tt.recursive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, f := range files {
+			rel, err := filepath.Rel(dir, f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, filepath.ToSlash(rel))
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("recursive %v: got %v, want %v", tt.recursive, got, tt.want)
+		}
+	}
+}